@@ -1,13 +1,21 @@
 package hamster
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/lann/builder"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
+// ErrInvalidStage is returned when an aggregate stage is malformed or misplaced
+var ErrInvalidStage = errors.New("hamster: invalid aggregate stage")
+
 // aggregateDoc is a MQL aggregate pipeline
 type aggregateDoc struct {
 	Pipeline bson.A
+	// Errors collects the problems found while building the pipeline
+	Errors []error
 }
 
 // aggregateDocBuilder is a builder for aggregateDoc
@@ -18,15 +26,37 @@ var (
 	AggregateDocBuilder = builder.Register(aggregateDocBuilder{}, aggregateDoc{}).(aggregateDocBuilder)
 )
 
+// Doc returns the aggregateDoc instance, misplaced $out, $merge and firstStages
+// stages such as $geoNear are reported by its Err
 func (a aggregateDocBuilder) Doc() aggregateDoc {
-	return builder.GetStruct(a).(aggregateDoc)
+	return builder.GetStruct(a.checkOutputLast().checkFirstStages()).(aggregateDoc)
 }
 
 func (a aggregateDoc) ToA() bson.A {
 	return a.Pipeline
 }
 
+// ToD returns the pipeline as { pipeline: [ <stages> ] }, like MarshalBSON
+func (a aggregateDoc) ToD() bson.D {
+	return bson.D{{Key: "pipeline", Value: a.Pipeline}}
+}
+
+func (a aggregateDoc) ToM() bson.M {
+	return a.ToD().Map()
+}
+
+// Err returns the first error found while building the pipeline
+func (a aggregateDoc) Err() error {
+	if len(a.Errors) == 0 {
+		return nil
+	}
+	return a.Errors[0]
+}
+
 func (a aggregateDoc) MarshalBSON() ([]byte, error) {
+	if err := a.Err(); err != nil {
+		return nil, err
+	}
 	return bson.Marshal(bson.D{{Key: "pipeline", Value: a.Pipeline}})
 }
 
@@ -41,24 +71,103 @@ func (a *aggregateDoc) UnmarshalBSON(data []byte) error {
 	return nil
 }
 
+// fail records err on the pipeline, it is reported by aggregateDoc.Err
+func (a aggregateDocBuilder) fail(err error) aggregateDocBuilder {
+	return builder.Append(a, "Errors", err).(aggregateDocBuilder)
+}
+
+// failf records a formatted ErrInvalidStage on the pipeline
+func (a aggregateDocBuilder) failf(format string, args ...interface{}) aggregateDocBuilder {
+	return a.fail(fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidStage}, args...)...))
+}
+
+// inherit records the errors of a nested pipeline
+func (a aggregateDocBuilder) inherit(sub aggregateDoc) aggregateDocBuilder {
+	for _, err := range sub.Errors {
+		a = a.fail(err)
+	}
+	return a
+}
+
+// pipelineOf returns v as a pipeline, v is an aggregateDoc, an
+// AggregateDocBuilder, a bson.A or a []bson.D
+func pipelineOf(v interface{}) (aggregateDoc, bool) {
+	switch p := v.(type) {
+	case aggregateDoc:
+		return p, true
+	case aggregateDocBuilder:
+		return p.Doc(), true
+	case bson.A:
+		return aggregateDoc{Pipeline: p}, true
+	case []bson.D:
+		stages := make(bson.A, 0, len(p))
+		for _, stage := range p {
+			stages = append(stages, stage)
+		}
+		return aggregateDoc{Pipeline: stages}, true
+	}
+	return aggregateDoc{}, false
+}
+
+// withPipeline replaces the stages of the pipeline, later stages can still be appended
+func (a aggregateDocBuilder) withPipeline(stages bson.A) aggregateDocBuilder {
+	a = builder.Delete(a, "Pipeline").(aggregateDocBuilder)
+	return builder.Extend(a, "Pipeline", stages).(aggregateDocBuilder)
+}
+
+// concat appends the stages of another pipeline and records its errors
+func (a aggregateDocBuilder) concat(other aggregateDoc) aggregateDocBuilder {
+	a = a.inherit(other)
+	return builder.Extend(a, "Pipeline", other.ToA()).(aggregateDocBuilder)
+}
+
+// inheritGroup records the errors of a nested groupDoc
+func (a aggregateDocBuilder) inheritGroup(g groupDoc) aggregateDocBuilder {
+	for _, err := range g.Errors {
+		a = a.fail(err)
+	}
+	return a
+}
+
 func (a aggregateDocBuilder) stage(stage string, value interface{}) aggregateDocBuilder {
 	return builder.Append(a, "Pipeline", bson.D{{Key: stage, Value: value}}).(aggregateDocBuilder)
 }
 
-func (a aggregateDocBuilder) Match(filter bson.D) aggregateDocBuilder {
-	return a.stage("$match", filter)
+// document appends { <stage>: <doc> } and records the errors of doc, which is
+// a hamster doc or builder, a bson.D or a bson.M
+func (a aggregateDocBuilder) document(stage string, doc interface{}) aggregateDocBuilder {
+	d, ok := toDocument(doc)
+	if !ok {
+		return a.failf("%s needs a document, got %T", stage, doc)
+	}
+	for _, err := range docErrors(doc) {
+		a = a.fail(err)
+	}
+	return a.stage(stage, d)
+}
+
+// Match appends { $match: <filter> }, filter is a filterDoc, a FilterDocBuilder, a bson.D or a bson.M
+func (a aggregateDocBuilder) Match(filter interface{}) aggregateDocBuilder {
+	return a.document("$match", filter)
 }
 
-func (a aggregateDocBuilder) Project(project bson.D) aggregateDocBuilder {
-	return a.stage("$project", project)
+// Project appends { $project: <project> }, project is a projectDoc, a ProjectDocBuilder, a bson.D or a bson.M
+func (a aggregateDocBuilder) Project(project interface{}) aggregateDocBuilder {
+	return a.document("$project", project)
 }
 
-func (a aggregateDocBuilder) Group(group bson.D) aggregateDocBuilder {
-	return a.stage("$group", group)
+// Group appends { $group: <group> }, group is a groupDoc, a GroupDocBuilder, a bson.D or a bson.M
+func (a aggregateDocBuilder) Group(group interface{}) aggregateDocBuilder {
+	return a.document("$group", group)
 }
 
-func (a aggregateDocBuilder) Sort(sort bson.D) aggregateDocBuilder {
-	return a.stage("$sort", sort)
+// Sort appends { $sort: <sort> }, sort is a sortDoc, a SortDocBuilder, a bson.D or a
+// bson.M with a single key since the order of bson.M keys is lost
+func (a aggregateDocBuilder) Sort(sort interface{}) aggregateDocBuilder {
+	if m, ok := sort.(bson.M); ok && len(m) > 1 {
+		return a.failf("$sort needs an ordered document, got a bson.M with %d keys", len(m))
+	}
+	return a.document("$sort", sort)
 }
 
 func (a aggregateDocBuilder) Limit(limit int64) aggregateDocBuilder {
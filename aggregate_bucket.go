@@ -0,0 +1,86 @@
+package hamster
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// bucketGranularities are the preferred number series accepted by $bucketAuto
+var bucketGranularities = map[string]bool{
+	"R5":        true,
+	"R10":       true,
+	"R20":       true,
+	"R40":       true,
+	"R80":       true,
+	"1-2-5":     true,
+	"E6":        true,
+	"E12":       true,
+	"E24":       true,
+	"E48":       true,
+	"E96":       true,
+	"E192":      true,
+	"POWERSOF2": true,
+}
+
+// Bucket adds a $bucket stage, boundaries must be sorted ascending, unique and
+// of one type. The output accumulators come from a GroupDocBuilder whose _id is
+// ignored, a nil defaultBucket and an empty output are left out.
+// { $bucket: { groupBy: <expression>, boundaries: [ <lowerbound1>, ... ], default: <literal>, output: { <field>: { <accumulator>: <expression> }, ... } } }
+func (a aggregateDocBuilder) Bucket(groupBy interface{}, boundaries []interface{}, defaultBucket interface{}, output groupDoc) aggregateDocBuilder {
+	if groupBy == nil {
+		return a.failf("$bucket requires groupBy")
+	}
+	if len(boundaries) < 2 {
+		return a.failf("$bucket requires at least two boundaries, got %d", len(boundaries))
+	}
+	for i := 1; i < len(boundaries); i++ {
+		if typeOrder(boundaries[i]) != typeOrder(boundaries[0]) {
+			return a.failf("$bucket boundaries must be of one type, %v and %v differ", boundaries[0], boundaries[i])
+		}
+		if compareValues(boundaries[i-1], boundaries[i]) >= 0 {
+			return a.failf("$bucket boundaries must be sorted ascending and unique, %v is not below %v", boundaries[i-1], boundaries[i])
+		}
+	}
+	if defaultBucket != nil && typeOrder(defaultBucket) == typeOrder(boundaries[0]) &&
+		compareValues(defaultBucket, boundaries[0]) >= 0 &&
+		compareValues(defaultBucket, boundaries[len(boundaries)-1]) < 0 {
+		return a.failf("$bucket default %v must be outside the boundaries", defaultBucket)
+	}
+	a = a.inheritGroup(output)
+
+	arr := make(bson.A, 0, len(boundaries))
+	for _, b := range boundaries {
+		arr = append(arr, bsonValue(b))
+	}
+	d := bson.D{{Key: "groupBy", Value: bsonValue(groupBy)}, {Key: "boundaries", Value: arr}}
+	if defaultBucket != nil {
+		d = append(d, bson.E{Key: "default", Value: defaultBucket})
+	}
+	if len(output.Fields) > 0 {
+		d = append(d, bson.E{Key: "output", Value: output.Fields})
+	}
+	return a.stage("$bucket", d)
+}
+
+// BucketAuto adds a $bucketAuto stage, an empty output and granularity are left out
+// { $bucketAuto: { groupBy: <expression>, buckets: <number>, output: { <field>: { <accumulator>: <expression> }, ... }, granularity: <string> } }
+func (a aggregateDocBuilder) BucketAuto(groupBy interface{}, buckets int32, output groupDoc, granularity string) aggregateDocBuilder {
+	if groupBy == nil {
+		return a.failf("$bucketAuto requires groupBy")
+	}
+	if buckets < 1 {
+		return a.failf("$bucketAuto buckets must be positive, got %d", buckets)
+	}
+	if granularity != "" && !bucketGranularities[granularity] {
+		return a.failf("$bucketAuto granularity %q is not a preferred number series", granularity)
+	}
+	a = a.inheritGroup(output)
+
+	d := bson.D{{Key: "groupBy", Value: bsonValue(groupBy)}, {Key: "buckets", Value: buckets}}
+	if len(output.Fields) > 0 {
+		d = append(d, bson.E{Key: "output", Value: output.Fields})
+	}
+	if granularity != "" {
+		d = append(d, bson.E{Key: "granularity", Value: granularity})
+	}
+	return a.stage("$bucketAuto", d)
+}
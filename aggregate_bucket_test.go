@@ -0,0 +1,84 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAggregateBucket(t *testing.T) {
+	// { $bucket: { groupBy: "$price", boundaries: [ 0, 200, 400 ], default: "Other",
+	//   output: { count: { $sum: 1 }, titles: { $push: "$title" } } } }
+	output := GroupDocBuilder.Sum("count", 1).Push("titles", "$title").Doc()
+	doc := AggregateDocBuilder.Bucket(Expr.Field("price"), []interface{}{0, 200, 400}, "Other", output).Doc()
+	std := bson.D{{Key: "$bucket", Value: bson.D{
+		{Key: "groupBy", Value: "$price"},
+		{Key: "boundaries", Value: bson.A{0, 200, 400}},
+		{Key: "default", Value: "Other"},
+		{Key: "output", Value: bson.D{
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "titles", Value: bson.D{{Key: "$push", Value: "$title"}}},
+		}},
+	}}}
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, std, doc.ToA()[0])
+
+	doc = AggregateDocBuilder.Bucket("$price", []interface{}{0, 200.5}, nil, GroupDocBuilder.Doc()).Doc()
+	std = bson.D{{Key: "$bucket", Value: bson.D{
+		{Key: "groupBy", Value: "$price"},
+		{Key: "boundaries", Value: bson.A{0, 200.5}},
+	}}}
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, std, doc.ToA()[0])
+}
+
+func TestAggregateBucketValidate(t *testing.T) {
+	empty := GroupDocBuilder.Doc()
+	cases := map[string]aggregateDoc{
+		"too-few":      AggregateDocBuilder.Bucket("$price", []interface{}{0}, nil, empty).Doc(),
+		"unsorted":     AggregateDocBuilder.Bucket("$price", []interface{}{200, 0}, nil, empty).Doc(),
+		"duplicate":    AggregateDocBuilder.Bucket("$price", []interface{}{0, 0, 1}, nil, empty).Doc(),
+		"mixed-types":  AggregateDocBuilder.Bucket("$price", []interface{}{0, "a"}, nil, empty).Doc(),
+		"default-in":   AggregateDocBuilder.Bucket("$price", []interface{}{0, 200}, 100, empty).Doc(),
+		"output-error": AggregateDocBuilder.Bucket("$price", []interface{}{0, 200}, nil, GroupDocBuilder.Sum("a.b", 1).Doc()).Doc(),
+	}
+	for name, doc := range cases {
+		require.True(t, errors.Is(doc.Err(), ErrInvalidStage), name)
+	}
+
+	// a default of another type or past the last boundary is allowed
+	require.NoError(t, AggregateDocBuilder.Bucket("$price", []interface{}{0, 200}, 200, empty).Doc().Err())
+	require.NoError(t, AggregateDocBuilder.Bucket("$price", []interface{}{0, 200}, "Other", empty).Doc().Err())
+
+	// large integer boundaries are ordered exactly
+	require.NoError(t, AggregateDocBuilder.Bucket("$id", []interface{}{int64(1 << 53), int64(1<<53 + 1)}, nil, empty).Doc().Err())
+	require.NoError(t, AggregateDocBuilder.Bucket("$id", []interface{}{uint(1), uint64(2)}, nil, empty).Doc().Err())
+}
+
+func TestAggregateBucketAuto(t *testing.T) {
+	// { $bucketAuto: { groupBy: "$price", buckets: 5, output: { count: { $sum: 1 } }, granularity: "R5" } }
+	output := GroupDocBuilder.Sum("count", 1).Doc()
+	doc := AggregateDocBuilder.BucketAuto(Expr.Field("price"), 5, output, "R5").Doc()
+	std := bson.D{{Key: "$bucketAuto", Value: bson.D{
+		{Key: "groupBy", Value: "$price"},
+		{Key: "buckets", Value: int32(5)},
+		{Key: "output", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}}},
+		{Key: "granularity", Value: "R5"},
+	}}}
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, std, doc.ToA()[0])
+
+	doc = AggregateDocBuilder.BucketAuto("$price", 3, GroupDocBuilder.Doc(), "").Doc()
+	require.EqualValues(t, bson.D{{Key: "$bucketAuto", Value: bson.D{
+		{Key: "groupBy", Value: "$price"},
+		{Key: "buckets", Value: int32(3)},
+	}}}, doc.ToA()[0])
+
+	for _, g := range []string{"E12", "1-2-5", "POWERSOF2"} {
+		require.NoError(t, AggregateDocBuilder.BucketAuto("$price", 3, output, g).Doc().Err())
+	}
+	require.True(t, errors.Is(AggregateDocBuilder.BucketAuto("$price", 3, output, "R7").Doc().Err(), ErrInvalidStage))
+	require.True(t, errors.Is(AggregateDocBuilder.BucketAuto("$price", 0, output, "").Doc().Err(), ErrInvalidStage))
+}
@@ -0,0 +1,189 @@
+package hamster
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The editing methods of aggregateDoc return a new pipeline and leave the
+// receiver untouched, so a shared fragment can be customised per caller.
+// Stages are hamster docs or builders, bson.D or bson.M holding one $ key.
+// An index out of range or a missing stage is reported by the result's Err,
+// run Validate on the result to check the stage placement rules.
+
+// edited returns a copy of the pipeline holding stages and the errors of a and errs
+func (a aggregateDoc) edited(stages bson.A, errs ...error) aggregateDoc {
+	out := aggregateDoc{Pipeline: stages}
+	out.Errors = append(out.Errors, a.Errors...)
+	out.Errors = append(out.Errors, errs...)
+	return out
+}
+
+func (a aggregateDoc) failf(format string, args ...interface{}) aggregateDoc {
+	err := fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidStage}, args...)...)
+	return a.edited(append(bson.A{}, a.Pipeline...), err)
+}
+
+// Len returns the number of stages
+func (a aggregateDoc) Len() int {
+	return len(a.Pipeline)
+}
+
+// Find returns the indexes of the stages whose operator is op, such as "$match"
+func (a aggregateDoc) Find(op string) []int {
+	var found []int
+	for i, stage := range a.Pipeline {
+		if stageName(stage) == op {
+			found = append(found, i)
+		}
+	}
+	return found
+}
+
+// stageDocuments converts stages, hamster docs or builders, bson.D or bson.M
+// holding one $ key, it returns the errors they carry and false if one of them
+// is not a stage
+func stageDocuments(stages []interface{}) ([]bson.D, []error, bool) {
+	docs := make([]bson.D, 0, len(stages))
+	var errs []error
+	for _, stage := range stages {
+		d, ok := toDocument(stage)
+		if !ok {
+			return nil, []error{fmt.Errorf("%w: a stage must be a document, got %T", ErrInvalidStage, stage)}, false
+		}
+		if _, _, problem := splitStage(d); problem != "" {
+			return nil, []error{fmt.Errorf("%w: %s", ErrInvalidStage, problem)}, false
+		}
+		errs = append(errs, docErrors(stage)...)
+		docs = append(docs, d)
+	}
+	return docs, errs, true
+}
+
+// insert returns the pipeline with stages inserted at i
+func (a aggregateDoc) insert(i int, stages []interface{}) aggregateDoc {
+	docs, errs, ok := stageDocuments(stages)
+	if !ok {
+		return a.edited(append(bson.A{}, a.Pipeline...), errs...)
+	}
+	out := make(bson.A, 0, len(a.Pipeline)+len(docs))
+	out = append(out, a.Pipeline[:i]...)
+	for _, d := range docs {
+		out = append(out, d)
+	}
+	return a.edited(append(out, a.Pipeline[i:]...), errs...)
+}
+
+// replace returns the pipeline with the stages at indexes replaced by stage
+func (a aggregateDoc) replace(indexes []int, stage interface{}) aggregateDoc {
+	docs, errs, ok := stageDocuments([]interface{}{stage})
+	if !ok {
+		return a.edited(append(bson.A{}, a.Pipeline...), errs...)
+	}
+	out := append(bson.A{}, a.Pipeline...)
+	for _, i := range indexes {
+		out[i] = docs[0]
+	}
+	return a.edited(out, errs...)
+}
+
+// InsertBefore returns the pipeline with stages inserted before the stage at i,
+// i may be Len() to append
+func (a aggregateDoc) InsertBefore(i int, stages ...interface{}) aggregateDoc {
+	if i < 0 || i > len(a.Pipeline) {
+		return a.failf("insert index %d out of range [0, %d]", i, len(a.Pipeline))
+	}
+	return a.insert(i, stages)
+}
+
+// InsertAfter returns the pipeline with stages inserted after the stage at i
+func (a aggregateDoc) InsertAfter(i int, stages ...interface{}) aggregateDoc {
+	if i < 0 || i >= len(a.Pipeline) {
+		return a.failf("insert index %d out of range [0, %d)", i, len(a.Pipeline))
+	}
+	return a.insert(i+1, stages)
+}
+
+// InsertBeforeStage returns the pipeline with stages inserted before the first op stage
+func (a aggregateDoc) InsertBeforeStage(op string, stages ...interface{}) aggregateDoc {
+	found := a.Find(op)
+	if len(found) == 0 {
+		return a.failf("no %s stage to insert before", op)
+	}
+	return a.insert(found[0], stages)
+}
+
+// InsertAfterStage returns the pipeline with stages inserted after the last op stage
+func (a aggregateDoc) InsertAfterStage(op string, stages ...interface{}) aggregateDoc {
+	found := a.Find(op)
+	if len(found) == 0 {
+		return a.failf("no %s stage to insert after", op)
+	}
+	return a.insert(found[len(found)-1]+1, stages)
+}
+
+// Remove returns the pipeline without the stage at i
+func (a aggregateDoc) Remove(i int) aggregateDoc {
+	if i < 0 || i >= len(a.Pipeline) {
+		return a.failf("remove index %d out of range [0, %d)", i, len(a.Pipeline))
+	}
+	out := make(bson.A, 0, len(a.Pipeline)-1)
+	out = append(out, a.Pipeline[:i]...)
+	return a.edited(append(out, a.Pipeline[i+1:]...))
+}
+
+// RemoveStages returns the pipeline without its op stages, it is not an
+// error when there is none
+func (a aggregateDoc) RemoveStages(op string) aggregateDoc {
+	out := make(bson.A, 0, len(a.Pipeline))
+	for _, stage := range a.Pipeline {
+		if stageName(stage) != op {
+			out = append(out, stage)
+		}
+	}
+	return a.edited(out)
+}
+
+// Replace returns the pipeline with the stage at i replaced by stage
+func (a aggregateDoc) Replace(i int, stage interface{}) aggregateDoc {
+	if i < 0 || i >= len(a.Pipeline) {
+		return a.failf("replace index %d out of range [0, %d)", i, len(a.Pipeline))
+	}
+	return a.replace([]int{i}, stage)
+}
+
+// ReplaceStages returns the pipeline with every op stage replaced by stage
+func (a aggregateDoc) ReplaceStages(op string, stage interface{}) aggregateDoc {
+	found := a.Find(op)
+	if len(found) == 0 {
+		return a.failf("no %s stage to replace", op)
+	}
+	return a.replace(found, stage)
+}
+
+// Concat returns the stages of a followed by the stages of other,
+// the errors of both are kept
+func (a aggregateDoc) Concat(other aggregateDoc) aggregateDoc {
+	out := make(bson.A, 0, len(a.Pipeline)+len(other.Pipeline))
+	out = append(out, a.Pipeline...)
+	return a.edited(append(out, other.Pipeline...), other.Errors...)
+}
+
+// PrependMatch returns the pipeline starting with { $match: <filter> }, such as
+// a tenant scope, filter is a filterDoc, a FilterDocBuilder, a bson.D or a bson.M.
+// The $match goes after a leading stage that must be first, like $geoNear or
+// $search, so the pipeline stays valid
+func (a aggregateDoc) PrependMatch(filter interface{}) aggregateDoc {
+	d, ok := toDocument(filter)
+	if !ok {
+		return a.failf("$match needs a document, got %T", filter)
+	}
+	i := 0
+	if len(a.Pipeline) > 0 && firstStages[stageName(a.Pipeline[0])] {
+		i = 1
+	}
+	out := a.insert(i, []interface{}{bson.D{{Key: "$match", Value: d}}})
+	out.Errors = append(out.Errors, docErrors(filter)...)
+	return out
+}
@@ -0,0 +1,78 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAggregateCompose(t *testing.T) {
+	match := bson.D{{Key: "$match", Value: bson.D{{Key: "a", Value: 1}}}}
+	sort := bson.D{{Key: "$sort", Value: bson.D{{Key: "a", Value: 1}}}}
+	limit := bson.D{{Key: "$limit", Value: int64(10)}}
+	skip := bson.D{{Key: "$skip", Value: int64(5)}}
+	tenant := bson.D{{Key: "tenant", Value: "acme"}}
+
+	base := AggregateDocBuilder.Match(bson.D{{Key: "a", Value: 1}}).Sort(bson.D{{Key: "a", Value: 1}}).Limit(10).Doc()
+	require.Equal(t, 3, base.Len())
+	require.Equal(t, []int{2}, base.Find("$limit"))
+	require.Empty(t, base.Find("$group"))
+
+	cases := map[string]struct {
+		doc  aggregateDoc
+		want bson.A
+	}{
+		"insert-before":       {base.InsertBefore(2, skip), bson.A{match, sort, skip, limit}},
+		"insert-before-end":   {base.InsertBefore(3, skip), bson.A{match, sort, limit, skip}},
+		"insert-after":        {base.InsertAfter(0, skip, skip), bson.A{match, skip, skip, sort, limit}},
+		"insert-before-stage": {base.InsertBeforeStage("$limit", skip), bson.A{match, sort, skip, limit}},
+		"insert-after-stage":  {base.InsertAfterStage("$match", skip), bson.A{match, skip, sort, limit}},
+		"remove":              {base.Remove(1), bson.A{match, limit}},
+		"remove-stages":       {base.RemoveStages("$sort").RemoveStages("$group"), bson.A{match, limit}},
+		"replace":             {base.Replace(2, skip), bson.A{match, sort, skip}},
+		"replace-stages":      {base.ReplaceStages("$limit", skip), bson.A{match, sort, skip}},
+		"concat":              {base.Concat(AggregateDocBuilder.Skip(5).Doc()), bson.A{match, sort, limit, skip}},
+		"prepend-match": {base.PrependMatch(tenant), bson.A{
+			bson.D{{Key: "$match", Value: tenant}}, match, sort, limit,
+		}},
+		"insert-bson-m":  {base.InsertBefore(2, bson.M{"$skip": int64(5)}), bson.A{match, sort, skip, limit}},
+		"replace-bson-m": {base.Replace(2, bson.M{"$skip": int64(5)}), bson.A{match, sort, skip}},
+		"prepend-match-builder": {base.PrependMatch(FilterDocBuilder.Eq("tenant", "acme")), bson.A{
+			bson.D{{Key: "$match", Value: tenant}}, match, sort, limit,
+		}},
+	}
+	for name, c := range cases {
+		require.NoError(t, c.doc.Err(), name)
+		require.EqualValues(t, c.want, c.doc.ToA(), name)
+	}
+	// the base pipeline is never modified
+	require.EqualValues(t, bson.A{match, sort, limit}, base.ToA())
+
+	// a leading $geoNear stays first
+	geo := AggregateDocBuilder.GeoNear(Point{Lng: 1, Lat: 1}, "d", nil).Doc()
+	scoped := geo.PrependMatch(tenant)
+	require.Equal(t, "$geoNear", stageName(scoped.ToA()[0]))
+	require.Equal(t, []int{1}, scoped.Find("$match"))
+	require.NoError(t, scoped.Validate())
+
+	failed := map[string]aggregateDoc{
+		"insert-before":  base.InsertBefore(4, skip),
+		"insert-after":   base.InsertAfter(3, skip),
+		"insert-stage":   base.InsertAfterStage("$group", skip),
+		"remove":         base.Remove(-1),
+		"replace":        base.Replace(3, skip),
+		"replace-stages": base.ReplaceStages("$group", skip),
+		"concat":         base.Concat(AggregateDocBuilder.Out("").Doc()),
+		"not-a-document": base.InsertBefore(0, "$skip"),
+		"not-a-stage":    base.Replace(0, bson.D{{Key: "skip", Value: 5}}),
+		"many-keys":      base.InsertAfter(0, bson.D{{Key: "$skip", Value: 5}, {Key: "$limit", Value: 1}}),
+		"match-type":     base.PrependMatch(42),
+	}
+	for name, doc := range failed {
+		require.True(t, errors.Is(doc.Err(), ErrInvalidStage), name)
+	}
+	require.True(t, errors.Is(base.PrependMatch(FilterDocBuilder.And(42)).Err(), ErrInvalidFilter))
+	require.NoError(t, base.Err())
+}
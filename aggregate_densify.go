@@ -0,0 +1,280 @@
+package hamster
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lann/builder"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// AggregateDensifyRange is the range of a $densify stage. Bounds is "full",
+// "partition" or a [lower, upper] pair of numbers, or of dates when Unit is set.
+type AggregateDensifyRange struct {
+	Step   interface{}
+	Unit   string
+	Bounds interface{}
+}
+
+// Densify adds a $densify stage, a Unit requires a date field and no Unit a numeric
+// one. Bounds given as a pair, a bson.A or a Go slice such as []time.Time, are
+// checked against the Unit. With "full" or "partition" bounds the type of field
+// is unknown to the builder and only the server can check it
+// { $densify: { field: <field>, partitionByFields: [ <field>, ... ], range: { step: <number>, unit: <unit>, bounds: <bounds> } } }
+func (a aggregateDocBuilder) Densify(field string, partitionByFields []string, rng AggregateDensifyRange) aggregateDocBuilder {
+	if field == "" {
+		return a.failf("$densify requires a field")
+	}
+	for _, p := range partitionByFields {
+		if p == field {
+			return a.failf("$densify field %q must not be a partitionByFields entry", field)
+		}
+	}
+
+	step, ok := toFloat(rng.Step)
+	if !ok || step <= 0 {
+		return a.failf("$densify step must be a positive number, got %v", rng.Step)
+	}
+	if rng.Unit != "" {
+		if !timeUnits[rng.Unit] {
+			return a.failf("invalid $densify unit %q", rng.Unit)
+		}
+		if step != float64(int64(step)) {
+			return a.failf("$densify step must be an integer with unit %q, got %v", rng.Unit, rng.Step)
+		}
+	}
+
+	var bounds interface{}
+	if name, ok := rng.Bounds.(string); ok {
+		if name != "full" && name != "partition" {
+			return a.failf("$densify bounds must be \"full\", \"partition\" or a pair, got %q", name)
+		}
+		bounds = name
+	} else {
+		b := arrayOf(rng.Bounds)
+		if b == nil {
+			return a.failf("$densify bounds must be \"full\", \"partition\" or a pair, got %T", rng.Bounds)
+		}
+		if len(b) != 2 {
+			return a.failf("$densify bounds must be a [lower, upper] pair, got %d values", len(b))
+		}
+		for _, v := range b {
+			_, isDate := toTime(v)
+			_, isNumber := toFloat(v)
+			if rng.Unit != "" && !isDate {
+				return a.failf("$densify unit %q requires date bounds, got %v", rng.Unit, v)
+			}
+			if rng.Unit == "" && !isNumber {
+				return a.failf("$densify numeric bounds expected without a unit, got %v", v)
+			}
+		}
+		if compareValues(b[0], b[1]) > 0 {
+			return a.failf("$densify lower bound %v is above upper bound %v", b[0], b[1])
+		}
+		bounds = bson.A{b[0], b[1]}
+	}
+
+	d := bson.D{{Key: "field", Value: field}}
+	if len(partitionByFields) > 0 {
+		arr := make(bson.A, 0, len(partitionByFields))
+		for _, p := range partitionByFields {
+			arr = append(arr, p)
+		}
+		d = append(d, bson.E{Key: "partitionByFields", Value: arr})
+	}
+	r := bson.D{{Key: "step", Value: rng.Step}}
+	if rng.Unit != "" {
+		r = append(r, bson.E{Key: "unit", Value: rng.Unit})
+	}
+	r = append(r, bson.E{Key: "bounds", Value: bounds})
+	return a.stage("$densify", append(d, bson.E{Key: "range", Value: r}))
+}
+
+// fillDoc is the output document of a $fill stage
+type fillDoc struct {
+	Fields bson.D
+	// SortedBy lists the outputs filled by a method, which requires a sortBy
+	SortedBy []string
+	// Errors collects the problems found while building the document
+	Errors []error
+}
+
+// fillDocBuilder is a builder for fillDoc
+type fillDocBuilder builder.Builder
+
+var (
+	// FillDocBuilder is a singleton builder for $fill outputs,
+	// use it with AggregateDocBuilder.Fill
+	FillDocBuilder = builder.Register(fillDocBuilder{}, fillDoc{}).(fillDocBuilder)
+)
+
+// Doc returns the fillDoc instance
+func (f fillDocBuilder) Doc() fillDoc {
+	return builder.GetStruct(f).(fillDoc)
+}
+
+// ToD convert fillDoc to a bson.D output document
+func (f fillDoc) ToD() bson.D {
+	return f.Fields
+}
+
+// ToM convert fillDoc to a bson.M output document
+func (f fillDoc) ToM() bson.M {
+	return f.ToD().Map()
+}
+
+// Err returns the first error found while building the document
+func (f fillDoc) Err() error {
+	if len(f.Errors) == 0 {
+		return nil
+	}
+	return f.Errors[0]
+}
+
+func (f fillDocBuilder) output(field string, value bson.D) fillDocBuilder {
+	for _, e := range f.Doc().Fields {
+		if e.Key == field {
+			err := fmt.Errorf("%w: $fill duplicate output field %q", ErrInvalidStage, field)
+			return builder.Append(f, "Errors", err).(fillDocBuilder)
+		}
+	}
+	return builder.Append(f, "Fields", bson.E{Key: field, Value: value}).(fillDocBuilder)
+}
+
+// Value fills missing values of field with expr, { <field>: { value: <expr> } }
+func (f fillDocBuilder) Value(field string, expr interface{}) fillDocBuilder {
+	return f.output(field, bson.D{{Key: "value", Value: bsonValue(expr)}})
+}
+
+// Linear fills missing values of field by linear interpolation, { <field>: { method: "linear" } }
+func (f fillDocBuilder) Linear(field string) fillDocBuilder {
+	f = builder.Append(f, "SortedBy", field).(fillDocBuilder)
+	return f.output(field, bson.D{{Key: "method", Value: "linear"}})
+}
+
+// Locf fills missing values of field with the last observed value, { <field>: { method: "locf" } }
+func (f fillDocBuilder) Locf(field string) fillDocBuilder {
+	f = builder.Append(f, "SortedBy", field).(fillDocBuilder)
+	return f.output(field, bson.D{{Key: "method", Value: "locf"}})
+}
+
+// Fill adds a $fill stage, a nil partitionBy and an empty sortBy are left out
+// { $fill: { partitionBy: <expression>, sortBy: { <field>: <order> }, output: { <field>: { value: <expr> } | { method: <method> }, ... } } }
+func (a aggregateDocBuilder) Fill(partitionBy interface{}, sortBy sortDoc, output fillDoc) aggregateDocBuilder {
+	var d bson.D
+	if partitionBy != nil {
+		d = bson.D{{Key: "partitionBy", Value: bsonValue(partitionBy)}}
+	}
+	return a.fill(d, sortBy, output)
+}
+
+// FillByFields adds a $fill stage partitioned by fields
+// { $fill: { partitionByFields: [ <field>, ... ], sortBy: { <field>: <order> }, output: { ... } } }
+func (a aggregateDocBuilder) FillByFields(partitionByFields []string, sortBy sortDoc, output fillDoc) aggregateDocBuilder {
+	var d bson.D
+	if len(partitionByFields) > 0 {
+		arr := make(bson.A, 0, len(partitionByFields))
+		for _, p := range partitionByFields {
+			arr = append(arr, p)
+		}
+		d = bson.D{{Key: "partitionByFields", Value: arr}}
+	}
+	return a.fill(d, sortBy, output)
+}
+
+func (a aggregateDocBuilder) fill(d bson.D, sortBy sortDoc, output fillDoc) aggregateDocBuilder {
+	for _, err := range output.Errors {
+		a = a.fail(err)
+	}
+	if len(output.Fields) == 0 {
+		return a.failf("$fill requires at least one output")
+	}
+	if len(output.SortedBy) > 0 && len(sortBy.ToD()) == 0 {
+		return a.failf("$fill output %q requires sortBy", output.SortedBy[0])
+	}
+	if len(sortBy.ToD()) > 0 {
+		d = append(d, bson.E{Key: "sortBy", Value: sortBy.ToD()})
+	}
+	return a.stage("$fill", append(d, bson.E{Key: "output", Value: output.ToD()}))
+}
+
+// TimeSeriesBuckets returns a pipeline that turns a raw metric stream into
+// evenly spaced buckets: timeField is truncated to binSize units, metrics are
+// averaged per bucket and partition, missing buckets are added by $densify and
+// their metrics filled with fillMethod, "linear" or "locf"
+func TimeSeriesBuckets(timeField string, partitionFields []string, binSize int64, unit string, metrics []string, fillMethod string) aggregateDoc {
+	a := AggregateDocBuilder
+	if fillMethod != "linear" && fillMethod != "locf" {
+		return a.failf("time series fill method must be \"linear\" or \"locf\", got %q", fillMethod).Doc()
+	}
+	if binSize < 1 {
+		return a.failf("time series binSize must be positive, got %d", binSize).Doc()
+	}
+	if !timeUnits[unit] {
+		return a.failf("invalid time series unit %q", unit).Doc()
+	}
+	if timeField == "" {
+		return a.failf("time series requires a timeField").Doc()
+	}
+
+	// $group field names cannot contain dots, dotted fields are grouped under an
+	// alias and restored to their path by $project
+	aliases := make(map[string]string)
+	alias := func(field string) (string, bool) {
+		name := strings.ReplaceAll(field, ".", "_")
+		if prev, ok := aliases[name]; ok && prev != field {
+			return "", false
+		}
+		aliases[name] = field
+		return name, true
+	}
+
+	timeAlias, _ := alias(timeField)
+	id := bson.D{{Key: timeAlias, Value: Expr.DateTrunc(Expr.Field(timeField), unit, &ExprDateOptions{BinSize: &binSize})}}
+	project := bson.D{{Key: "_id", Value: 0}, {Key: timeField, Value: "$_id." + timeAlias}}
+	sort := SortDocBuilder
+	for _, p := range partitionFields {
+		if p == "" {
+			return a.failf("time series partition field must not be empty").Doc()
+		}
+		name, ok := alias(p)
+		if !ok {
+			return a.failf("time series fields %q and %q have the same alias", aliases[name], p).Doc()
+		}
+		id = append(id, bson.E{Key: name, Value: Expr.Field(p)})
+		project = append(project, bson.E{Key: p, Value: "$_id." + name})
+		sort = sort.OrderAscBy(p)
+	}
+	sort = sort.OrderAscBy(timeField)
+
+	group := GroupDocBuilder.IdCompound(id)
+	fill := FillDocBuilder
+	for _, m := range metrics {
+		name, ok := alias(m)
+		if !ok {
+			return a.failf("time series fields %q and %q have the same alias", aliases[name], m).Doc()
+		}
+		group = group.Avg(name, Expr.Field(m))
+		if name == m {
+			project = append(project, bson.E{Key: m, Value: 1})
+		} else {
+			project = append(project, bson.E{Key: m, Value: "$" + name})
+		}
+		if fillMethod == "linear" {
+			fill = fill.Linear(m)
+		} else {
+			fill = fill.Locf(m)
+		}
+	}
+
+	bounds := "full"
+	if len(partitionFields) > 0 {
+		bounds = "partition"
+	}
+	return a.Group(group).
+		Project(project).
+		Densify(timeField, partitionFields, AggregateDensifyRange{Step: binSize, Unit: unit, Bounds: bounds}).
+		FillByFields(partitionFields, SortDocBuilder.OrderAscBy(timeField).Doc(), fill.Doc()).
+		Sort(sort).
+		Doc()
+}
@@ -0,0 +1,176 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAggregateDensify(t *testing.T) {
+	// { $densify: { field: "timestamp", range: { step: 1, unit: "hour",
+	//   bounds: [ ISODate("2021-05-18T00:00:00.000Z"), ISODate("2021-05-18T08:00:00.000Z") ] } } }
+	lower := time.Date(2021, 5, 18, 0, 0, 0, 0, time.UTC)
+	upper := time.Date(2021, 5, 18, 8, 0, 0, 0, time.UTC)
+	doc := AggregateDocBuilder.Densify("timestamp", nil, AggregateDensifyRange{
+		Step:   1,
+		Unit:   "hour",
+		Bounds: []interface{}{lower, upper},
+	}).Doc()
+	std := bson.D{{Key: "$densify", Value: bson.D{
+		{Key: "field", Value: "timestamp"},
+		{Key: "range", Value: bson.D{
+			{Key: "step", Value: 1},
+			{Key: "unit", Value: "hour"},
+			{Key: "bounds", Value: bson.A{lower, upper}},
+		}},
+	}}}
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, std, doc.ToA()[0])
+
+	// bounds may be a bson.A or a typed Go slice
+	for _, b := range []interface{}{bson.A{lower, upper}, []time.Time{lower, upper}} {
+		doc = AggregateDocBuilder.Densify("timestamp", nil, AggregateDensifyRange{Step: 1, Unit: "hour", Bounds: b}).Doc()
+		require.NoError(t, doc.Err())
+		require.EqualValues(t, std, doc.ToA()[0])
+	}
+
+	// { $densify: { field: "altitude", partitionByFields: [ "variety" ], range: { bounds: "partition", step: 200 } } }
+	doc = AggregateDocBuilder.Densify("altitude", []string{"variety"}, AggregateDensifyRange{
+		Step:   200,
+		Bounds: "partition",
+	}).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "$densify", Value: bson.D{
+		{Key: "field", Value: "altitude"},
+		{Key: "partitionByFields", Value: bson.A{"variety"}},
+		{Key: "range", Value: bson.D{{Key: "step", Value: 200}, {Key: "bounds", Value: "partition"}}},
+	}}}, doc.ToA()[0])
+}
+
+func TestAggregateDensifyValidate(t *testing.T) {
+	now := time.Now()
+	cases := map[string]AggregateDensifyRange{
+		"zero-step":          {Step: 0, Bounds: "full"},
+		"bad-unit":           {Step: 1, Unit: "fortnight", Bounds: "full"},
+		"fractional-step":    {Step: 1.5, Unit: "hour", Bounds: "full"},
+		"bad-bounds":         {Step: 1, Bounds: "all"},
+		"numeric-with-unit":  {Step: 1, Unit: "hour", Bounds: []interface{}{0, 10}},
+		"dates-without-unit": {Step: 1, Bounds: []interface{}{now, now.Add(time.Hour)}},
+		"reversed":           {Step: 1, Bounds: []interface{}{10, 0}},
+		"single-bound":       {Step: 1, Bounds: []interface{}{0}},
+		"typed-reversed":     {Step: 1, Bounds: []int{10, 0}},
+		"bounds-type":        {Step: 1, Bounds: 10},
+	}
+	for name, rng := range cases {
+		doc := AggregateDocBuilder.Densify("ts", nil, rng).Doc()
+		require.True(t, errors.Is(doc.Err(), ErrInvalidStage), name)
+	}
+
+	doc := AggregateDocBuilder.Densify("ts", []string{"ts"}, AggregateDensifyRange{Step: 1, Bounds: "full"}).Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+}
+
+func TestAggregateFill(t *testing.T) {
+	// { $fill: { partitionBy: "$restaurant", sortBy: { date: 1 },
+	//   output: { score: { method: "locf" }, bootsSold: { value: 0 }, price: { method: "linear" } } } }
+	sortBy := SortDocBuilder.OrderAscBy("date").Doc()
+	output := FillDocBuilder.Locf("score").Value("bootsSold", 0).Linear("price").Doc()
+	doc := AggregateDocBuilder.Fill(Expr.Field("restaurant"), sortBy, output).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "$fill", Value: bson.D{
+		{Key: "partitionBy", Value: "$restaurant"},
+		{Key: "sortBy", Value: sortBy.ToD()},
+		{Key: "output", Value: bson.D{
+			{Key: "score", Value: bson.D{{Key: "method", Value: "locf"}}},
+			{Key: "bootsSold", Value: bson.D{{Key: "value", Value: 0}}},
+			{Key: "price", Value: bson.D{{Key: "method", Value: "linear"}}},
+		}},
+	}}}, doc.ToA()[0])
+
+	doc = AggregateDocBuilder.FillByFields([]string{"restaurant"}, SortDocBuilder.Doc(), FillDocBuilder.Value("bootsSold", 0).Doc()).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "$fill", Value: bson.D{
+		{Key: "partitionByFields", Value: bson.A{"restaurant"}},
+		{Key: "output", Value: bson.D{{Key: "bootsSold", Value: bson.D{{Key: "value", Value: 0}}}}},
+	}}}, doc.ToA()[0])
+
+	doc = AggregateDocBuilder.Fill(nil, SortDocBuilder.Doc(), FillDocBuilder.Linear("price").Doc()).Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+
+	duplicate := FillDocBuilder.Linear("price").Locf("price").Doc()
+	require.True(t, errors.Is(duplicate.Err(), ErrInvalidStage))
+	require.NoError(t, output.Err())
+	doc = AggregateDocBuilder.Fill(nil, sortBy, duplicate).Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+
+	doc = AggregateDocBuilder.Fill(nil, sortBy, FillDocBuilder.Doc()).Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+}
+
+func TestTimeSeriesBuckets(t *testing.T) {
+	binSize := int64(5)
+	doc := TimeSeriesBuckets("ts", []string{"sensor"}, binSize, "minute", []string{"temp"}, "linear")
+	require.NoError(t, doc.Err())
+
+	std := bson.A{
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{
+				{Key: "ts", Value: bson.D{{Key: "$dateTrunc", Value: bson.D{
+					{Key: "date", Value: "$ts"}, {Key: "unit", Value: "minute"}, {Key: "binSize", Value: int64(5)},
+				}}}},
+				{Key: "sensor", Value: "$sensor"},
+			}},
+			{Key: "temp", Value: bson.D{{Key: "$avg", Value: "$temp"}}},
+		}}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "ts", Value: "$_id.ts"},
+			{Key: "sensor", Value: "$_id.sensor"},
+			{Key: "temp", Value: 1},
+		}}},
+		bson.D{{Key: "$densify", Value: bson.D{
+			{Key: "field", Value: "ts"},
+			{Key: "partitionByFields", Value: bson.A{"sensor"}},
+			{Key: "range", Value: bson.D{{Key: "step", Value: int64(5)}, {Key: "unit", Value: "minute"}, {Key: "bounds", Value: "partition"}}},
+		}}},
+		bson.D{{Key: "$fill", Value: bson.D{
+			{Key: "partitionByFields", Value: bson.A{"sensor"}},
+			{Key: "sortBy", Value: bson.D{{Key: "ts", Value: SortAsc}}},
+			{Key: "output", Value: bson.D{{Key: "temp", Value: bson.D{{Key: "method", Value: "linear"}}}}},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "sensor", Value: SortAsc}, {Key: "ts", Value: SortAsc}}}},
+	}
+	require.EqualValues(t, std, doc.ToA())
+
+	require.True(t, errors.Is(TimeSeriesBuckets("ts", nil, 5, "minute", []string{"temp"}, "mean").Err(), ErrInvalidStage))
+	require.True(t, errors.Is(TimeSeriesBuckets("ts", nil, 5, "minutes", []string{"temp"}, "locf").Err(), ErrInvalidStage))
+	require.True(t, errors.Is(TimeSeriesBuckets("", nil, 5, "minute", []string{"temp"}, "locf").Err(), ErrInvalidStage))
+	require.True(t, errors.Is(TimeSeriesBuckets("ts", []string{"meta.sensor", "meta_sensor"}, 5, "minute", []string{"temp"}, "locf").Err(), ErrInvalidStage))
+}
+
+func TestTimeSeriesBucketsDottedFields(t *testing.T) {
+	// dotted fields are grouped under an undotted alias and restored by $project
+	doc := TimeSeriesBuckets("ts", []string{"meta.sensor"}, 1, "hour", []string{"m.temp"}, "locf")
+	require.NoError(t, doc.Err())
+	std := bson.A{
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{
+				{Key: "ts", Value: bson.D{{Key: "$dateTrunc", Value: bson.D{
+					{Key: "date", Value: "$ts"}, {Key: "unit", Value: "hour"}, {Key: "binSize", Value: int64(1)},
+				}}}},
+				{Key: "meta_sensor", Value: "$meta.sensor"},
+			}},
+			{Key: "m_temp", Value: bson.D{{Key: "$avg", Value: "$m.temp"}}},
+		}}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "ts", Value: "$_id.ts"},
+			{Key: "meta.sensor", Value: "$_id.meta_sensor"},
+			{Key: "m.temp", Value: "$m_temp"},
+		}}},
+	}
+	require.EqualValues(t, std, doc.ToA()[:2])
+}
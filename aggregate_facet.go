@@ -0,0 +1,149 @@
+package hamster
+
+import (
+	"context"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// facetForbiddenStages are the stages a $facet sub-pipeline must not contain
+var facetForbiddenStages = map[string]bool{
+	"$out":            true,
+	"$merge":          true,
+	"$facet":          true,
+	"$collStats":      true,
+	"$indexStats":     true,
+	"$geoNear":        true,
+	"$planCacheStats": true,
+	"$search":         true,
+	"$searchMeta":     true,
+	"$vectorSearch":   true,
+}
+
+// stageName returns the operator of a pipeline stage, such as "$match"
+func stageName(stage interface{}) string {
+	switch s := stage.(type) {
+	case bson.D:
+		if len(s) > 0 {
+			return s[0].Key
+		}
+	case bson.M:
+		for k := range s {
+			return k
+		}
+	}
+	return ""
+}
+
+// Facet adds a $facet stage running named sub-pipelines on the same input
+// documents. facets are name, pipeline pairs or a single bson.D of them, a
+// pipeline is an aggregateDoc, an AggregateDocBuilder, a bson.A or a []bson.D.
+// Every call adds its own stage.
+// { $facet: { <name>: [ <stage>, ... ], ... } }
+func (a aggregateDocBuilder) Facet(facets ...interface{}) aggregateDocBuilder {
+	pairs := facets
+	if len(facets) == 1 {
+		d, ok := facets[0].(bson.D)
+		if !ok {
+			return a.failf("$facet needs name and pipeline pairs or a bson.D, got %T", facets[0])
+		}
+		pairs = make([]interface{}, 0, 2*len(d))
+		for _, e := range d {
+			pairs = append(pairs, e.Key, e.Value)
+		}
+	}
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return a.failf("$facet needs name and pipeline pairs, got %d arguments", len(pairs))
+	}
+
+	d := make(bson.D, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		name, ok := pairs[i].(string)
+		if !ok {
+			return a.failf("$facet name must be a string, got %T", pairs[i])
+		}
+		if name == "" || strings.HasPrefix(name, "$") || strings.Contains(name, ".") {
+			return a.failf("invalid $facet name %q", name)
+		}
+		for _, e := range d {
+			if e.Key == name {
+				return a.failf("duplicate $facet name %q", name)
+			}
+		}
+		pipeline, ok := pipelineOf(pairs[i+1])
+		if !ok {
+			return a.failf("$facet %q needs a pipeline, got %T", name, pairs[i+1])
+		}
+		a = a.inherit(pipeline)
+		for _, stage := range pipeline.ToA() {
+			if op := stageName(stage); facetForbiddenStages[op] {
+				return a.failf("$facet %q must not contain a %s stage", name, op)
+			}
+		}
+		pipe := pipeline.ToA()
+		if pipe == nil {
+			pipe = bson.A{}
+		}
+		d = append(d, bson.E{Key: name, Value: pipe})
+	}
+	return a.stage("$facet", d)
+}
+
+// Paginate returns a pipeline that runs match and yields a single document
+// { items: [ ... ], total: <n> } holding one sorted page and the total count
+// of matching documents. Decode the result with DecodePage.
+func Paginate(match aggregateDoc, sort sortDoc, skip, limit int64) aggregateDoc {
+	a := AggregateDocBuilder.withPipeline(match.ToA()).inherit(match)
+	if skip < 0 || limit < 0 {
+		return a.failf("pagination skip and limit must be non-negative, got %d and %d", skip, limit).Doc()
+	}
+
+	items := AggregateDocBuilder
+	if len(sort.ToD()) > 0 {
+		items = items.Sort(sort)
+	}
+	if skip > 0 {
+		items = items.Skip(skip)
+	}
+	if limit > 0 {
+		items = items.Limit(limit)
+	}
+	total := AggregateDocBuilder.Count("count")
+
+	return a.Facet("items", items, "total", total).
+		Project(bson.D{
+			{Key: "items", Value: 1},
+			{Key: "total", Value: Expr.IfNull(Expr.ArrayElemAt(Expr.Field("total.count"), 0), 0).Value()},
+		}).
+		Doc()
+}
+
+// Page is the result document of a Paginate pipeline
+type Page struct {
+	Items bson.RawValue `bson:"items"`
+	Total int64         `bson:"total"`
+}
+
+// DecodeItems decodes the page items into out, a pointer to a slice
+func (p Page) DecodeItems(out interface{}) error {
+	if p.Items.Type == 0 {
+		return nil
+	}
+	return p.Items.Unmarshal(out)
+}
+
+// DecodePage reads the result of a Paginate pipeline from cursor, decoding
+// the items into out, a pointer to a slice, and returning the total count
+func DecodePage(ctx context.Context, cursor *mongo.Cursor, out interface{}) (int64, error) {
+	defer cursor.Close(ctx)
+	if !cursor.Next(ctx) {
+		return 0, cursor.Err()
+	}
+	var page Page
+	if err := cursor.Decode(&page); err != nil {
+		return 0, err
+	}
+	return page.Total, page.DecodeItems(out)
+}
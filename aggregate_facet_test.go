@@ -0,0 +1,124 @@
+package hamster
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestAggregateFacet(t *testing.T) {
+	// { $facet: { categorizedByTags: [ { $unwind: "$tags" }, { $sortByCount: "$tags" } ],
+	//   categorizedByYears: [ { $match: { year: { $exists: true } } } ] } }
+	byTags := AggregateDocBuilder.Unwind("$tags").AddStage(bson.D{{Key: "$sortByCount", Value: "$tags"}}).Doc()
+	byYears := AggregateDocBuilder.Match(FilterDocBuilder.Exists("year").Doc().ToD()).Doc()
+
+	doc := AggregateDocBuilder.Facet("categorizedByTags", byTags, "categorizedByYears", byYears).Doc()
+	std := bson.D{{Key: "$facet", Value: bson.D{
+		{Key: "categorizedByTags", Value: bson.A{
+			bson.D{{Key: "$unwind", Value: "$tags"}},
+			bson.D{{Key: "$sortByCount", Value: "$tags"}},
+		}},
+		{Key: "categorizedByYears", Value: bson.A{
+			bson.D{{Key: "$match", Value: bson.D{{Key: "year", Value: bson.D{{Key: "$exists", Value: true}}}}}},
+		}},
+	}}}
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.A{std}, doc.ToA())
+
+	// facets given as a bson.D, pipelines as builders, bson.A or []bson.D
+	doc = AggregateDocBuilder.Facet(bson.D{
+		{Key: "categorizedByTags", Value: AggregateDocBuilder.Unwind("$tags").AddStage(bson.D{{Key: "$sortByCount", Value: "$tags"}})},
+		{Key: "categorizedByYears", Value: []bson.D{byYears.ToA()[0].(bson.D)}},
+	}).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.A{std}, doc.ToA())
+
+	// every call adds its own stage, earlier $facet stages are left alone
+	doc = AggregateDocBuilder.Facet("a", byTags).Facet("b", bson.A{}).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.A{
+		bson.D{{Key: "$facet", Value: bson.D{{Key: "a", Value: byTags.ToA()}}}},
+		bson.D{{Key: "$facet", Value: bson.D{{Key: "b", Value: bson.A{}}}}},
+	}, doc.ToA())
+}
+
+func TestAggregateFacetValidate(t *testing.T) {
+	for _, stage := range []string{"$out", "$merge", "$facet", "$collStats"} {
+		sub := AggregateDocBuilder.AddStage(bson.D{{Key: stage, Value: bson.D{}}}).Doc()
+		doc := AggregateDocBuilder.Facet("a", sub).Doc()
+		require.True(t, errors.Is(doc.Err(), ErrInvalidStage), stage)
+	}
+
+	sub := AggregateDocBuilder.Limit(1).Doc()
+	failed := map[string]aggregateDoc{
+		"duplicate":    AggregateDocBuilder.Facet("a", sub, "a", sub).Doc(),
+		"name":         AggregateDocBuilder.Facet("$a", sub).Doc(),
+		"name-type":    AggregateDocBuilder.Facet(1, sub).Doc(),
+		"no-facet":     AggregateDocBuilder.Facet().Doc(),
+		"odd":          AggregateDocBuilder.Facet("a", sub, "b").Doc(),
+		"pipeline":     AggregateDocBuilder.Facet("a", "$limit").Doc(),
+		"single":       AggregateDocBuilder.Facet("a").Doc(),
+		"inherit":      AggregateDocBuilder.Facet("a", AggregateDocBuilder.Sample(0)).Doc(),
+		"empty-bson-d": AggregateDocBuilder.Facet(bson.D{}).Doc(),
+	}
+	for name, doc := range failed {
+		require.True(t, errors.Is(doc.Err(), ErrInvalidStage), name)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	match := AggregateDocBuilder.Match(FilterDocBuilder.Eq("status", "A").Doc().ToD()).Doc()
+	sort := SortDocBuilder.OrderDescBy("created_at").Doc()
+	doc := Paginate(match, sort, 20, 10)
+
+	std := bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "status", Value: "A"}}}},
+		bson.D{{Key: "$facet", Value: bson.D{
+			{Key: "items", Value: bson.A{
+				bson.D{{Key: "$sort", Value: sort.ToD()}},
+				bson.D{{Key: "$skip", Value: int64(20)}},
+				bson.D{{Key: "$limit", Value: int64(10)}},
+			}},
+			{Key: "total", Value: bson.A{bson.D{{Key: "$count", Value: "count"}}}},
+		}}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "items", Value: 1},
+			{Key: "total", Value: bson.D{{Key: "$ifNull", Value: bson.A{
+				bson.D{{Key: "$arrayElemAt", Value: bson.A{"$total.count", int64(0)}}}, 0,
+			}}}},
+		}}},
+	}
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, std, doc.ToA())
+
+	doc = Paginate(match, sort, -1, 10)
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+}
+
+func TestDecodePage(t *testing.T) {
+	type item struct {
+		Name string `bson:"name"`
+	}
+	result := bson.D{
+		{Key: "items", Value: bson.A{bson.D{{Key: "name", Value: "a"}}, bson.D{{Key: "name", Value: "b"}}}},
+		{Key: "total", Value: int32(42)},
+	}
+	cursor, err := mongo.NewCursorFromDocuments([]interface{}{result}, nil, nil)
+	require.NoError(t, err)
+
+	var items []item
+	total, err := DecodePage(context.Background(), cursor, &items)
+	require.NoError(t, err)
+	require.EqualValues(t, 42, total)
+	require.Equal(t, []item{{Name: "a"}, {Name: "b"}}, items)
+
+	cursor, err = mongo.NewCursorFromDocuments(nil, nil, nil)
+	require.NoError(t, err)
+	total, err = DecodePage(context.Background(), cursor, &items)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, total)
+}
@@ -0,0 +1,80 @@
+package hamster
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// AggregateGeoNearOptions are the optional fields of a $geoNear stage.
+// Distances are in meters for a Point and in radians for a spherical LegacyPoint
+type AggregateGeoNearOptions struct {
+	Spherical          *bool
+	MinDistance        *float64
+	MaxDistance        *float64
+	Query              filterDoc
+	IncludeLocs        *string
+	DistanceMultiplier *float64
+	Key                *string
+}
+
+// GeoNear adds a $geoNear stage, near is a Point or a LegacyPoint and the stage
+// must be the first of the pipeline
+// { $geoNear: { near: <point>, distanceField: <field>, spherical: <bool>, minDistance: <number>, maxDistance: <number>, query: <filter>, includeLocs: <field>, distanceMultiplier: <number> } }
+func (a aggregateDocBuilder) GeoNear(near interface{}, distanceField string, opt *AggregateGeoNearOptions) aggregateDocBuilder {
+	if distanceField == "" {
+		return a.failf("$geoNear requires a distanceField")
+	}
+	var point interface{}
+	switch p := near.(type) {
+	case Point:
+		if err := p.Validate(); err != nil {
+			return a.fail(err)
+		}
+		point = p.ToD()
+	case LegacyPoint:
+		point = p.ToA()
+	default:
+		return a.failf("$geoNear near must be a Point or a LegacyPoint, got %T", near)
+	}
+
+	d := bson.D{{Key: "near", Value: point}, {Key: "distanceField", Value: distanceField}}
+	if opt == nil {
+		return a.stage("$geoNear", d)
+	}
+	if opt.Spherical != nil {
+		d = append(d, bson.E{Key: "spherical", Value: *opt.Spherical})
+	}
+	if opt.MinDistance != nil {
+		if *opt.MinDistance < 0 {
+			return a.failf("$geoNear minDistance must be non-negative, got %v", *opt.MinDistance)
+		}
+		d = append(d, bson.E{Key: "minDistance", Value: *opt.MinDistance})
+	}
+	if opt.MaxDistance != nil {
+		if *opt.MaxDistance < 0 {
+			return a.failf("$geoNear maxDistance must be non-negative, got %v", *opt.MaxDistance)
+		}
+		if opt.MinDistance != nil && *opt.MinDistance > *opt.MaxDistance {
+			return a.failf("$geoNear minDistance %v is above maxDistance %v", *opt.MinDistance, *opt.MaxDistance)
+		}
+		d = append(d, bson.E{Key: "maxDistance", Value: *opt.MaxDistance})
+	}
+	if len(opt.Query.ToD()) > 0 {
+		for _, err := range opt.Query.Errors {
+			a = a.fail(err)
+		}
+		d = append(d, bson.E{Key: "query", Value: opt.Query.ToD()})
+	}
+	if opt.IncludeLocs != nil {
+		d = append(d, bson.E{Key: "includeLocs", Value: *opt.IncludeLocs})
+	}
+	if opt.DistanceMultiplier != nil {
+		if *opt.DistanceMultiplier <= 0 {
+			return a.failf("$geoNear distanceMultiplier must be positive, got %v", *opt.DistanceMultiplier)
+		}
+		d = append(d, bson.E{Key: "distanceMultiplier", Value: *opt.DistanceMultiplier})
+	}
+	if opt.Key != nil {
+		d = append(d, bson.E{Key: "key", Value: *opt.Key})
+	}
+	return a.stage("$geoNear", d)
+}
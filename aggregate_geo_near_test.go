@@ -0,0 +1,66 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAggregateGeoNear(t *testing.T) {
+	// { $geoNear: { near: { type: "Point", coordinates: [ -73.99279 , 40.719296 ] },
+	//   distanceField: "dist.calculated", maxDistance: 2, query: { category: "Parks" },
+	//   includeLocs: "dist.location", spherical: true } }
+	spherical := true
+	minDistance, maxDistance := 0.0, 2.0
+	includeLocs := "dist.location"
+	doc := AggregateDocBuilder.GeoNear(Point{Lng: -73.99279, Lat: 40.719296}, "dist.calculated", &AggregateGeoNearOptions{
+		Spherical:   &spherical,
+		MinDistance: &minDistance,
+		MaxDistance: &maxDistance,
+		Query:       FilterDocBuilder.Eq("category", "Parks").Doc(),
+		IncludeLocs: &includeLocs,
+	}).Limit(5).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "$geoNear", Value: bson.D{
+		{Key: "near", Value: bson.D{{Key: "type", Value: "Point"}, {Key: "coordinates", Value: bson.A{-73.99279, 40.719296}}}},
+		{Key: "distanceField", Value: "dist.calculated"},
+		{Key: "spherical", Value: true},
+		{Key: "minDistance", Value: 0.0},
+		{Key: "maxDistance", Value: 2.0},
+		{Key: "query", Value: bson.D{{Key: "category", Value: "Parks"}}},
+		{Key: "includeLocs", Value: "dist.location"},
+	}}}, doc.ToA()[0])
+
+	// { $geoNear: { near: [ -73.99279, 40.719296 ], distanceField: "dist", distanceMultiplier: 6378.1 } }
+	multiplier := 6378.1
+	doc = AggregateDocBuilder.GeoNear(LegacyPoint{X: -73.99279, Y: 40.719296}, "dist", &AggregateGeoNearOptions{
+		DistanceMultiplier: &multiplier,
+	}).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "$geoNear", Value: bson.D{
+		{Key: "near", Value: bson.A{-73.99279, 40.719296}},
+		{Key: "distanceField", Value: "dist"},
+		{Key: "distanceMultiplier", Value: 6378.1},
+	}}}, doc.ToA()[0])
+}
+
+func TestAggregateGeoNearValidate(t *testing.T) {
+	point := Point{Lng: 1, Lat: 1}
+	negative, small, large := -1.0, 1.0, 2.0
+	cases := map[string]aggregateDoc{
+		"no-distance-field": AggregateDocBuilder.GeoNear(point, "", nil).Doc(),
+		"polygon":           AggregateDocBuilder.GeoNear(square, "d", nil).Doc(),
+		"bad-point":         AggregateDocBuilder.GeoNear(Point{Lng: 500}, "d", nil).Doc(),
+		"negative-min":      AggregateDocBuilder.GeoNear(point, "d", &AggregateGeoNearOptions{MinDistance: &negative}).Doc(),
+		"min-above-max": AggregateDocBuilder.GeoNear(point, "d", &AggregateGeoNearOptions{
+			MinDistance: &large, MaxDistance: &small,
+		}).Doc(),
+		"not-first": AggregateDocBuilder.Limit(1).GeoNear(point, "d", nil).Doc(),
+		"concat":    AggregateDocBuilder.Limit(1).concat(AggregateDocBuilder.GeoNear(point, "d", nil).Doc()).Doc(),
+	}
+	for name, doc := range cases {
+		require.True(t, errors.Is(doc.Err(), ErrInvalidStage) || errors.Is(doc.Err(), ErrInvalidGeometry), name)
+	}
+}
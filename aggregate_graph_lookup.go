@@ -0,0 +1,46 @@
+package hamster
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// AggregateGraphLookupOptions are the optional fields of a $graphLookup stage
+type AggregateGraphLookupOptions struct {
+	MaxDepth                *int64
+	DepthField              *string
+	RestrictSearchWithMatch filterDoc
+}
+
+// GraphLookup adds a $graphLookup stage performing a recursive search on a collection
+// { $graphLookup: { from: <from>, startWith: <startWith>, connectFromField: <connectFromField>, connectToField: <connectToField>, as: <as> } }
+func (a aggregateDocBuilder) GraphLookup(from string, startWith interface{}, connectFromField, connectToField, as string, opt *AggregateGraphLookupOptions) aggregateDocBuilder {
+	if from == "" || connectFromField == "" || connectToField == "" || as == "" {
+		return a.failf("$graphLookup requires from, connectFromField, connectToField and as")
+	}
+	if s, ok := startWith.(string); startWith == nil || (ok && s == "") {
+		return a.failf("$graphLookup requires startWith")
+	}
+
+	d := bson.D{
+		{Key: "from", Value: from},
+		{Key: "startWith", Value: startWith},
+		{Key: "connectFromField", Value: connectFromField},
+		{Key: "connectToField", Value: connectToField},
+		{Key: "as", Value: as},
+	}
+	if opt != nil {
+		if opt.MaxDepth != nil {
+			if *opt.MaxDepth < 0 {
+				return a.failf("$graphLookup maxDepth must be non-negative, got %d", *opt.MaxDepth)
+			}
+			d = append(d, bson.E{Key: "maxDepth", Value: *opt.MaxDepth})
+		}
+		if opt.DepthField != nil {
+			d = append(d, bson.E{Key: "depthField", Value: *opt.DepthField})
+		}
+		if len(opt.RestrictSearchWithMatch.ToD()) > 0 {
+			d = append(d, bson.E{Key: "restrictSearchWithMatch", Value: opt.RestrictSearchWithMatch.ToD()})
+		}
+	}
+	return a.stage("$graphLookup", d)
+}
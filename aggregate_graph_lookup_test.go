@@ -0,0 +1,63 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAggregateGraphLookup(t *testing.T) {
+	// { $graphLookup: { from: "employees", startWith: "$reportsTo", connectFromField: "reportsTo",
+	//   connectToField: "name", as: "reportingHierarchy" } }
+	doc := AggregateDocBuilder.GraphLookup("employees", "$reportsTo", "reportsTo", "name", "reportingHierarchy", nil).Doc()
+	std := bson.D{{Key: "$graphLookup", Value: bson.D{
+		{Key: "from", Value: "employees"},
+		{Key: "startWith", Value: "$reportsTo"},
+		{Key: "connectFromField", Value: "reportsTo"},
+		{Key: "connectToField", Value: "name"},
+		{Key: "as", Value: "reportingHierarchy"},
+	}}}
+	require.NoError(t, doc.Err())
+	require.Len(t, doc.ToA(), 1)
+	require.EqualValues(t, std, doc.ToA()[0])
+
+	// { $graphLookup: { from: "people", startWith: "$friends", connectFromField: "friends",
+	//   connectToField: "name", as: "golfers", maxDepth: 2, depthField: "degree",
+	//   restrictSearchWithMatch: { hobbies: "golf" } } }
+	maxDepth := int64(2)
+	depthField := "degree"
+	opt := &AggregateGraphLookupOptions{
+		MaxDepth:                &maxDepth,
+		DepthField:              &depthField,
+		RestrictSearchWithMatch: FilterDocBuilder.Eq("hobbies", "golf").Doc(),
+	}
+	doc = AggregateDocBuilder.GraphLookup("people", "$friends", "friends", "name", "golfers", opt).Doc()
+	std = bson.D{{Key: "$graphLookup", Value: bson.D{
+		{Key: "from", Value: "people"},
+		{Key: "startWith", Value: "$friends"},
+		{Key: "connectFromField", Value: "friends"},
+		{Key: "connectToField", Value: "name"},
+		{Key: "as", Value: "golfers"},
+		{Key: "maxDepth", Value: int64(2)},
+		{Key: "depthField", Value: "degree"},
+		{Key: "restrictSearchWithMatch", Value: bson.D{{Key: "hobbies", Value: "golf"}}},
+	}}}
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, std, doc.ToA()[0])
+}
+
+func TestAggregateGraphLookupValidate(t *testing.T) {
+	doc := AggregateDocBuilder.GraphLookup("employees", nil, "reportsTo", "name", "hierarchy", nil).Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+	require.Empty(t, doc.ToA())
+
+	doc = AggregateDocBuilder.GraphLookup("employees", "$reportsTo", "", "name", "hierarchy", nil).Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+
+	maxDepth := int64(-1)
+	doc = AggregateDocBuilder.GraphLookup("employees", "$reportsTo", "reportsTo", "name", "hierarchy",
+		&AggregateGraphLookupOptions{MaxDepth: &maxDepth}).Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+}
@@ -0,0 +1,65 @@
+package hamster
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Lookup adds an equality match $lookup stage
+// { $lookup: { from: <from>, localField: <localField>, foreignField: <foreignField>, as: <as> } }
+func (a aggregateDocBuilder) Lookup(from, localField, foreignField, as string) aggregateDocBuilder {
+	if from == "" || localField == "" || foreignField == "" || as == "" {
+		return a.failf("$lookup requires from, localField, foreignField and as")
+	}
+	return a.stage("$lookup", bson.D{
+		{Key: "from", Value: from},
+		{Key: "localField", Value: localField},
+		{Key: "foreignField", Value: foreignField},
+		{Key: "as", Value: as},
+	})
+}
+
+// LookupPipeline adds a $lookup stage that joins with a sub-pipeline,
+// every $$variable used by the sub-pipeline must be declared in let
+// { $lookup: { from: <from>, let: <let>, pipeline: <pipeline>, as: <as> } }
+func (a aggregateDocBuilder) LookupPipeline(from string, let bson.D, pipeline aggregateDoc, as string) aggregateDocBuilder {
+	return a.lookupPipeline(from, "", "", let, pipeline, as)
+}
+
+// LookupPipelineWithFields adds the MongoDB 5.0 $lookup stage that combines an
+// equality match with a sub-pipeline
+// { $lookup: { from: <from>, localField: <localField>, foreignField: <foreignField>, let: <let>, pipeline: <pipeline>, as: <as> } }
+func (a aggregateDocBuilder) LookupPipelineWithFields(from, localField, foreignField string, let bson.D, pipeline aggregateDoc, as string) aggregateDocBuilder {
+	if localField == "" || foreignField == "" {
+		return a.failf("$lookup requires both localField and foreignField")
+	}
+	return a.lookupPipeline(from, localField, foreignField, let, pipeline, as)
+}
+
+func (a aggregateDocBuilder) lookupPipeline(from, localField, foreignField string, let bson.D, pipeline aggregateDoc, as string) aggregateDocBuilder {
+	if from == "" || as == "" {
+		return a.failf("$lookup requires from and as")
+	}
+	a = a.inherit(pipeline)
+
+	declared := map[string]bool{}
+	for _, e := range let {
+		declared[e.Key] = true
+	}
+	if err := checkVariables(pipeline.ToA(), declared); err != nil {
+		return a.fail(err)
+	}
+
+	d := bson.D{{Key: "from", Value: from}}
+	if localField != "" {
+		d = append(d, bson.E{Key: "localField", Value: localField}, bson.E{Key: "foreignField", Value: foreignField})
+	}
+	if len(let) > 0 {
+		d = append(d, bson.E{Key: "let", Value: let})
+	}
+	pipe := pipeline.ToA()
+	if pipe == nil {
+		pipe = bson.A{}
+	}
+	d = append(d, bson.E{Key: "pipeline", Value: pipe}, bson.E{Key: "as", Value: as})
+	return a.stage("$lookup", d)
+}
@@ -0,0 +1,97 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAggregateLookup(t *testing.T) {
+	// { $lookup: { from: "inventory", localField: "item", foreignField: "sku", as: "inventory_docs" } }
+	doc := AggregateDocBuilder.Lookup("inventory", "item", "sku", "inventory_docs").Doc()
+	std := bson.D{{Key: "$lookup", Value: bson.D{
+		{Key: "from", Value: "inventory"},
+		{Key: "localField", Value: "item"},
+		{Key: "foreignField", Value: "sku"},
+		{Key: "as", Value: "inventory_docs"},
+	}}}
+	require.NoError(t, doc.Err())
+	require.Len(t, doc.ToA(), 1)
+	require.EqualValues(t, std, doc.ToA()[0])
+
+	doc = AggregateDocBuilder.Lookup("inventory", "", "sku", "inventory_docs").Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+	_, err := bson.Marshal(doc)
+	require.Error(t, err)
+}
+
+func TestAggregateLookupPipeline(t *testing.T) {
+	// { $lookup: { from: "warehouses", let: { order_item: "$item", order_qty: "$ordered" },
+	//   pipeline: [ { $match: { $expr: { $and: [ { $eq: [ "$stock_item", "$$order_item" ] },
+	//   { $gte: [ "$instock", "$$order_qty" ] } ] } } }, { $project: { stock_item: 0, _id: 0 } } ],
+	//   as: "stockdata" } }
+	let := bson.D{{Key: "order_item", Value: "$item"}, {Key: "order_qty", Value: "$ordered"}}
+	match := bson.D{{Key: "$expr", Value: bson.D{{Key: "$and", Value: bson.A{
+		bson.D{{Key: "$eq", Value: bson.A{"$stock_item", "$$order_item"}}},
+		bson.D{{Key: "$gte", Value: bson.A{"$instock", "$$order_qty"}}},
+	}}}}}
+	project := ProjectDocBuilder.Exclude("stock_item").ExcludeId().Doc().ToD()
+	sub := AggregateDocBuilder.Match(match).Project(project).Doc()
+
+	doc := AggregateDocBuilder.LookupPipeline("warehouses", let, sub, "stockdata").Doc()
+	std := bson.D{{Key: "$lookup", Value: bson.D{
+		{Key: "from", Value: "warehouses"},
+		{Key: "let", Value: let},
+		{Key: "pipeline", Value: bson.A{
+			bson.D{{Key: "$match", Value: match}},
+			bson.D{{Key: "$project", Value: project}},
+		}},
+		{Key: "as", Value: "stockdata"},
+	}}}
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, std, doc.ToA()[0])
+
+	// undeclared $$order_qty
+	doc = AggregateDocBuilder.LookupPipeline("warehouses", let[:1], sub, "stockdata").Doc()
+	require.True(t, errors.Is(doc.Err(), ErrUndeclaredVariable))
+	require.Contains(t, doc.Err().Error(), "$$order_qty")
+
+	// system variables and variables bound inside the sub-pipeline are allowed
+	sub = AggregateDocBuilder.Project(bson.D{
+		{Key: "root", Value: "$$ROOT"},
+		{Key: "names", Value: bson.D{{Key: "$map", Value: bson.D{
+			{Key: "input", Value: "$items"},
+			{Key: "as", Value: "item"},
+			{Key: "in", Value: "$$item.name"},
+		}}}},
+	}).Doc()
+	doc = AggregateDocBuilder.LookupPipeline("warehouses", nil, sub, "stockdata").Doc()
+	require.NoError(t, doc.Err())
+}
+
+func TestAggregateLookupPipelineWithFields(t *testing.T) {
+	// { $lookup: { from: "restaurants", localField: "restaurant_name", foreignField: "name",
+	//   let: { orders_drink: "$drink" },
+	//   pipeline: [ { $match: { $expr: { $in: [ "$$orders_drink", "$beverages" ] } } } ],
+	//   as: "matches" } }
+	let := bson.D{{Key: "orders_drink", Value: "$drink"}}
+	match := bson.D{{Key: "$expr", Value: bson.D{{Key: "$in", Value: bson.A{"$$orders_drink", "$beverages"}}}}}
+	sub := AggregateDocBuilder.Match(match).Doc()
+
+	doc := AggregateDocBuilder.LookupPipelineWithFields("restaurants", "restaurant_name", "name", let, sub, "matches").Doc()
+	std := bson.D{{Key: "$lookup", Value: bson.D{
+		{Key: "from", Value: "restaurants"},
+		{Key: "localField", Value: "restaurant_name"},
+		{Key: "foreignField", Value: "name"},
+		{Key: "let", Value: let},
+		{Key: "pipeline", Value: bson.A{bson.D{{Key: "$match", Value: match}}}},
+		{Key: "as", Value: "matches"},
+	}}}
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, std, doc.ToA()[0])
+
+	doc = AggregateDocBuilder.LookupPipelineWithFields("restaurants", "restaurant_name", "", let, sub, "matches").Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+}
@@ -0,0 +1,355 @@
+package hamster
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The rules applied by aggregateDoc.Optimize
+const (
+	// RewriteDropNoop removes $match {}, $skip 0, $addFields {} and $set {}
+	RewriteDropNoop = "drop-noop"
+	// RewriteMergeMatch merges adjacent $match stages into one $and
+	RewriteMergeMatch = "merge-match"
+	// RewritePushMatch moves a $match ahead of a $project, $addFields, $set,
+	// $unset or $sort that does not touch the matched fields
+	RewritePushMatch = "push-match"
+	// RewriteSortLimit moves a $limit right after its $sort, across stages that
+	// keep the number of documents, so the server can run a top-k sort
+	RewriteSortLimit = "sort-limit"
+	// RewriteSkipLimit collapses consecutive $skip or consecutive $limit stages
+	RewriteSkipLimit = "skip-limit"
+)
+
+// AggregateRewrite is a rewrite applied by aggregateDoc.Optimize,
+// Stage is the index of the rewritten stage in the pipeline at that time
+type AggregateRewrite struct {
+	Rule   string
+	Stage  int
+	Detail string
+}
+
+func (r AggregateRewrite) String() string {
+	return fmt.Sprintf("%s at %d: %s", r.Rule, r.Stage, r.Detail)
+}
+
+// Optimize returns a copy of the pipeline with the safe rewrites applied until
+// none applies any more, and the rewrites in the order they were applied.
+// Only top level stages are rewritten, sub-pipelines are left as they are
+func (a aggregateDoc) Optimize() (aggregateDoc, []AggregateRewrite) {
+	stages := append(bson.A{}, a.Pipeline...)
+	var report []AggregateRewrite
+	for {
+		rewrite, ok := optimizeOnce(&stages)
+		if !ok {
+			break
+		}
+		report = append(report, rewrite)
+	}
+	return aggregateDoc{Pipeline: stages, Errors: a.Errors}, report
+}
+
+// optimizeOnce applies the first rewrite found in stages
+func optimizeOnce(stages *bson.A) (AggregateRewrite, bool) {
+	s := *stages
+	for i := range s {
+		op, value, ok := singleStage(s[i])
+		if !ok {
+			continue
+		}
+		if isNoopStage(op, value) {
+			*stages = append(s[:i:i], s[i+1:]...)
+			return AggregateRewrite{Rule: RewriteDropNoop, Stage: i, Detail: "dropped no-op " + op}, true
+		}
+		if i+1 == len(s) {
+			continue
+		}
+		nextOp, nextValue, ok := singleStage(s[i+1])
+		if !ok {
+			continue
+		}
+
+		switch {
+		case op == "$match" && nextOp == "$match":
+			merged, ok := mergeMatch(value, nextValue)
+			if !ok {
+				break
+			}
+			*stages = append(append(s[:i:i], bson.D{{Key: "$match", Value: merged}}), s[i+2:]...)
+			return AggregateRewrite{Rule: RewriteMergeMatch, Stage: i, Detail: fmt.Sprintf("merged $match at %d and %d", i, i+1)}, true
+
+		case op == "$skip" && nextOp == "$skip", op == "$limit" && nextOp == "$limit":
+			n, ok1 := intOf(value)
+			m, ok2 := intOf(nextValue)
+			if !ok1 || !ok2 {
+				break
+			}
+			if op == "$skip" {
+				n += m
+			} else if m < n {
+				n = m
+			}
+			*stages = append(append(s[:i:i], bson.D{{Key: op, Value: n}}), s[i+2:]...)
+			return AggregateRewrite{Rule: RewriteSkipLimit, Stage: i, Detail: fmt.Sprintf("collapsed %s at %d and %d into %s %d", op, i, i+1, op, n)}, true
+
+		case nextOp == "$match" && matchCanPass(op, value, nextValue):
+			s[i], s[i+1] = s[i+1], s[i]
+			return AggregateRewrite{Rule: RewritePushMatch, Stage: i + 1, Detail: "moved $match ahead of " + op}, true
+
+		case op == "$sort":
+			for j := i + 1; j < len(s); j++ {
+				op, _, ok := singleStage(s[j])
+				if !ok {
+					break
+				}
+				if op == "$limit" {
+					if j == i+1 {
+						break
+					}
+					limit := s[j]
+					copy(s[i+2:j+1], s[i+1:j])
+					s[i+1] = limit
+					return AggregateRewrite{Rule: RewriteSortLimit, Stage: j, Detail: fmt.Sprintf("moved $limit at %d right after $sort at %d", j, i)}, true
+				}
+				if !oneToOneStages[op] {
+					break
+				}
+			}
+		}
+	}
+	return AggregateRewrite{}, false
+}
+
+// oneToOneStages are the stages that output exactly one document per input document, in order
+var oneToOneStages = map[string]bool{
+	"$project":     true,
+	"$addFields":   true,
+	"$set":         true,
+	"$unset":       true,
+	"$replaceRoot": true,
+	"$replaceWith": true,
+}
+
+// singleStage returns the operator and the value of a { <op>: <value> } stage
+func singleStage(stage interface{}) (string, interface{}, bool) {
+	d, ok := stage.(bson.D)
+	if !ok || len(d) != 1 {
+		return "", nil, false
+	}
+	return d[0].Key, d[0].Value, true
+}
+
+func isNoopStage(op string, value interface{}) bool {
+	switch op {
+	case "$match", "$addFields", "$set":
+		d := documentOf(value)
+		return d != nil && len(d) == 0
+	case "$skip":
+		n, ok := intOf(value)
+		return ok && n == 0
+	}
+	return false
+}
+
+// intOf returns v as an int64 when it is an integral number
+func intOf(v interface{}) (int64, bool) {
+	f, ok := toFloat(v)
+	if !ok || f != float64(int64(f)) {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// filterList returns the filters of a $and, $or or $nor
+func filterList(v interface{}) ([]bson.D, bool) {
+	switch l := v.(type) {
+	case []bson.D:
+		return l, true
+	case bson.A, []interface{}:
+		arr := arrayOf(l)
+		out := make([]bson.D, 0, len(arr))
+		for _, f := range arr {
+			d := documentOf(f)
+			if d == nil {
+				return nil, false
+			}
+			out = append(out, d)
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+// mergeMatch returns { $and: [ <a>, <b> ] }, flattening a lone $and on either side
+func mergeMatch(a, b interface{}) (bson.D, bool) {
+	var and bson.A
+	for _, v := range []interface{}{a, b} {
+		d := documentOf(v)
+		if d == nil {
+			return nil, false
+		}
+		if len(d) == 1 && d[0].Key == "$and" {
+			if filters, ok := filterList(d[0].Value); ok {
+				for _, f := range filters {
+					and = append(and, f)
+				}
+				continue
+			}
+		}
+		and = append(and, d)
+	}
+	return bson.D{{Key: "$and", Value: and}}, true
+}
+
+// matchedFields returns the field paths a filter reads, ok is false when
+// the filter uses a top level operator that may read any field, like $expr
+func matchedFields(filter bson.D) ([]string, bool) {
+	var fields []string
+	for _, e := range filter {
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			filters, ok := filterList(e.Value)
+			if !ok {
+				return nil, false
+			}
+			for _, f := range filters {
+				sub, ok := matchedFields(f)
+				if !ok {
+					return nil, false
+				}
+				fields = append(fields, sub...)
+			}
+		case "$comment":
+		default:
+			if strings.HasPrefix(e.Key, "$") {
+				return nil, false
+			}
+			fields = append(fields, e.Key)
+		}
+	}
+	return fields, true
+}
+
+// pathsOverlap reports whether one path is the other or inside it
+func pathsOverlap(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
+
+// matchCanPass reports whether a $match can run before the stage op
+// without changing the result
+func matchCanPass(op string, value, match interface{}) bool {
+	filter := documentOf(match)
+	if filter == nil {
+		return false
+	}
+	fields, ok := matchedFields(filter)
+	if !ok {
+		return false
+	}
+
+	var touched []string
+	switch op {
+	case "$sort":
+		return true
+	case "$addFields", "$set":
+		d := documentOf(value)
+		if d == nil {
+			return false
+		}
+		for _, e := range d {
+			touched = append(touched, e.Key)
+		}
+	case "$unset":
+		switch u := value.(type) {
+		case string:
+			touched = []string{u}
+		default:
+			for _, f := range arrayOf(u) {
+				s, ok := f.(string)
+				if !ok {
+					return false
+				}
+				touched = append(touched, s)
+			}
+		}
+	case "$project":
+		d := documentOf(value)
+		if d == nil {
+			return false
+		}
+		return projectKeeps(d, fields)
+	default:
+		return false
+	}
+
+	for _, f := range fields {
+		for _, t := range touched {
+			if pathsOverlap(f, t) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// projectKeeps reports whether every field leaves the projection unchanged
+func projectKeeps(project bson.D, fields []string) bool {
+	var included, excluded, computed []string
+	for _, e := range project {
+		switch v := e.Value.(type) {
+		case bool:
+			if v {
+				included = append(included, e.Key)
+			} else {
+				excluded = append(excluded, e.Key)
+			}
+		default:
+			if f, ok := toFloat(v); ok {
+				if f != 0 {
+					included = append(included, e.Key)
+				} else {
+					excluded = append(excluded, e.Key)
+				}
+			} else {
+				computed = append(computed, e.Key)
+			}
+		}
+	}
+	inclusion := len(computed) > 0
+	for _, k := range included {
+		if k != "_id" {
+			inclusion = true
+		}
+	}
+	if inclusion {
+		// _id is kept unless excluded
+		idExcluded := false
+		for _, k := range excluded {
+			idExcluded = idExcluded || k == "_id"
+		}
+		if !idExcluded {
+			included = append(included, "_id")
+		}
+	}
+
+	for _, f := range fields {
+		for _, k := range append(computed, excluded...) {
+			if pathsOverlap(f, k) {
+				return false
+			}
+		}
+		if !inclusion {
+			continue
+		}
+		kept := false
+		for _, k := range included {
+			kept = kept || f == k || strings.HasPrefix(f, k+".")
+		}
+		if !kept {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package hamster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func rewriteRules(report []AggregateRewrite) []string {
+	out := make([]string, 0, len(report))
+	for _, r := range report {
+		out = append(out, r.Rule)
+	}
+	return out
+}
+
+func TestAggregateOptimizeMatch(t *testing.T) {
+	a := bson.D{{Key: "a", Value: 1}}
+	b := bson.D{{Key: "b", Value: 2}}
+	c := bson.D{{Key: "c", Value: 3}}
+	doc, report := AggregateDocBuilder.Match(a).Match(b).Match(c).Doc().Optimize()
+	require.EqualValues(t, bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "$and", Value: bson.A{a, b, c}}}}},
+	}, doc.ToA())
+	require.Equal(t, []string{RewriteMergeMatch, RewriteMergeMatch}, rewriteRules(report))
+
+	// $match moves ahead of stages that leave its fields alone
+	doc, report = AggregateDocBuilder.
+		Sort(bson.D{{Key: "a", Value: 1}}).
+		AddFields(bson.D{{Key: "total", Value: "$x"}}).
+		Project(bson.D{{Key: "a", Value: 1}, {Key: "total", Value: 1}}).
+		Match(FilterDocBuilder.Gt("a.n", 1).Doc().ToD()).
+		Doc().Optimize()
+	require.EqualValues(t, bson.A{
+		bson.D{{Key: "$match", Value: FilterDocBuilder.Gt("a.n", 1).Doc().ToD()}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "a", Value: 1}}}},
+		bson.D{{Key: "$addFields", Value: bson.D{{Key: "total", Value: "$x"}}}},
+		bson.D{{Key: "$project", Value: bson.D{{Key: "a", Value: 1}, {Key: "total", Value: 1}}}},
+	}, doc.ToA())
+	require.Equal(t, []string{RewritePushMatch, RewritePushMatch, RewritePushMatch}, rewriteRules(report))
+
+	// $match stays behind stages that change its fields
+	pipelines := map[string]aggregateDoc{
+		"added":    AggregateDocBuilder.AddFields(bson.D{{Key: "a", Value: "$x"}}).Match(a).Doc(),
+		"parent":   AggregateDocBuilder.Set(bson.D{{Key: "a", Value: 1}}).Match(bson.D{{Key: "a.b", Value: 1}}).Doc(),
+		"unset":    AggregateDocBuilder.Unset("a").Match(a).Doc(),
+		"excluded": AggregateDocBuilder.Project(bson.D{{Key: "a", Value: 0}}).Match(a).Doc(),
+		"missing":  AggregateDocBuilder.Project(bson.D{{Key: "b", Value: 1}}).Match(a).Doc(),
+		"computed": AggregateDocBuilder.Project(bson.D{{Key: "a", Value: "$b"}}).Match(a).Doc(),
+		"child":    AggregateDocBuilder.Project(bson.D{{Key: "a.b", Value: 1}}).Match(a).Doc(),
+		"expr":     AggregateDocBuilder.Sort(a).Match(bson.D{{Key: "$expr", Value: true}}).Doc(),
+		"or": AggregateDocBuilder.Set(bson.D{{Key: "b", Value: 1}}).
+			Match(FilterDocBuilder.Or(FilterDocBuilder.Eq("a", 1).Doc(), FilterDocBuilder.Eq("b", 1).Doc()).Doc().ToD()).Doc(),
+	}
+	for name, pipeline := range pipelines {
+		doc, report := pipeline.Optimize()
+		require.Empty(t, report, name)
+		require.EqualValues(t, pipeline.ToA(), doc.ToA(), name)
+	}
+
+	// _id is kept by an inclusion projection unless excluded
+	_, report = AggregateDocBuilder.Project(bson.D{{Key: "a", Value: 1}}).Match(bson.D{{Key: "_id", Value: 1}}).Doc().Optimize()
+	require.Equal(t, []string{RewritePushMatch}, rewriteRules(report))
+	_, report = AggregateDocBuilder.Project(bson.D{{Key: "_id", Value: 0}, {Key: "a", Value: 1}}).Match(bson.D{{Key: "_id", Value: 1}}).Doc().Optimize()
+	require.Empty(t, report)
+}
+
+func TestAggregateOptimizeSkipLimit(t *testing.T) {
+	doc, report := AggregateDocBuilder.Skip(10).Skip(5).Limit(20).Limit(3).Limit(7).Doc().Optimize()
+	require.EqualValues(t, bson.A{
+		bson.D{{Key: "$skip", Value: int64(15)}},
+		bson.D{{Key: "$limit", Value: int64(3)}},
+	}, doc.ToA())
+	require.Equal(t, []string{RewriteSkipLimit, RewriteSkipLimit, RewriteSkipLimit}, rewriteRules(report))
+
+	// { $sort }, { $project }, { $limit } -> { $sort }, { $limit }, { $project }
+	sort := bson.D{{Key: "score", Value: -1}}
+	project := bson.D{{Key: "score", Value: 1}}
+	doc, report = AggregateDocBuilder.Sort(sort).Project(project).Set(bson.D{{Key: "x", Value: 1}}).Limit(5).Doc().Optimize()
+	require.EqualValues(t, bson.A{
+		bson.D{{Key: "$sort", Value: sort}},
+		bson.D{{Key: "$limit", Value: int64(5)}},
+		bson.D{{Key: "$project", Value: project}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "x", Value: 1}}}},
+	}, doc.ToA())
+	require.Equal(t, []string{RewriteSortLimit}, rewriteRules(report))
+
+	// a $limit behind a stage that changes the number of documents stays there
+	pipeline := AggregateDocBuilder.Sort(sort).Unwind("$tags").Limit(5).Doc()
+	doc, report = pipeline.Optimize()
+	require.Empty(t, report)
+	require.EqualValues(t, pipeline.ToA(), doc.ToA())
+}
+
+func TestAggregateOptimizeNoop(t *testing.T) {
+	errored := AggregateDocBuilder.Match(bson.D{}).Skip(0).AddFields(bson.D{}).Limit(-1).Count("").Doc()
+	doc, report := errored.Optimize()
+	require.EqualValues(t, bson.A{bson.D{{Key: "$limit", Value: int64(-1)}}}, doc.ToA())
+	require.Equal(t, []string{RewriteDropNoop, RewriteDropNoop, RewriteDropNoop}, rewriteRules(report))
+	require.Equal(t, "drop-noop at 0: dropped no-op $match", report[0].String())
+	// errors are kept
+	require.Error(t, errored.Err())
+	require.Equal(t, errored.Err(), doc.Err())
+
+	// the original pipeline is left alone
+	pipeline := AggregateDocBuilder.Match(bson.D{{Key: "a", Value: 1}}).Match(bson.D{{Key: "b", Value: 1}}).Doc()
+	pipeline.Optimize()
+	require.Len(t, pipeline.ToA(), 2)
+}
@@ -0,0 +1,220 @@
+package hamster
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lann/builder"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// outputStages are the stages that write the pipeline results and must come last
+var outputStages = map[string]bool{
+	"$out":   true,
+	"$merge": true,
+}
+
+// mergeWhenMatched are the whenMatched modes of $merge
+var mergeWhenMatched = map[string]bool{
+	"replace":      true,
+	"keepExisting": true,
+	"merge":        true,
+	"fail":         true,
+}
+
+// mergeWhenNotMatched are the whenNotMatched modes of $merge
+var mergeWhenNotMatched = map[string]bool{
+	"insert":  true,
+	"discard": true,
+	"fail":    true,
+}
+
+// mergeUpdateStages are the stages allowed in a $merge whenMatched pipeline
+var mergeUpdateStages = map[string]bool{
+	"$addFields":   true,
+	"$set":         true,
+	"$project":     true,
+	"$unset":       true,
+	"$replaceRoot": true,
+	"$replaceWith": true,
+}
+
+// Out adds { $out: <coll> }
+func (a aggregateDocBuilder) Out(coll string) aggregateDocBuilder {
+	if coll == "" {
+		return a.failf("$out requires a collection")
+	}
+	return a.stage("$out", coll)
+}
+
+// OutDb adds { $out: { db: <db>, coll: <coll> } }
+func (a aggregateDocBuilder) OutDb(db, coll string) aggregateDocBuilder {
+	if db == "" || coll == "" {
+		return a.failf("$out requires a database and a collection")
+	}
+	return a.stage("$out", bson.D{{Key: "db", Value: db}, {Key: "coll", Value: coll}})
+}
+
+// AggregateMergeOptions are the optional fields of a $merge stage.
+// WhenMatched is one of "replace", "keepExisting", "merge", "fail" or an
+// update pipeline, an aggregateDoc, an AggregateDocBuilder, a bson.A or a
+// []bson.D of stages, which may reference the Let variables and $$new.
+// An UpdateDocBuilder using only Set and Unset is turned into $set and $unset
+// stages, its values are then read as expressions.
+// WhenNotMatched is one of "insert", "discard", "fail".
+type AggregateMergeOptions struct {
+	On             []string
+	Let            bson.D
+	WhenMatched    interface{}
+	WhenNotMatched string
+}
+
+// Merge adds { $merge: { into: <coll>, on: <fields>, let: <let>, whenMatched: <mode|pipeline>, whenNotMatched: <mode> } }
+func (a aggregateDocBuilder) Merge(into string, opt *AggregateMergeOptions) aggregateDocBuilder {
+	if into == "" {
+		return a.failf("$merge requires a target collection")
+	}
+	return a.merge(into, opt)
+}
+
+// MergeDb adds { $merge: { into: { db: <db>, coll: <coll> }, ... } }
+func (a aggregateDocBuilder) MergeDb(db, coll string, opt *AggregateMergeOptions) aggregateDocBuilder {
+	if db == "" || coll == "" {
+		return a.failf("$merge requires a database and a collection")
+	}
+	return a.merge(bson.D{{Key: "db", Value: db}, {Key: "coll", Value: coll}}, opt)
+}
+
+func (a aggregateDocBuilder) merge(into interface{}, opt *AggregateMergeOptions) aggregateDocBuilder {
+	d := bson.D{{Key: "into", Value: into}}
+	if opt == nil {
+		return a.stage("$merge", d)
+	}
+
+	if len(opt.On) == 1 {
+		d = append(d, bson.E{Key: "on", Value: opt.On[0]})
+	} else if len(opt.On) > 1 {
+		on := make(bson.A, 0, len(opt.On))
+		for _, field := range opt.On {
+			on = append(on, field)
+		}
+		d = append(d, bson.E{Key: "on", Value: on})
+	}
+
+	whenMatched := opt.WhenMatched
+	switch pipeline := whenMatched.(type) {
+	case updateDocBuilder:
+		converted, err := updatePipeline(pipeline.Doc())
+		if err != nil {
+			return a.fail(err)
+		}
+		whenMatched = converted
+	case updateDoc:
+		converted, err := updatePipeline(pipeline)
+		if err != nil {
+			return a.fail(err)
+		}
+		whenMatched = converted
+	case aggregateDocBuilder:
+		whenMatched = pipeline.Doc()
+	case bson.A:
+		whenMatched = aggregateDoc{Pipeline: pipeline}
+	case []bson.D:
+		stages := make(bson.A, 0, len(pipeline))
+		for _, stage := range pipeline {
+			stages = append(stages, stage)
+		}
+		whenMatched = aggregateDoc{Pipeline: stages}
+	}
+
+	if len(opt.Let) > 0 {
+		if _, ok := whenMatched.(aggregateDoc); !ok {
+			return a.failf("$merge let requires a whenMatched pipeline")
+		}
+		d = append(d, bson.E{Key: "let", Value: bsonValue(opt.Let)})
+	}
+
+	switch whenMatched := whenMatched.(type) {
+	case nil:
+	case string:
+		if !mergeWhenMatched[whenMatched] {
+			return a.failf("invalid $merge whenMatched %q", whenMatched)
+		}
+		d = append(d, bson.E{Key: "whenMatched", Value: whenMatched})
+	case aggregateDoc:
+		a = a.inherit(whenMatched)
+		for _, stage := range whenMatched.ToA() {
+			if op := stageName(stage); !mergeUpdateStages[op] {
+				return a.failf("$merge whenMatched pipeline must not contain a %s stage", op)
+			}
+		}
+		declared := map[string]bool{}
+		for _, e := range opt.Let {
+			declared[e.Key] = true
+		}
+		if len(opt.Let) == 0 {
+			declared["new"] = true
+		}
+		if err := checkVariables(whenMatched.ToA(), declared); err != nil {
+			return a.fail(err)
+		}
+		d = append(d, bson.E{Key: "whenMatched", Value: whenMatched.ToA()})
+	default:
+		return a.failf("$merge whenMatched must be a mode or a pipeline, got %T", opt.WhenMatched)
+	}
+
+	if opt.WhenNotMatched != "" {
+		if !mergeWhenNotMatched[opt.WhenNotMatched] {
+			return a.failf("invalid $merge whenNotMatched %q", opt.WhenNotMatched)
+		}
+		d = append(d, bson.E{Key: "whenNotMatched", Value: opt.WhenNotMatched})
+	}
+	return a.stage("$merge", d)
+}
+
+// updatePipeline converts the $set and $unset operators of an update document
+// into the stages of an update pipeline
+func updatePipeline(u updateDoc) (aggregateDoc, error) {
+	stages := bson.A{}
+	for _, op := range u.ToD() {
+		fields := documentOf(op.Value)
+		switch op.Key {
+		case "$set":
+			stages = append(stages, bson.D{{Key: "$set", Value: bsonValue(fields)}})
+		case "$unset":
+			names := make(bson.A, 0, len(fields))
+			for _, f := range fields {
+				names = append(names, f.Key)
+			}
+			stages = append(stages, bson.D{{Key: "$unset", Value: names}})
+		default:
+			return aggregateDoc{}, fmt.Errorf("%w: $merge whenMatched update supports $set and $unset, got %s", ErrInvalidStage, op.Key)
+		}
+	}
+	return aggregateDoc{Pipeline: stages}, nil
+}
+
+// checkOutputLast records an error for every $out or $merge that is not the last stage
+func (a aggregateDocBuilder) checkOutputLast() aggregateDocBuilder {
+	doc := builder.GetStruct(a).(aggregateDoc)
+	for i := 0; i < len(doc.Pipeline)-1; i++ {
+		if op := stageName(doc.Pipeline[i]); outputStages[op] {
+			a = a.failf("%s must be the last stage, found at %d of %d", op, i, len(doc.Pipeline))
+		}
+	}
+	return a
+}
+
+// IncrementalMerge returns a pipeline that runs pipeline over the documents
+// whose timestampField is after since and merges the results into the target
+// collection, the usual shape of a materialized view refreshed on a schedule
+func IncrementalMerge(pipeline aggregateDoc, timestampField string, since time.Time, into string, opt *AggregateMergeOptions) aggregateDoc {
+	a := AggregateDocBuilder
+	if timestampField == "" {
+		return a.failf("incremental merge requires a timestamp field").Doc()
+	}
+	return a.Match(FilterDocBuilder.Gt(timestampField, since)).
+		concat(pipeline).
+		Merge(into, opt).
+		Doc()
+}
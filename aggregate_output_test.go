@@ -0,0 +1,153 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAggregateOut(t *testing.T) {
+	doc := AggregateDocBuilder.Out("authors").Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "$out", Value: "authors"}}, doc.ToA()[0])
+
+	doc = AggregateDocBuilder.OutDb("reporting", "authors").Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "$out", Value: bson.D{
+		{Key: "db", Value: "reporting"},
+		{Key: "coll", Value: "authors"},
+	}}}, doc.ToA()[0])
+
+	require.True(t, errors.Is(AggregateDocBuilder.Out("").Doc().Err(), ErrInvalidStage))
+}
+
+func TestAggregateMerge(t *testing.T) {
+	doc := AggregateDocBuilder.Merge("monthlytotals", nil).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "$merge", Value: bson.D{{Key: "into", Value: "monthlytotals"}}}}, doc.ToA()[0])
+
+	// { $merge: { into: { db: "reporting", coll: "budgets" }, on: [ "dept", "fiscal_year" ],
+	//   whenMatched: "replace", whenNotMatched: "insert" } }
+	doc = AggregateDocBuilder.MergeDb("reporting", "budgets", &AggregateMergeOptions{
+		On:             []string{"dept", "fiscal_year"},
+		WhenMatched:    "replace",
+		WhenNotMatched: "insert",
+	}).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "$merge", Value: bson.D{
+		{Key: "into", Value: bson.D{{Key: "db", Value: "reporting"}, {Key: "coll", Value: "budgets"}}},
+		{Key: "on", Value: bson.A{"dept", "fiscal_year"}},
+		{Key: "whenMatched", Value: "replace"},
+		{Key: "whenNotMatched", Value: "insert"},
+	}}}, doc.ToA()[0])
+
+	// { $merge: { into: "salaries", on: "_id", let: { year: 2020 },
+	//   whenMatched: [ { $addFields: { "salaries.$$year": "$$new.salary" } } ] } }
+	update := AggregateDocBuilder.AddFields(bson.D{{Key: "salary", Value: "$$new.salary"}, {Key: "year", Value: "$$year"}}).Doc()
+	doc = AggregateDocBuilder.Merge("salaries", &AggregateMergeOptions{
+		On:          []string{"_id"},
+		Let:         bson.D{{Key: "year", Value: 2020}, {Key: "new", Value: "$$ROOT"}},
+		WhenMatched: update,
+	}).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "$merge", Value: bson.D{
+		{Key: "into", Value: "salaries"},
+		{Key: "on", Value: "_id"},
+		{Key: "let", Value: bson.D{{Key: "year", Value: 2020}, {Key: "new", Value: "$$ROOT"}}},
+		{Key: "whenMatched", Value: update.ToA()},
+	}}}, doc.ToA()[0])
+
+	// $$new is implicit without let
+	doc = AggregateDocBuilder.Merge("salaries", &AggregateMergeOptions{
+		WhenMatched: AggregateDocBuilder.Set(bson.D{{Key: "salary", Value: "$$new.salary"}}).Doc(),
+	}).Doc()
+	require.NoError(t, doc.Err())
+
+	// a builder, a bson.A and a []bson.D are update pipelines too
+	set := bson.D{{Key: "$set", Value: bson.D{{Key: "salary", Value: "$$new.salary"}}}}
+	for name, whenMatched := range map[string]interface{}{
+		"builder": AggregateDocBuilder.Set(bson.D{{Key: "salary", Value: "$$new.salary"}}),
+		"array":   bson.A{set},
+		"stages":  []bson.D{set},
+	} {
+		doc = AggregateDocBuilder.Merge("salaries", &AggregateMergeOptions{WhenMatched: whenMatched}).Doc()
+		require.NoError(t, doc.Err(), name)
+		require.EqualValues(t, bson.D{{Key: "$merge", Value: bson.D{
+			{Key: "into", Value: "salaries"},
+			{Key: "whenMatched", Value: bson.A{set}},
+		}}}, doc.ToA()[0], name)
+	}
+	doc = AggregateDocBuilder.Merge("salaries", &AggregateMergeOptions{WhenMatched: []bson.D{{{Key: "$limit", Value: 1}}}}).Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+
+	// the $set and $unset of an update document become pipeline stages
+	updates := UpdateDocBuilder.Set("salary", "$$new.salary").Unset("bonus")
+	for _, whenMatched := range []interface{}{updates, updates.Doc()} {
+		doc = AggregateDocBuilder.Merge("salaries", &AggregateMergeOptions{WhenMatched: whenMatched}).Doc()
+		require.NoError(t, doc.Err())
+		require.EqualValues(t, bson.D{{Key: "$merge", Value: bson.D{
+			{Key: "into", Value: "salaries"},
+			{Key: "whenMatched", Value: bson.A{set, bson.D{{Key: "$unset", Value: bson.A{"bonus"}}}}},
+		}}}, doc.ToA()[0])
+	}
+	doc = AggregateDocBuilder.Merge("salaries", &AggregateMergeOptions{WhenMatched: UpdateDocBuilder.Inc("count", 1)}).Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+}
+
+func TestAggregateMergeValidate(t *testing.T) {
+	cases := map[string]*AggregateMergeOptions{
+		"when-matched":     {WhenMatched: "upsert"},
+		"when-not-matched": {WhenNotMatched: "upsert"},
+		"let-without-pipeline": {
+			Let:         bson.D{{Key: "year", Value: 2020}},
+			WhenMatched: "merge",
+		},
+		"pipeline-stage": {WhenMatched: AggregateDocBuilder.Limit(1).Doc()},
+		"undeclared-variable": {
+			Let:         bson.D{{Key: "year", Value: 2020}},
+			WhenMatched: AggregateDocBuilder.Set(bson.D{{Key: "salary", Value: "$$new.salary"}}).Doc(),
+		},
+		"when-matched-type": {WhenMatched: 1},
+	}
+	for name, opt := range cases {
+		require.Error(t, AggregateDocBuilder.Merge("salaries", opt).Doc().Err(), name)
+	}
+}
+
+func TestAggregateOutputLast(t *testing.T) {
+	doc := AggregateDocBuilder.Out("a").Limit(1).Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+	_, err := bson.Marshal(doc)
+	require.Error(t, err)
+
+	doc = AggregateDocBuilder.Merge("a", nil).Out("b").Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+
+	doc = AggregateDocBuilder.Limit(1).Merge("a", nil).Doc()
+	require.NoError(t, doc.Err())
+}
+
+func TestIncrementalMerge(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	group := GroupDocBuilder.IdField("store").Sum("total", "$amount").Doc()
+	pipeline := AggregateDocBuilder.Group(group.ToD()).Doc()
+
+	doc := IncrementalMerge(pipeline, "updated_at", since, "store_totals", &AggregateMergeOptions{WhenMatched: "replace"})
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "updated_at", Value: bson.D{{Key: "$gt", Value: since}}}}}},
+		bson.D{{Key: "$group", Value: group.ToD()}},
+		bson.D{{Key: "$merge", Value: bson.D{{Key: "into", Value: "store_totals"}, {Key: "whenMatched", Value: "replace"}}}},
+	}, doc.ToA())
+
+	doc = IncrementalMerge(AggregateDocBuilder.Out("x").Doc(), "updated_at", since, "store_totals", nil)
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+
+	// a missing timestamp field is the only error
+	doc = IncrementalMerge(pipeline, "", since, "store_totals", nil)
+	require.Len(t, doc.Errors, 1)
+	require.Empty(t, doc.ToA())
+}
@@ -0,0 +1,141 @@
+package hamster
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lann/builder"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// aggregateQuery is an aggregate pipeline with the options it runs with
+type aggregateQuery struct {
+	Pipeline     aggregateDoc
+	AllowDiskUse *bool
+	BatchSize    *int32
+	MaxTime      *time.Duration
+	Hint         interface{}
+	Collation    *options.Collation
+	Comment      *string
+	// Let declares the variables referenced as $$name in the pipeline
+	Let bson.D
+	// Errors collects the problems found while building the query
+	Errors []error
+}
+
+// aggregateQueryBuilder is a builder for aggregateQuery
+type aggregateQueryBuilder builder.Builder
+
+var (
+	// AggregateQueryBuilder is a singleton builder for aggregateQuery, it keeps an
+	// aggregate pipeline and its options together:
+	//
+	//	pipeline, opts, err := AggregateQueryBuilder.Pipeline(p).AllowDiskUse().Doc().Build()
+	//	cursor, err := collection.Aggregate(ctx, pipeline, opts)
+	AggregateQueryBuilder = builder.Register(aggregateQueryBuilder{}, aggregateQuery{}).(aggregateQueryBuilder)
+)
+
+// Doc returns the aggregateQuery instance
+func (q aggregateQueryBuilder) Doc() aggregateQuery {
+	return builder.GetStruct(q).(aggregateQuery)
+}
+
+func (q aggregateQueryBuilder) fail(err error) aggregateQueryBuilder {
+	return builder.Append(q, "Errors", err).(aggregateQueryBuilder)
+}
+
+// Pipeline sets the pipeline to run
+func (q aggregateQueryBuilder) Pipeline(pipeline aggregateDoc) aggregateQueryBuilder {
+	return builder.Set(q, "Pipeline", pipeline).(aggregateQueryBuilder)
+}
+
+// AllowDiskUse lets the stages write temporary files
+func (q aggregateQueryBuilder) AllowDiskUse() aggregateQueryBuilder {
+	allow := true
+	return builder.Set(q, "AllowDiskUse", &allow).(aggregateQueryBuilder)
+}
+
+// BatchSize sets the number of documents per batch
+func (q aggregateQueryBuilder) BatchSize(size int32) aggregateQueryBuilder {
+	if size < 0 {
+		return q.fail(fmt.Errorf("%w: batch size must be non-negative, got %d", ErrInvalidStage, size))
+	}
+	return builder.Set(q, "BatchSize", &size).(aggregateQueryBuilder)
+}
+
+// MaxTime sets the time limit of the query on the server
+func (q aggregateQueryBuilder) MaxTime(d time.Duration) aggregateQueryBuilder {
+	if d < 0 {
+		return q.fail(fmt.Errorf("%w: max time must be non-negative, got %s", ErrInvalidStage, d))
+	}
+	return builder.Set(q, "MaxTime", &d).(aggregateQueryBuilder)
+}
+
+// Hint makes the query use the index with the keys of index
+func (q aggregateQueryBuilder) Hint(index indexDoc) aggregateQueryBuilder {
+	if len(index.Keys) == 0 {
+		return q.fail(fmt.Errorf("%w: hint index has no keys", ErrInvalidStage))
+	}
+	return builder.Set(q, "Hint", index.ToD()).(aggregateQueryBuilder)
+}
+
+// HintName makes the query use the index named name
+func (q aggregateQueryBuilder) HintName(name string) aggregateQueryBuilder {
+	return builder.Set(q, "Hint", name).(aggregateQueryBuilder)
+}
+
+// Collation sets the collation of string comparisons
+func (q aggregateQueryBuilder) Collation(collation *options.Collation) aggregateQueryBuilder {
+	return builder.Set(q, "Collation", collation).(aggregateQueryBuilder)
+}
+
+// Comment sets a comment shown in the profiler and the logs
+func (q aggregateQueryBuilder) Comment(comment string) aggregateQueryBuilder {
+	return builder.Set(q, "Comment", &comment).(aggregateQueryBuilder)
+}
+
+// Let declares the variable name, referenced as $$name in the pipeline
+func (q aggregateQueryBuilder) Let(name string, value interface{}) aggregateQueryBuilder {
+	return builder.Append(q, "Let", bson.E{Key: name, Value: bsonValue(value)}).(aggregateQueryBuilder)
+}
+
+// Err returns the first error of the query or of its pipeline
+func (q aggregateQuery) Err() error {
+	if len(q.Errors) > 0 {
+		return q.Errors[0]
+	}
+	return q.Pipeline.Err()
+}
+
+// Options returns the driver options of the query
+func (q aggregateQuery) Options() *options.AggregateOptions {
+	opt := options.Aggregate()
+	opt.AllowDiskUse = q.AllowDiskUse
+	opt.BatchSize = q.BatchSize
+	opt.MaxTime = q.MaxTime
+	opt.Hint = q.Hint
+	opt.Collation = q.Collation
+	opt.Comment = q.Comment
+	if len(q.Let) > 0 {
+		opt.Let = q.Let
+	}
+	return opt
+}
+
+// Build returns the pipeline and the options to pass to collection.Aggregate.
+// It fails on build errors and on $$ variables that are neither declared with
+// Let, bound inside the pipeline nor system variables
+func (q aggregateQuery) Build() (bson.A, *options.AggregateOptions, error) {
+	if err := q.Err(); err != nil {
+		return nil, nil, err
+	}
+	declared := make(map[string]bool, len(q.Let))
+	for _, e := range q.Let {
+		declared[e.Key] = true
+	}
+	if err := checkVariables(q.Pipeline.ToA(), declared); err != nil {
+		return nil, nil, err
+	}
+	return q.Pipeline.ToA(), q.Options(), nil
+}
@@ -0,0 +1,68 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestAggregateQueryBuilder(t *testing.T) {
+	pipeline := AggregateDocBuilder.
+		Match(FilterDocBuilder.Expr(Expr.Gte(Expr.Field("amount"), Expr.Var("minAmount")))).
+		Limit(10).
+		Doc()
+	collation := &options.Collation{Locale: "fr"}
+
+	query := AggregateQueryBuilder.
+		Pipeline(pipeline).
+		AllowDiskUse().
+		BatchSize(100).
+		MaxTime(2*time.Second).
+		Hint(IndexDocBuilder.Asc("amount").Doc()).
+		Collation(collation).
+		Comment("report").
+		Let("minAmount", 50).
+		Doc()
+
+	stages, opt, err := query.Build()
+	require.NoError(t, err)
+	require.EqualValues(t, pipeline.ToA(), stages)
+	require.True(t, *opt.AllowDiskUse)
+	require.EqualValues(t, 100, *opt.BatchSize)
+	require.Equal(t, 2*time.Second, *opt.MaxTime)
+	require.EqualValues(t, bson.D{{Key: "amount", Value: SortAsc}}, opt.Hint)
+	require.Equal(t, collation, opt.Collation)
+	require.Equal(t, "report", *opt.Comment)
+	require.EqualValues(t, bson.D{{Key: "minAmount", Value: 50}}, opt.Let)
+
+	// unset options stay nil
+	_, opt, err = AggregateQueryBuilder.Pipeline(AggregateDocBuilder.Limit(1).Doc()).HintName("amount_1").Doc().Build()
+	require.NoError(t, err)
+	require.Equal(t, "amount_1", opt.Hint)
+	require.Nil(t, opt.AllowDiskUse)
+	require.Nil(t, opt.Let)
+}
+
+func TestAggregateQueryErrors(t *testing.T) {
+	undeclared := AggregateQueryBuilder.
+		Pipeline(AggregateDocBuilder.Match(FilterDocBuilder.Expr(Expr.Eq(Expr.Field("a"), Expr.Var("tenant")))).Doc()).
+		Let("other", 1).
+		Doc()
+	_, _, err := undeclared.Build()
+	require.True(t, errors.Is(err, ErrUndeclaredVariable))
+
+	cases := map[string]aggregateQuery{
+		"batch":    AggregateQueryBuilder.BatchSize(-1).Doc(),
+		"max-time": AggregateQueryBuilder.MaxTime(-time.Second).Doc(),
+		"hint":     AggregateQueryBuilder.Hint(IndexDocBuilder.Doc()).Doc(),
+		"pipeline": AggregateQueryBuilder.Pipeline(AggregateDocBuilder.Out("").Doc()).Doc(),
+	}
+	for name, query := range cases {
+		_, _, err := query.Build()
+		require.True(t, errors.Is(err, ErrInvalidStage), name)
+	}
+}
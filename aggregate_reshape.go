@@ -0,0 +1,140 @@
+package hamster
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// AggregateUnwindOptions are the optional fields of the $unwind document form
+type AggregateUnwindOptions struct {
+	IncludeArrayIndex          *string
+	PreserveNullAndEmptyArrays *bool
+}
+
+// UnwindWithOptions adds the document form of $unwind
+// { $unwind: { path: <path>, includeArrayIndex: <string>, preserveNullAndEmptyArrays: <bool> } }
+func (a aggregateDocBuilder) UnwindWithOptions(path string, opt *AggregateUnwindOptions) aggregateDocBuilder {
+	if !strings.HasPrefix(path, "$") || len(path) == 1 {
+		return a.failf("$unwind path must be a field path prefixed with $, got %q", path)
+	}
+	d := bson.D{{Key: "path", Value: path}}
+	if opt != nil {
+		if opt.IncludeArrayIndex != nil {
+			if strings.HasPrefix(*opt.IncludeArrayIndex, "$") {
+				return a.failf("$unwind includeArrayIndex must not start with $, got %q", *opt.IncludeArrayIndex)
+			}
+			d = append(d, bson.E{Key: "includeArrayIndex", Value: *opt.IncludeArrayIndex})
+		}
+		if opt.PreserveNullAndEmptyArrays != nil {
+			d = append(d, bson.E{Key: "preserveNullAndEmptyArrays", Value: *opt.PreserveNullAndEmptyArrays})
+		}
+	}
+	return a.stage("$unwind", d)
+}
+
+// ReplaceRoot adds { $replaceRoot: { newRoot: <newRoot> } }, newRoot is a field path,
+// an Expression or a document
+func (a aggregateDocBuilder) ReplaceRoot(newRoot interface{}) aggregateDocBuilder {
+	a, root, ok := a.replacement("$replaceRoot", newRoot)
+	if !ok {
+		return a
+	}
+	return a.stage("$replaceRoot", bson.D{{Key: "newRoot", Value: root}})
+}
+
+// ReplaceWith adds { $replaceWith: <replacement> }, replacement is a field path,
+// an Expression or a document
+func (a aggregateDocBuilder) ReplaceWith(replacement interface{}) aggregateDocBuilder {
+	a, root, ok := a.replacement("$replaceWith", replacement)
+	if !ok {
+		return a
+	}
+	return a.stage("$replaceWith", root)
+}
+
+// AddFields adds { $addFields: { <field>: <expression>, ... } }, fields is a hamster
+// doc or builder, a bson.D or a bson.M
+func (a aggregateDocBuilder) AddFields(fields interface{}) aggregateDocBuilder {
+	return a.expressions("$addFields", fields)
+}
+
+// Set adds { $set: { <field>: <expression>, ... } }, an alias of $addFields
+func (a aggregateDocBuilder) Set(fields interface{}) aggregateDocBuilder {
+	return a.expressions("$set", fields)
+}
+
+// replacement returns the new root of $replaceRoot and $replaceWith
+func (a aggregateDocBuilder) replacement(stage string, v interface{}) (aggregateDocBuilder, interface{}, bool) {
+	switch t := v.(type) {
+	case string:
+		if !strings.HasPrefix(t, "$") || len(t) == 1 {
+			return a.failf("%s needs a field path prefixed with $, got %q", stage, t), nil, false
+		}
+		return a, t, true
+	case Expression:
+		return a, t.Value(), true
+	}
+	d, ok := toDocument(v)
+	if !ok {
+		return a.failf("%s needs a field path, an Expression or a document, got %T", stage, v), nil, false
+	}
+	for _, err := range nestedErrors(v) {
+		a = a.fail(err)
+	}
+	return a, bsonValue(d), true
+}
+
+// expressions appends { <stage>: <fields> }, the Expressions and hamster docs
+// nested in fields are rendered and their errors recorded
+func (a aggregateDocBuilder) expressions(stage string, fields interface{}) aggregateDocBuilder {
+	d, ok := toDocument(fields)
+	if !ok {
+		return a.failf("%s needs a document, got %T", stage, fields)
+	}
+	for _, err := range nestedErrors(fields) {
+		a = a.fail(err)
+	}
+	return a.stage(stage, bsonValue(d))
+}
+
+// Unset adds { $unset: <field> } or { $unset: [ <field>, ... ] }
+func (a aggregateDocBuilder) Unset(fields ...string) aggregateDocBuilder {
+	if len(fields) == 0 {
+		return a.failf("$unset requires at least one field")
+	}
+	if len(fields) == 1 {
+		return a.stage("$unset", fields[0])
+	}
+	arr := make(bson.A, 0, len(fields))
+	for _, f := range fields {
+		arr = append(arr, f)
+	}
+	return a.stage("$unset", arr)
+}
+
+// Count adds { $count: <field> }
+func (a aggregateDocBuilder) Count(field string) aggregateDocBuilder {
+	if field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+		return a.failf("invalid $count field %q", field)
+	}
+	return a.stage("$count", field)
+}
+
+// SortByCount adds { $sortByCount: <expression> }
+func (a aggregateDocBuilder) SortByCount(expr interface{}) aggregateDocBuilder {
+	return a.stage("$sortByCount", bsonValue(expr))
+}
+
+// Sample adds { $sample: { size: <size> } }
+func (a aggregateDocBuilder) Sample(size int64) aggregateDocBuilder {
+	if size < 1 {
+		return a.failf("$sample size must be positive, got %d", size)
+	}
+	return a.stage("$sample", bson.D{{Key: "size", Value: size}})
+}
+
+// Redact adds { $redact: <expression> }, the expression resolves to $$DESCEND, $$PRUNE or $$KEEP
+func (a aggregateDocBuilder) Redact(expr interface{}) aggregateDocBuilder {
+	return a.stage("$redact", bsonValue(expr))
+}
@@ -0,0 +1,99 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAggregateUnwindWithOptions(t *testing.T) {
+	// { $unwind: { path: "$sizes", includeArrayIndex: "arrayIndex", preserveNullAndEmptyArrays: true } }
+	index := "arrayIndex"
+	preserve := true
+	doc := AggregateDocBuilder.UnwindWithOptions("$sizes", &AggregateUnwindOptions{
+		IncludeArrayIndex:          &index,
+		PreserveNullAndEmptyArrays: &preserve,
+	}).Doc()
+	std := bson.D{{Key: "$unwind", Value: bson.D{
+		{Key: "path", Value: "$sizes"},
+		{Key: "includeArrayIndex", Value: "arrayIndex"},
+		{Key: "preserveNullAndEmptyArrays", Value: true},
+	}}}
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, std, doc.ToA()[0])
+
+	doc = AggregateDocBuilder.UnwindWithOptions("$sizes", nil).Doc()
+	require.EqualValues(t, bson.D{{Key: "$unwind", Value: bson.D{{Key: "path", Value: "$sizes"}}}}, doc.ToA()[0])
+
+	doc = AggregateDocBuilder.UnwindWithOptions("sizes", nil).Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+}
+
+func TestAggregateReshapeStages(t *testing.T) {
+	total := Expr.Add(Expr.Field("homework"), Expr.Field("quiz"))
+	doc := AggregateDocBuilder.
+		ReplaceRoot(Expr.Field("name")).
+		ReplaceWith(Expr.Field("name")).
+		AddFields(bson.D{{Key: "total", Value: total}}).
+		Set(bson.D{{Key: "total", Value: total}}).
+		Unset("isbn").
+		Unset("isbn", "author.first").
+		SortByCount(Expr.Field("tags")).
+		Sample(3).
+		Redact(Expr.Cond(Expr.Gt(Expr.Field("level"), 5), "$$PRUNE", "$$DESCEND")).
+		Count("passing_scores").
+		Doc()
+
+	std := bson.A{
+		bson.D{{Key: "$replaceRoot", Value: bson.D{{Key: "newRoot", Value: "$name"}}}},
+		bson.D{{Key: "$replaceWith", Value: "$name"}},
+		bson.D{{Key: "$addFields", Value: bson.D{{Key: "total", Value: bson.D{{Key: "$add", Value: bson.A{"$homework", "$quiz"}}}}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "total", Value: bson.D{{Key: "$add", Value: bson.A{"$homework", "$quiz"}}}}}}},
+		bson.D{{Key: "$unset", Value: "isbn"}},
+		bson.D{{Key: "$unset", Value: bson.A{"isbn", "author.first"}}},
+		bson.D{{Key: "$sortByCount", Value: "$tags"}},
+		bson.D{{Key: "$sample", Value: bson.D{{Key: "size", Value: int64(3)}}}},
+		bson.D{{Key: "$redact", Value: bson.D{{Key: "$cond", Value: bson.D{
+			{Key: "if", Value: bson.D{{Key: "$gt", Value: bson.A{"$level", 5}}}},
+			{Key: "then", Value: "$$PRUNE"},
+			{Key: "else", Value: "$$DESCEND"},
+		}}}}},
+		bson.D{{Key: "$count", Value: "passing_scores"}},
+	}
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, std, doc.ToA())
+
+	// hamster documents are accepted as well
+	doc = AggregateDocBuilder.ReplaceWith(DocumentBuilder.Set("a.b", "$x").Doc()).Doc()
+	require.EqualValues(t, bson.D{{Key: "$replaceWith", Value: bson.D{{Key: "a", Value: bson.D{{Key: "b", Value: "$x"}}}}}}, doc.ToA()[0])
+}
+
+func TestAggregateReshapeValidate(t *testing.T) {
+	require.True(t, errors.Is(AggregateDocBuilder.Unset().Doc().Err(), ErrInvalidStage))
+	require.True(t, errors.Is(AggregateDocBuilder.Count("$n").Doc().Err(), ErrInvalidStage))
+	require.True(t, errors.Is(AggregateDocBuilder.Sample(0).Doc().Err(), ErrInvalidStage))
+}
+
+func TestAggregateReshapeDocuments(t *testing.T) {
+	// bson.M fields are sorted and nested Expressions rendered
+	doc := AggregateDocBuilder.AddFields(bson.M{"b": Expr.Field("x"), "a": 1}).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "$addFields", Value: bson.D{{Key: "a", Value: 1}, {Key: "b", Value: "$x"}}}}, doc.ToA()[0])
+
+	doc = AggregateDocBuilder.ReplaceRoot(bson.M{"name": "$name"}).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "$replaceRoot", Value: bson.D{{Key: "newRoot", Value: bson.D{{Key: "name", Value: "$name"}}}}}}, doc.ToA()[0])
+
+	// non documents are rejected
+	require.True(t, errors.Is(AggregateDocBuilder.AddFields("total").Doc().Err(), ErrInvalidStage))
+	require.True(t, errors.Is(AggregateDocBuilder.Set(bson.A{1}).Doc().Err(), ErrInvalidStage))
+	require.True(t, errors.Is(AggregateDocBuilder.ReplaceRoot("name").Doc().Err(), ErrInvalidStage))
+	require.True(t, errors.Is(AggregateDocBuilder.ReplaceWith(42).Doc().Err(), ErrInvalidStage))
+
+	// the errors of nested hamster docs are inherited
+	bad := AggregateDocBuilder.Sample(0).Doc()
+	require.True(t, errors.Is(AggregateDocBuilder.Set(bson.D{{Key: "items", Value: bad}}).Doc().Err(), ErrInvalidStage))
+	require.True(t, errors.Is(AggregateDocBuilder.ReplaceWith(bad).Doc().Err(), ErrInvalidStage))
+}
@@ -0,0 +1,562 @@
+package hamster
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Run executes the pipeline in memory over docs, which lets a pipeline be
+// tested without a server. It runs $match, $project, $addFields, $set,
+// $unset, $sort, $skip, $limit, $unwind, $group, $count, $replaceRoot,
+// $replaceWith and $facet, any other stage returns ErrUnsupported.
+// Integers are added as int64 unless all of them are int32
+func (a aggregateDoc) Run(docs []bson.D) ([]bson.D, error) {
+	if err := a.Err(); err != nil {
+		return nil, err
+	}
+	return runPipeline(a.Pipeline, docs)
+}
+
+func runPipeline(pipeline bson.A, docs []bson.D) ([]bson.D, error) {
+	for i, stage := range pipeline {
+		op, value, problem := splitStage(stage)
+		if problem != "" {
+			return nil, fmt.Errorf("%w: stage %d: %s", ErrInvalidStage, i, problem)
+		}
+		out, err := runStage(op, value, docs)
+		if err != nil {
+			return nil, fmt.Errorf("stage %d %s: %w", i, op, err)
+		}
+		docs = out
+	}
+	return docs, nil
+}
+
+func runStage(op string, value interface{}, docs []bson.D) ([]bson.D, error) {
+	switch op {
+	case "$match":
+		return runMatch(value, docs)
+	case "$project":
+		return runProject(value, docs)
+	case "$addFields", "$set":
+		return runAddFields(value, docs)
+	case "$unset":
+		return runUnset(value, docs)
+	case "$sort":
+		return runSort(value, docs)
+	case "$skip":
+		return runSkip(value, docs)
+	case "$limit":
+		return runLimit(value, docs)
+	case "$unwind":
+		return runUnwind(value, docs)
+	case "$group":
+		return runGroup(value, docs)
+	case "$count":
+		return runCount(value, docs)
+	case "$replaceRoot":
+		return runReplaceRoot(value, docs)
+	case "$replaceWith":
+		return runReplaceWith(value, docs)
+	case "$facet":
+		return runFacet(value, docs)
+	}
+	return nil, fmt.Errorf("%w: stage %s", ErrUnsupported, op)
+}
+
+func runMatch(value interface{}, docs []bson.D) ([]bson.D, error) {
+	filter := documentOf(value)
+	if filter == nil {
+		return nil, fmt.Errorf("%w: $match takes a filter document", ErrInvalidStage)
+	}
+	out := make([]bson.D, 0, len(docs))
+	for _, doc := range docs {
+		ok, err := matchDocument(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = append(out, doc)
+		}
+	}
+	return out, nil
+}
+
+// flattenSpec turns { a: { b: 1 } } into { "a.b": 1 }, operator documents are kept
+func flattenSpec(spec bson.D, prefix string) bson.D {
+	var out bson.D
+	for _, e := range spec {
+		path := prefix + e.Key
+		if d := documentOf(e.Value); len(d) > 0 && !strings.HasPrefix(d[0].Key, "$") {
+			out = append(out, flattenSpec(d, path+".")...)
+			continue
+		}
+		out = append(out, bson.E{Key: path, Value: e.Value})
+	}
+	return out
+}
+
+func runProject(value interface{}, docs []bson.D) ([]bson.D, error) {
+	spec := documentOf(value)
+	if len(spec) == 0 {
+		return nil, fmt.Errorf("%w: $project needs at least one field", ErrInvalidStage)
+	}
+	spec = flattenSpec(spec, "")
+
+	var included, excluded []string
+	var computed bson.D
+	keepID, idOnly := true, false
+	for _, e := range spec {
+		isFlag := false
+		flag := false
+		switch v := e.Value.(type) {
+		case bool:
+			isFlag, flag = true, v
+		default:
+			if f, ok := toFloat(v); ok {
+				isFlag, flag = true, f != 0
+			}
+		}
+		switch {
+		case e.Key == "_id" && isFlag:
+			keepID, idOnly = flag, flag
+		case isFlag && flag:
+			included = append(included, e.Key)
+		case isFlag:
+			excluded = append(excluded, e.Key)
+		default:
+			computed = append(computed, e)
+		}
+	}
+	if len(excluded) > 0 && (len(included) > 0 || len(computed) > 0) {
+		return nil, fmt.Errorf("%w: $project cannot mix exclusions and inclusions", ErrInvalidStage)
+	}
+
+	// { _id: 1 } alone is an inclusion of _id
+	exclusion := len(included) == 0 && len(computed) == 0 && (len(excluded) > 0 || !idOnly)
+
+	out := make([]bson.D, 0, len(docs))
+	for _, doc := range docs {
+		if exclusion {
+			var v interface{} = doc
+			if !keepID {
+				v = removePath(v, []string{"_id"})
+			}
+			for _, path := range excluded {
+				v = removePath(v, strings.Split(path, "."))
+			}
+			out = append(out, documentOf(v))
+			continue
+		}
+
+		projected := bson.D{}
+		if keepID {
+			if id := fieldValue(doc, []string{"_id"}); id != missing {
+				projected = append(projected, bson.E{Key: "_id", Value: id})
+			}
+		}
+		for _, path := range included {
+			projected = includePath(projected, doc, strings.Split(path, "."))
+		}
+		ctx := evalContext{root: doc}
+		for _, e := range computed {
+			v, err := ctx.eval(e.Value)
+			if err != nil {
+				return nil, err
+			}
+			if v != missing {
+				projected = setPath(projected, strings.Split(e.Key, "."), v)
+			}
+		}
+		out = append(out, projected)
+	}
+	return out, nil
+}
+
+// includePath copies path from src into dst, arrays of documents are projected element-wise
+func includePath(dst bson.D, src bson.D, path []string) bson.D {
+	for _, e := range src {
+		if e.Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return setField(dst, e.Key, e.Value)
+		}
+		var existing interface{}
+		for _, d := range dst {
+			if d.Key == e.Key {
+				existing = d.Value
+			}
+		}
+		if sub := documentOf(e.Value); sub != nil {
+			return setField(dst, e.Key, includePath(documentOf(existing), sub, path[1:]))
+		}
+		if arr := arrayOf(e.Value); arr != nil {
+			prev := arrayOf(existing)
+			elems := bson.A{}
+			for _, elem := range arr {
+				if sub := documentOf(elem); sub != nil {
+					var into bson.D
+					if len(elems) < len(prev) {
+						into = documentOf(prev[len(elems)])
+					}
+					elems = append(elems, includePath(into, sub, path[1:]))
+				}
+			}
+			return setField(dst, e.Key, elems)
+		}
+	}
+	return dst
+}
+
+func runAddFields(value interface{}, docs []bson.D) ([]bson.D, error) {
+	spec := documentOf(value)
+	if spec == nil {
+		return nil, fmt.Errorf("%w: $addFields takes a document", ErrInvalidStage)
+	}
+	spec = flattenSpec(spec, "")
+	out := make([]bson.D, 0, len(docs))
+	for _, doc := range docs {
+		ctx := evalContext{root: doc}
+		result := doc
+		for _, e := range spec {
+			v, err := ctx.eval(e.Value)
+			if err != nil {
+				return nil, err
+			}
+			path := strings.Split(e.Key, ".")
+			if v == missing {
+				result = documentOf(removePath(result, path))
+				continue
+			}
+			result = setPath(result, path, v)
+		}
+		out = append(out, result)
+	}
+	return out, nil
+}
+
+func runUnset(value interface{}, docs []bson.D) ([]bson.D, error) {
+	var paths []string
+	switch v := value.(type) {
+	case string:
+		paths = []string{v}
+	default:
+		for _, p := range arrayOf(v) {
+			s, ok := p.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: $unset takes field names", ErrInvalidStage)
+			}
+			paths = append(paths, s)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%w: $unset takes field names", ErrInvalidStage)
+	}
+	out := make([]bson.D, 0, len(docs))
+	for _, doc := range docs {
+		var v interface{} = doc
+		for _, p := range paths {
+			v = removePath(v, strings.Split(p, "."))
+		}
+		out = append(out, documentOf(v))
+	}
+	return out, nil
+}
+
+// sortKey returns the value a document sorts by, arrays sort by their
+// smallest element ascending and their largest descending
+func sortKey(doc bson.D, path string, desc bool) interface{} {
+	v := orNull(fieldValue(doc, strings.Split(path, ".")))
+	arr := arrayOf(v)
+	if arr == nil {
+		return v
+	}
+	if len(arr) == 0 {
+		return nil
+	}
+	best := arr[0]
+	for _, elem := range arr[1:] {
+		c := compareValues(elem, best)
+		if (desc && c > 0) || (!desc && c < 0) {
+			best = elem
+		}
+	}
+	return best
+}
+
+func runSort(value interface{}, docs []bson.D) ([]bson.D, error) {
+	spec := documentOf(value)
+	if len(spec) == 0 {
+		return nil, fmt.Errorf("%w: $sort needs at least one field", ErrInvalidStage)
+	}
+	desc := make([]bool, len(spec))
+	for i, e := range spec {
+		n, ok := intOf(e.Value)
+		if order, isOrder := e.Value.(OrderClause); isOrder {
+			n, ok = int64(order), true
+		}
+		if !ok || (n != 1 && n != -1) {
+			return nil, fmt.Errorf("%w: $sort order of %q must be 1 or -1", ErrUnsupported, e.Key)
+		}
+		desc[i] = n == -1
+	}
+	out := append([]bson.D{}, docs...)
+	sort.SliceStable(out, func(i, j int) bool {
+		for k, e := range spec {
+			c := compareValues(sortKey(out[i], e.Key, desc[k]), sortKey(out[j], e.Key, desc[k]))
+			if desc[k] {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return out, nil
+}
+
+func runSkip(value interface{}, docs []bson.D) ([]bson.D, error) {
+	n, ok := intOf(value)
+	if !ok || n < 0 {
+		return nil, fmt.Errorf("%w: $skip takes a non-negative integer", ErrInvalidStage)
+	}
+	if n > int64(len(docs)) {
+		n = int64(len(docs))
+	}
+	return docs[n:], nil
+}
+
+func runLimit(value interface{}, docs []bson.D) ([]bson.D, error) {
+	n, ok := intOf(value)
+	if !ok || n <= 0 {
+		return nil, fmt.Errorf("%w: $limit takes a positive integer", ErrInvalidStage)
+	}
+	if n > int64(len(docs)) {
+		n = int64(len(docs))
+	}
+	return docs[:n], nil
+}
+
+func runUnwind(value interface{}, docs []bson.D) ([]bson.D, error) {
+	var path, indexField string
+	preserve := false
+	switch v := value.(type) {
+	case string:
+		path = v
+	default:
+		spec := documentOf(v)
+		for _, e := range spec {
+			switch e.Key {
+			case "path":
+				path, _ = e.Value.(string)
+			case "includeArrayIndex":
+				indexField, _ = e.Value.(string)
+			case "preserveNullAndEmptyArrays":
+				preserve = truthy(e.Value)
+			default:
+				return nil, fmt.Errorf("%w: $unwind has no option %q", ErrInvalidStage, e.Key)
+			}
+		}
+	}
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("%w: $unwind path must start with $", ErrInvalidStage)
+	}
+	segments := strings.Split(path[1:], ".")
+
+	var out []bson.D
+	for _, doc := range docs {
+		v := documentValue(doc, segments)
+		arr := arrayOf(v)
+		switch {
+		case arr != nil && len(arr) > 0:
+			for i, elem := range arr {
+				unwound := setPath(doc, segments, elem)
+				if indexField != "" {
+					unwound = setPath(unwound, strings.Split(indexField, "."), int64(i))
+				}
+				out = append(out, unwound)
+			}
+		case arr == nil && !nullish(v):
+			// a non-array value is treated as a single element array
+			if indexField != "" {
+				doc = setPath(doc, strings.Split(indexField, "."), nil)
+			}
+			out = append(out, doc)
+		case preserve:
+			// an empty array is removed, null and missing are kept as is
+			if arr != nil {
+				doc = documentOf(removePath(doc, segments))
+			}
+			if indexField != "" {
+				doc = setPath(doc, strings.Split(indexField, "."), nil)
+			}
+			out = append(out, doc)
+		}
+	}
+	return out, nil
+}
+
+// documentValue returns the value at path without traversing arrays
+func documentValue(doc bson.D, path []string) interface{} {
+	var v interface{} = doc
+	for _, segment := range path {
+		d := documentOf(v)
+		if d == nil {
+			return missing
+		}
+		v = missing
+		for _, e := range d {
+			if e.Key == segment {
+				v = e.Value
+			}
+		}
+	}
+	return v
+}
+
+// groupAccumulators are the $group accumulators Run supports
+var groupAccumulators = map[string]bool{
+	"$sum": true, "$avg": true, "$min": true, "$max": true, "$first": true, "$last": true,
+	"$push": true, "$addToSet": true, "$count": true, "$stdDevPop": true, "$stdDevSamp": true,
+	"$mergeObjects": true,
+}
+
+func runGroup(value interface{}, docs []bson.D) ([]bson.D, error) {
+	spec := documentOf(value)
+	var idExpr interface{}
+	hasID := false
+	type field struct {
+		name string
+		op   string
+		expr interface{}
+	}
+	var fields []field
+	for _, e := range spec {
+		if e.Key == "_id" {
+			idExpr, hasID = e.Value, true
+			continue
+		}
+		acc := documentOf(e.Value)
+		if len(acc) != 1 {
+			return nil, fmt.Errorf("%w: $group field %q must be a single accumulator", ErrInvalidStage, e.Key)
+		}
+		if !groupAccumulators[acc[0].Key] {
+			return nil, fmt.Errorf("%w: accumulator %s", ErrUnsupported, acc[0].Key)
+		}
+		fields = append(fields, field{name: e.Key, op: acc[0].Key, expr: acc[0].Value})
+	}
+	if !hasID {
+		return nil, fmt.Errorf("%w: $group requires an _id", ErrInvalidStage)
+	}
+
+	type group struct {
+		id     interface{}
+		values [][]interface{}
+	}
+	var groups []*group
+	for _, doc := range docs {
+		ctx := evalContext{root: doc}
+		id, err := ctx.eval(idExpr)
+		if err != nil {
+			return nil, err
+		}
+		id = orNull(id)
+
+		var g *group
+		for _, candidate := range groups {
+			if typeOrder(candidate.id) == typeOrder(id) && compareValues(candidate.id, id) == 0 {
+				g = candidate
+				break
+			}
+		}
+		if g == nil {
+			g = &group{id: id, values: make([][]interface{}, len(fields))}
+			groups = append(groups, g)
+		}
+		for i, f := range fields {
+			v, err := ctx.eval(f.expr)
+			if err != nil {
+				return nil, err
+			}
+			g.values[i] = append(g.values[i], v)
+		}
+	}
+
+	out := make([]bson.D, 0, len(groups))
+	for _, g := range groups {
+		d := bson.D{{Key: "_id", Value: g.id}}
+		for i, f := range fields {
+			v, err := accumulate(f.op, g.values[i])
+			if err != nil {
+				return nil, err
+			}
+			d = append(d, bson.E{Key: f.name, Value: v})
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+func runCount(value interface{}, docs []bson.D) ([]bson.D, error) {
+	name, ok := value.(string)
+	if !ok || name == "" || strings.HasPrefix(name, "$") || strings.Contains(name, ".") {
+		return nil, fmt.Errorf("%w: $count takes a field name", ErrInvalidStage)
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	return []bson.D{{{Key: name, Value: int32(len(docs))}}}, nil
+}
+
+func runReplaceRoot(value interface{}, docs []bson.D) ([]bson.D, error) {
+	spec := documentOf(value)
+	if len(spec) != 1 || spec[0].Key != "newRoot" {
+		return nil, fmt.Errorf("%w: $replaceRoot takes { newRoot: <expression> }", ErrInvalidStage)
+	}
+	return runReplaceWith(spec[0].Value, docs)
+}
+
+func runReplaceWith(value interface{}, docs []bson.D) ([]bson.D, error) {
+	out := make([]bson.D, 0, len(docs))
+	for _, doc := range docs {
+		v, err := evalContext{root: doc}.eval(value)
+		if err != nil {
+			return nil, err
+		}
+		d := documentOf(v)
+		if d == nil {
+			return nil, fmt.Errorf("%w: the new root must be a document, got %T", ErrInvalidStage, orNull(v))
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+func runFacet(value interface{}, docs []bson.D) ([]bson.D, error) {
+	facets := documentOf(value)
+	if len(facets) == 0 {
+		return nil, fmt.Errorf("%w: $facet needs at least one sub-pipeline", ErrInvalidStage)
+	}
+	result := make(bson.D, 0, len(facets))
+	for _, facet := range facets {
+		pipeline := arrayOf(facet.Value)
+		if pipeline == nil {
+			return nil, fmt.Errorf("%w: $facet %q must be a pipeline", ErrInvalidStage, facet.Key)
+		}
+		sub, err := runPipeline(pipeline, docs)
+		if err != nil {
+			return nil, fmt.Errorf("$facet %q: %w", facet.Key, err)
+		}
+		arr := make(bson.A, 0, len(sub))
+		for _, d := range sub {
+			arr = append(arr, d)
+		}
+		result = append(result, bson.E{Key: facet.Key, Value: arr})
+	}
+	return []bson.D{result}, nil
+}
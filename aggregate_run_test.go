@@ -0,0 +1,126 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var runOrders = []bson.D{
+	{{Key: "_id", Value: 1}, {Key: "store", Value: "paris"}, {Key: "amount", Value: int64(30)}, {Key: "items", Value: bson.A{"pen", "ink"}}},
+	{{Key: "_id", Value: 2}, {Key: "store", Value: "lyon"}, {Key: "amount", Value: int64(10)}, {Key: "items", Value: bson.A{"pen"}}},
+	{{Key: "_id", Value: 3}, {Key: "store", Value: "paris"}, {Key: "amount", Value: int64(5)}, {Key: "items", Value: bson.A{}}},
+	{{Key: "_id", Value: 4}, {Key: "store", Value: "nice"}, {Key: "amount", Value: int64(50)}},
+}
+
+func TestAggregateRun(t *testing.T) {
+	group := GroupDocBuilder.IdField("store").
+		Sum("total", "$amount").
+		Count("orders").
+		Push("ids", "$_id").
+		Doc()
+	doc := AggregateDocBuilder.
+		Match(FilterDocBuilder.Gt("amount", 6).Doc().ToD()).
+		Group(group.ToD()).
+		Sort(SortDocBuilder.OrderDescBy("total").Doc().ToD()).
+		Skip(1).
+		Limit(5).
+		Doc()
+	out, err := doc.Run(runOrders)
+	require.NoError(t, err)
+	require.EqualValues(t, []bson.D{
+		{{Key: "_id", Value: "paris"}, {Key: "total", Value: int64(30)}, {Key: "orders", Value: int32(1)}, {Key: "ids", Value: bson.A{1}}},
+		{{Key: "_id", Value: "lyon"}, {Key: "total", Value: int64(10)}, {Key: "orders", Value: int32(1)}, {Key: "ids", Value: bson.A{2}}},
+	}, out)
+
+	// $unwind, $project and $count
+	index := "i"
+	doc = AggregateDocBuilder.
+		UnwindWithOptions("$items", &AggregateUnwindOptions{IncludeArrayIndex: &index}).
+		Project(ProjectDocBuilder.ExcludeId().Include("items", "i").Doc().ToD()).
+		Doc()
+	out, err = doc.Run(runOrders)
+	require.NoError(t, err)
+	require.EqualValues(t, []bson.D{
+		{{Key: "items", Value: "pen"}, {Key: "i", Value: int64(0)}},
+		{{Key: "items", Value: "ink"}, {Key: "i", Value: int64(1)}},
+		{{Key: "items", Value: "pen"}, {Key: "i", Value: int64(0)}},
+	}, out)
+
+	preserve := true
+	out, err = AggregateDocBuilder.
+		UnwindWithOptions("$items", &AggregateUnwindOptions{PreserveNullAndEmptyArrays: &preserve}).
+		Count("n").
+		Doc().Run(runOrders)
+	require.NoError(t, err)
+	require.EqualValues(t, []bson.D{{{Key: "n", Value: int32(5)}}}, out)
+
+	// an empty array is removed by a preserving $unwind, null is kept
+	out, err = AggregateDocBuilder.
+		UnwindWithOptions("$arr", &AggregateUnwindOptions{PreserveNullAndEmptyArrays: &preserve}).
+		Doc().Run([]bson.D{
+		{{Key: "_id", Value: 1}, {Key: "arr", Value: bson.A{}}},
+		{{Key: "_id", Value: 2}, {Key: "arr", Value: nil}},
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, []bson.D{
+		{{Key: "_id", Value: 1}},
+		{{Key: "_id", Value: 2}, {Key: "arr", Value: nil}},
+	}, out)
+
+	// { _id: 1 } alone is an inclusion
+	out, err = AggregateDocBuilder.Project(bson.D{{Key: "_id", Value: 1}}).Doc().Run([]bson.D{
+		{{Key: "_id", Value: 1}, {Key: "a", Value: 2}, {Key: "arr", Value: bson.A{}}},
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, []bson.D{{{Key: "_id", Value: 1}}}, out)
+
+	// $addFields, $unset and $replaceRoot
+	out, err = AggregateDocBuilder.
+		AddFields(bson.D{{Key: "summary", Value: bson.D{
+			{Key: "store", Value: Expr.ToUpper("$store")},
+			{Key: "double", Value: Expr.Multiply("$amount", 2)},
+		}}}).
+		Unset("items").
+		ReplaceRoot("$summary").
+		Limit(2).
+		Doc().Run(runOrders)
+	require.NoError(t, err)
+	require.EqualValues(t, []bson.D{
+		{{Key: "store", Value: "PARIS"}, {Key: "double", Value: int64(60)}},
+		{{Key: "store", Value: "LYON"}, {Key: "double", Value: int64(20)}},
+	}, out)
+
+	// $facet
+	page := Paginate(AggregateDocBuilder.Match(bson.D{{Key: "store", Value: "paris"}}).Doc(),
+		SortDocBuilder.OrderAscBy("amount").Doc(), 0, 1)
+	out, err = page.Run(runOrders)
+	require.NoError(t, err)
+	require.EqualValues(t, []bson.D{{
+		{Key: "items", Value: bson.A{runOrders[2]}},
+		{Key: "total", Value: int32(2)},
+	}}, out)
+
+	// the input is left alone
+	require.Len(t, runOrders[0], 4)
+}
+
+func TestAggregateRunErrors(t *testing.T) {
+	_, err := AggregateDocBuilder.Lookup("a", "b", "c", "d").Doc().Run(runOrders)
+	require.True(t, errors.Is(err, ErrUnsupported))
+	require.EqualError(t, err, "stage 0 $lookup: hamster: unsupported in memory: stage $lookup")
+
+	_, err = AggregateDocBuilder.Group(bson.D{{Key: "_id", Value: nil}, {Key: "x", Value: bson.D{{Key: "$topN", Value: bson.D{}}}}}).Doc().Run(runOrders)
+	require.True(t, errors.Is(err, ErrUnsupported))
+
+	_, err = AggregateDocBuilder.Match(bson.D{{Key: "$where", Value: "true"}}).Doc().Run(runOrders)
+	require.True(t, errors.Is(err, ErrUnsupported))
+
+	_, err = AggregateDocBuilder.Out("").Doc().Run(runOrders)
+	require.True(t, errors.Is(err, ErrInvalidStage))
+
+	_, err = AggregateDocBuilder.Project(bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 0}}).Doc().Run(runOrders)
+	require.True(t, errors.Is(err, ErrInvalidStage))
+}
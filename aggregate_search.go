@@ -0,0 +1,416 @@
+package hamster
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// SearchOperator is an Atlas Search operator or collector, { <name>: { <fields> } }.
+// A malformed operator keeps its error, reported by the stage that uses it
+type SearchOperator struct {
+	name string
+	body bson.D
+	err  error
+}
+
+// SearchScore modifies the score of an operator, built by Search.Boost,
+// Search.BoostPath, Search.Constant and Search.Function
+type SearchScore struct {
+	d bson.D
+}
+
+// SearchCompound are the clauses of a compound operator, at least one is required
+type SearchCompound struct {
+	Must               []SearchOperator
+	MustNot            []SearchOperator
+	Should             []SearchOperator
+	Filter             []SearchOperator
+	MinimumShouldMatch int
+}
+
+// SearchRange are the bounds of a range operator, numbers or dates
+type SearchRange struct {
+	Gt  interface{}
+	Gte interface{}
+	Lt  interface{}
+	Lte interface{}
+}
+
+// SearchFacet is a facet of a facet collector. Type is "string", "number" or "date",
+// NumBuckets applies to string facets, Boundaries and Default to number and date facets
+type SearchFacet struct {
+	Name       string
+	Type       string
+	Path       string
+	NumBuckets int
+	Boundaries bson.A
+	Default    string
+}
+
+// SearchHighlight asks $search for the passages matching the query
+type SearchHighlight struct {
+	Path              interface{}
+	MaxCharsToExamine int
+	MaxNumPassages    int
+}
+
+// SearchCount asks for the number of matching documents, Type is "lowerBound" or
+// "total" and Threshold applies to "lowerBound"
+type SearchCount struct {
+	Type      string
+	Threshold int
+}
+
+// AggregateSearchOptions are the optional fields of $search and $searchMeta,
+// the index is "default" when Index is empty
+type AggregateSearchOptions struct {
+	Index              string
+	Highlight          *SearchHighlight
+	Count              *SearchCount
+	ReturnStoredSource bool
+}
+
+// searchFactory creates Atlas Search operators and scores
+type searchFactory struct{}
+
+var (
+	// Search creates the operators of the $search and $searchMeta stages, a path
+	// is a field name, a []string of field names or a path document such as
+	// { wildcard: "title.*" }
+	Search = searchFactory{}
+)
+
+// ToD returns the operator as { <name>: { <fields> } }
+func (o SearchOperator) ToD() bson.D {
+	return bson.D{{Key: o.name, Value: o.body}}
+}
+
+func (o SearchOperator) ToM() bson.M {
+	return o.ToD().Map()
+}
+
+// Err returns the problem of the operator or of its nested operators
+func (o SearchOperator) Err() error {
+	return o.err
+}
+
+// With returns the operator with an extra field, such as fuzzy, synonyms or allowAnalyzedField
+func (o SearchOperator) With(key string, value interface{}) SearchOperator {
+	body := make(bson.D, 0, len(o.body)+1)
+	body = append(body, o.body...)
+	o.body = append(body, bson.E{Key: key, Value: bsonValue(value)})
+	return o
+}
+
+// Score returns the operator with its score modified by score
+func (o SearchOperator) Score(score SearchScore) SearchOperator {
+	return o.With("score", score.d)
+}
+
+func searchError(format string, args ...interface{}) SearchOperator {
+	return SearchOperator{err: fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidStage}, args...)...)}
+}
+
+// searchPath checks the path of an operator
+func searchPath(op string, path interface{}) (interface{}, error) {
+	switch p := path.(type) {
+	case string:
+		if p != "" {
+			return p, nil
+		}
+	case []string:
+		if len(p) > 0 {
+			for _, field := range p {
+				if field == "" {
+					return nil, fmt.Errorf("%w: %s path has an empty field", ErrInvalidStage, op)
+				}
+			}
+			return p, nil
+		}
+	case bson.D, bson.M:
+		return p, nil
+	default:
+		return nil, fmt.Errorf("%w: %s path must be a string, a []string or a document, got %T", ErrInvalidStage, op, path)
+	}
+	return nil, fmt.Errorf("%w: %s requires a path", ErrInvalidStage, op)
+}
+
+// queryOperator builds { <op>: { query: <query>, path: <path> } }, query is a string or a []string
+func (searchFactory) queryOperator(op string, path interface{}, query interface{}) SearchOperator {
+	switch q := query.(type) {
+	case string:
+		if q == "" {
+			return searchError("%s requires a query", op)
+		}
+	case []string:
+		if len(q) == 0 {
+			return searchError("%s requires a query", op)
+		}
+	default:
+		return searchError("%s query must be a string or a []string, got %T", op, query)
+	}
+	p, err := searchPath(op, path)
+	if err != nil {
+		return SearchOperator{err: err}
+	}
+	return SearchOperator{name: op, body: bson.D{{Key: "query", Value: query}, {Key: "path", Value: p}}}
+}
+
+// Text matches the analyzed terms of query, { text: { query: <query>, path: <path> } }
+func (s searchFactory) Text(path interface{}, query interface{}) SearchOperator {
+	return s.queryOperator("text", path, query)
+}
+
+// Phrase matches the terms of query in order, { phrase: { query: <query>, path: <path> } }
+func (s searchFactory) Phrase(path interface{}, query interface{}) SearchOperator {
+	return s.queryOperator("phrase", path, query)
+}
+
+// Autocomplete matches terms starting with query, path must be indexed as autocomplete.
+// { autocomplete: { query: <query>, path: <path> } }
+func (s searchFactory) Autocomplete(path string, query interface{}) SearchOperator {
+	return s.queryOperator("autocomplete", path, query)
+}
+
+// Wildcard matches query with * and ? wildcards, { wildcard: { query: <query>, path: <path> } }
+func (s searchFactory) Wildcard(path interface{}, query interface{}) SearchOperator {
+	return s.queryOperator("wildcard", path, query)
+}
+
+// Regex matches the Lucene regular expression query, { regex: { query: <query>, path: <path> } }
+func (s searchFactory) Regex(path interface{}, query interface{}) SearchOperator {
+	return s.queryOperator("regex", path, query)
+}
+
+// Equals matches path equal to value, a bool, an ObjectID, a number, a date or a string.
+// { equals: { path: <path>, value: <value> } }
+func (searchFactory) Equals(path string, value interface{}) SearchOperator {
+	if path == "" {
+		return searchError("equals requires a path")
+	}
+	return SearchOperator{name: "equals", body: bson.D{{Key: "path", Value: path}, {Key: "value", Value: value}}}
+}
+
+// Exists matches the documents where path exists, { exists: { path: <path> } }
+func (searchFactory) Exists(path string) SearchOperator {
+	if path == "" {
+		return searchError("exists requires a path")
+	}
+	return SearchOperator{name: "exists", body: bson.D{{Key: "path", Value: path}}}
+}
+
+// Range matches path within bounds, { range: { path: <path>, gte: <lower>, lt: <upper> } }
+func (searchFactory) Range(path interface{}, bounds SearchRange) SearchOperator {
+	p, err := searchPath("range", path)
+	if err != nil {
+		return SearchOperator{err: err}
+	}
+	if bounds.Gt != nil && bounds.Gte != nil {
+		return searchError("range takes gt or gte, not both")
+	}
+	if bounds.Lt != nil && bounds.Lte != nil {
+		return searchError("range takes lt or lte, not both")
+	}
+	body := bson.D{{Key: "path", Value: p}}
+	for _, b := range []bson.E{
+		{Key: "gt", Value: bounds.Gt}, {Key: "gte", Value: bounds.Gte},
+		{Key: "lt", Value: bounds.Lt}, {Key: "lte", Value: bounds.Lte},
+	} {
+		if b.Value == nil {
+			continue
+		}
+		if _, isNumber := toFloat(b.Value); !isNumber {
+			if _, isDate := toTime(b.Value); !isDate {
+				return searchError("range %s must be a number or a date, got %T", b.Key, b.Value)
+			}
+		}
+		body = append(body, b)
+	}
+	if len(body) == 1 {
+		return searchError("range requires a bound")
+	}
+	return SearchOperator{name: "range", body: body}
+}
+
+// Compound combines operators, { compound: { must: [ ... ], mustNot: [ ... ], should: [ ... ], filter: [ ... ] } }
+func (searchFactory) Compound(clauses SearchCompound) SearchOperator {
+	var body bson.D
+	var err error
+	for _, clause := range []struct {
+		key string
+		ops []SearchOperator
+	}{
+		{"must", clauses.Must}, {"mustNot", clauses.MustNot}, {"should", clauses.Should}, {"filter", clauses.Filter},
+	} {
+		if len(clause.ops) == 0 {
+			continue
+		}
+		arr := make(bson.A, 0, len(clause.ops))
+		for _, op := range clause.ops {
+			if op.name == "" && op.err == nil {
+				return searchError("compound %s has an empty operator", clause.key)
+			}
+			if op.err != nil && err == nil {
+				err = op.err
+			}
+			arr = append(arr, op.ToD())
+		}
+		body = append(body, bson.E{Key: clause.key, Value: arr})
+	}
+	if len(body) == 0 {
+		return searchError("compound requires a clause")
+	}
+	if clauses.MinimumShouldMatch < 0 || clauses.MinimumShouldMatch > len(clauses.Should) {
+		return searchError("compound minimumShouldMatch %d is outside [0, %d]", clauses.MinimumShouldMatch, len(clauses.Should))
+	}
+	if clauses.MinimumShouldMatch > 0 {
+		body = append(body, bson.E{Key: "minimumShouldMatch", Value: clauses.MinimumShouldMatch})
+	}
+	return SearchOperator{name: "compound", body: body, err: err}
+}
+
+// Facet is a collector grouping the results of operator by facets, operator may
+// be nil to facet every document
+// { facet: { operator: <operator>, facets: { <name>: { type: <type>, path: <path>, ... } } } }
+func (searchFactory) Facet(operator *SearchOperator, facets ...SearchFacet) SearchOperator {
+	if len(facets) == 0 {
+		return searchError("facet requires a facet")
+	}
+	var body bson.D
+	var err error
+	if operator != nil {
+		err = operator.err
+		body = append(body, bson.E{Key: "operator", Value: operator.ToD()})
+	}
+	names := map[string]bool{}
+	d := make(bson.D, 0, len(facets))
+	for _, f := range facets {
+		if f.Name == "" || names[f.Name] {
+			return searchError("facet names must be unique and non-empty, got %q", f.Name)
+		}
+		names[f.Name] = true
+		if f.Path == "" {
+			return searchError("facet %q requires a path", f.Name)
+		}
+		facet := bson.D{{Key: "type", Value: f.Type}, {Key: "path", Value: f.Path}}
+		switch f.Type {
+		case "string":
+			if len(f.Boundaries) > 0 || f.Default != "" {
+				return searchError("string facet %q takes no boundaries or default", f.Name)
+			}
+			if f.NumBuckets > 0 {
+				facet = append(facet, bson.E{Key: "numBuckets", Value: f.NumBuckets})
+			}
+		case "number", "date":
+			if len(f.Boundaries) < 2 {
+				return searchError("%s facet %q requires at least 2 boundaries", f.Type, f.Name)
+			}
+			if f.NumBuckets > 0 {
+				return searchError("%s facet %q takes no numBuckets", f.Type, f.Name)
+			}
+			facet = append(facet, bson.E{Key: "boundaries", Value: f.Boundaries})
+			if f.Default != "" {
+				facet = append(facet, bson.E{Key: "default", Value: f.Default})
+			}
+		default:
+			return searchError("facet %q type must be string, number or date, got %q", f.Name, f.Type)
+		}
+		d = append(d, bson.E{Key: f.Name, Value: facet})
+	}
+	body = append(body, bson.E{Key: "facets", Value: d})
+	return SearchOperator{name: "facet", body: body, err: err}
+}
+
+// Boost multiplies the score by value, { boost: { value: <value> } }
+func (searchFactory) Boost(value float64) SearchScore {
+	return SearchScore{d: bson.D{{Key: "boost", Value: bson.D{{Key: "value", Value: value}}}}}
+}
+
+// BoostPath multiplies the score by the numeric field path, or by undefined when it is missing.
+// { boost: { path: <path>, undefined: <undefined> } }
+func (searchFactory) BoostPath(path string, undefined float64) SearchScore {
+	return SearchScore{d: bson.D{{Key: "boost", Value: bson.D{{Key: "path", Value: path}, {Key: "undefined", Value: undefined}}}}}
+}
+
+// Constant replaces the score by value, { constant: { value: <value> } }
+func (searchFactory) Constant(value float64) SearchScore {
+	return SearchScore{d: bson.D{{Key: "constant", Value: bson.D{{Key: "value", Value: value}}}}}
+}
+
+// Function computes the score with a score expression, such as { path: { value: "rating" } }.
+// { function: <expression> }
+func (searchFactory) Function(expression bson.D) SearchScore {
+	return SearchScore{d: bson.D{{Key: "function", Value: expression}}}
+}
+
+// search builds the value of a $search or $searchMeta stage
+func (a aggregateDocBuilder) search(stage string, operator SearchOperator, opt *AggregateSearchOptions) aggregateDocBuilder {
+	if operator.err != nil {
+		return a.fail(operator.err)
+	}
+	if operator.name == "" {
+		return a.failf("%s requires an operator", stage)
+	}
+	if opt == nil {
+		opt = &AggregateSearchOptions{}
+	}
+	var d bson.D
+	if opt.Index != "" {
+		d = append(d, bson.E{Key: "index", Value: opt.Index})
+	}
+	d = append(d, operator.ToD()...)
+	if h := opt.Highlight; h != nil {
+		if stage == "$searchMeta" {
+			return a.failf("$searchMeta takes no highlight")
+		}
+		path, err := searchPath("highlight", h.Path)
+		if err != nil {
+			return a.fail(err)
+		}
+		highlight := bson.D{{Key: "path", Value: path}}
+		if h.MaxCharsToExamine > 0 {
+			highlight = append(highlight, bson.E{Key: "maxCharsToExamine", Value: h.MaxCharsToExamine})
+		}
+		if h.MaxNumPassages > 0 {
+			highlight = append(highlight, bson.E{Key: "maxNumPassages", Value: h.MaxNumPassages})
+		}
+		d = append(d, bson.E{Key: "highlight", Value: highlight})
+	}
+	if c := opt.Count; c != nil {
+		count := bson.D{{Key: "type", Value: c.Type}}
+		switch c.Type {
+		case "lowerBound":
+			if c.Threshold > 0 {
+				count = append(count, bson.E{Key: "threshold", Value: c.Threshold})
+			}
+		case "total":
+			if c.Threshold > 0 {
+				return a.failf("%s count threshold only applies to lowerBound", stage)
+			}
+		default:
+			return a.failf("%s count type must be lowerBound or total, got %q", stage, c.Type)
+		}
+		d = append(d, bson.E{Key: "count", Value: count})
+	}
+	if opt.ReturnStoredSource {
+		if stage == "$searchMeta" {
+			return a.failf("$searchMeta takes no returnStoredSource")
+		}
+		d = append(d, bson.E{Key: "returnStoredSource", Value: true})
+	}
+	return a.stage(stage, d)
+}
+
+// Search adds an Atlas Search stage, which must be the first of the pipeline.
+// { $search: { index: <index>, <operator>: { ... }, highlight: { ... }, count: { ... }, returnStoredSource: true } }
+func (a aggregateDocBuilder) Search(operator SearchOperator, opt *AggregateSearchOptions) aggregateDocBuilder {
+	return a.search("$search", operator, opt)
+}
+
+// SearchMeta adds an Atlas Search metadata stage, such as the counts of a Search.Facet
+// collector, which must be the first of the pipeline.
+// { $searchMeta: { index: <index>, <operator>: { ... }, count: { ... } } }
+func (a aggregateDocBuilder) SearchMeta(operator SearchOperator, opt *AggregateSearchOptions) aggregateDocBuilder {
+	return a.search("$searchMeta", operator, opt)
+}
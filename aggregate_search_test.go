@@ -0,0 +1,164 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSearchOperators(t *testing.T) {
+	cases := map[string]struct {
+		op   SearchOperator
+		want bson.D
+	}{
+		"text": {
+			Search.Text("title", "hamster").With("fuzzy", bson.D{{Key: "maxEdits", Value: 1}}),
+			bson.D{{Key: "text", Value: bson.D{
+				{Key: "query", Value: "hamster"}, {Key: "path", Value: "title"},
+				{Key: "fuzzy", Value: bson.D{{Key: "maxEdits", Value: 1}}},
+			}}},
+		},
+		"phrase": {
+			Search.Phrase([]string{"title", "plot"}, "golden hamster").With("slop", 2),
+			bson.D{{Key: "phrase", Value: bson.D{
+				{Key: "query", Value: "golden hamster"}, {Key: "path", Value: []string{"title", "plot"}}, {Key: "slop", Value: 2},
+			}}},
+		},
+		"autocomplete": {
+			Search.Autocomplete("title", "ham"),
+			bson.D{{Key: "autocomplete", Value: bson.D{{Key: "query", Value: "ham"}, {Key: "path", Value: "title"}}}},
+		},
+		"wildcard": {
+			Search.Wildcard(bson.D{{Key: "wildcard", Value: "*"}}, "ham*").With("allowAnalyzedField", true),
+			bson.D{{Key: "wildcard", Value: bson.D{
+				{Key: "query", Value: "ham*"}, {Key: "path", Value: bson.D{{Key: "wildcard", Value: "*"}}},
+				{Key: "allowAnalyzedField", Value: true},
+			}}},
+		},
+		"regex": {
+			Search.Regex("title", "ham.*"),
+			bson.D{{Key: "regex", Value: bson.D{{Key: "query", Value: "ham.*"}, {Key: "path", Value: "title"}}}},
+		},
+		"equals": {
+			Search.Equals("verified", true),
+			bson.D{{Key: "equals", Value: bson.D{{Key: "path", Value: "verified"}, {Key: "value", Value: true}}}},
+		},
+		"exists": {
+			Search.Exists("plot"),
+			bson.D{{Key: "exists", Value: bson.D{{Key: "path", Value: "plot"}}}},
+		},
+		"range": {
+			Search.Range("year", SearchRange{Gte: 2000, Lt: 2010}),
+			bson.D{{Key: "range", Value: bson.D{{Key: "path", Value: "year"}, {Key: "gte", Value: 2000}, {Key: "lt", Value: 2010}}}},
+		},
+		"scores": {
+			Search.Text("title", "a").Score(Search.Boost(2)),
+			bson.D{{Key: "text", Value: bson.D{
+				{Key: "query", Value: "a"}, {Key: "path", Value: "title"},
+				{Key: "score", Value: bson.D{{Key: "boost", Value: bson.D{{Key: "value", Value: 2.0}}}}},
+			}}},
+		},
+		"compound": {
+			Search.Compound(SearchCompound{
+				Must:               []SearchOperator{Search.Text("title", "hamster")},
+				MustNot:            []SearchOperator{Search.Exists("deleted")},
+				Should:             []SearchOperator{Search.Phrase("plot", "wheel").Score(Search.Constant(3)), Search.Exists("poster")},
+				Filter:             []SearchOperator{Search.Range("year", SearchRange{Gt: 1990})},
+				MinimumShouldMatch: 1,
+			}),
+			bson.D{{Key: "compound", Value: bson.D{
+				{Key: "must", Value: bson.A{bson.D{{Key: "text", Value: bson.D{{Key: "query", Value: "hamster"}, {Key: "path", Value: "title"}}}}}},
+				{Key: "mustNot", Value: bson.A{bson.D{{Key: "exists", Value: bson.D{{Key: "path", Value: "deleted"}}}}}},
+				{Key: "should", Value: bson.A{
+					bson.D{{Key: "phrase", Value: bson.D{
+						{Key: "query", Value: "wheel"}, {Key: "path", Value: "plot"},
+						{Key: "score", Value: bson.D{{Key: "constant", Value: bson.D{{Key: "value", Value: 3.0}}}}},
+					}}},
+					bson.D{{Key: "exists", Value: bson.D{{Key: "path", Value: "poster"}}}},
+				}},
+				{Key: "filter", Value: bson.A{bson.D{{Key: "range", Value: bson.D{{Key: "path", Value: "year"}, {Key: "gt", Value: 1990}}}}}},
+				{Key: "minimumShouldMatch", Value: 1},
+			}}},
+		},
+	}
+	for name, c := range cases {
+		require.NoError(t, c.op.Err(), name)
+		require.EqualValues(t, c.want, c.op.ToD(), name)
+	}
+
+	require.EqualValues(t, bson.D{{Key: "boost", Value: bson.D{{Key: "path", Value: "rating"}, {Key: "undefined", Value: 1.0}}}},
+		Search.BoostPath("rating", 1).d)
+	require.EqualValues(t, bson.D{{Key: "function", Value: bson.D{{Key: "path", Value: "rating"}}}},
+		Search.Function(bson.D{{Key: "path", Value: "rating"}}).d)
+}
+
+func TestAggregateSearch(t *testing.T) {
+	doc := AggregateDocBuilder.
+		Search(Search.Text("title", "hamster"), &AggregateSearchOptions{
+			Index:              "movies",
+			Highlight:          &SearchHighlight{Path: "title", MaxNumPassages: 2},
+			Count:              &SearchCount{Type: "lowerBound", Threshold: 1000},
+			ReturnStoredSource: true,
+		}).
+		Project(ProjectDocBuilder.Include("title").MetaSearchScore("score").MetaSearchHighlights("highlights")).
+		Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.A{
+		bson.D{{Key: "$search", Value: bson.D{
+			{Key: "index", Value: "movies"},
+			{Key: "text", Value: bson.D{{Key: "query", Value: "hamster"}, {Key: "path", Value: "title"}}},
+			{Key: "highlight", Value: bson.D{{Key: "path", Value: "title"}, {Key: "maxNumPassages", Value: 2}}},
+			{Key: "count", Value: bson.D{{Key: "type", Value: "lowerBound"}, {Key: "threshold", Value: 1000}}},
+			{Key: "returnStoredSource", Value: true},
+		}}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "title", Value: int32(1)},
+			{Key: "score", Value: bson.D{{Key: "$meta", Value: "searchScore"}}},
+			{Key: "highlights", Value: bson.D{{Key: "$meta", Value: "searchHighlights"}}},
+		}}},
+	}, doc.ToA())
+
+	text := Search.Text("title", "hamster")
+	meta := AggregateDocBuilder.SearchMeta(Search.Facet(&text,
+		SearchFacet{Name: "genres", Type: "string", Path: "genres", NumBuckets: 5},
+		SearchFacet{Name: "years", Type: "number", Path: "year", Boundaries: bson.A{1990, 2000, 2010}, Default: "other"},
+	), &AggregateSearchOptions{Count: &SearchCount{Type: "total"}}).Doc()
+	require.NoError(t, meta.Err())
+	require.EqualValues(t, bson.A{bson.D{{Key: "$searchMeta", Value: bson.D{
+		{Key: "facet", Value: bson.D{
+			{Key: "operator", Value: bson.D{{Key: "text", Value: bson.D{{Key: "query", Value: "hamster"}, {Key: "path", Value: "title"}}}}},
+			{Key: "facets", Value: bson.D{
+				{Key: "genres", Value: bson.D{{Key: "type", Value: "string"}, {Key: "path", Value: "genres"}, {Key: "numBuckets", Value: 5}}},
+				{Key: "years", Value: bson.D{
+					{Key: "type", Value: "number"}, {Key: "path", Value: "year"},
+					{Key: "boundaries", Value: bson.A{1990, 2000, 2010}}, {Key: "default", Value: "other"},
+				}},
+			}},
+		}},
+		{Key: "count", Value: bson.D{{Key: "type", Value: "total"}}},
+	}}}}, meta.ToA())
+}
+
+func TestAggregateSearchErrors(t *testing.T) {
+	cases := map[string]aggregateDoc{
+		"empty-query":     AggregateDocBuilder.Search(Search.Text("title", ""), nil).Doc(),
+		"bad-path":        AggregateDocBuilder.Search(Search.Phrase(42, "a"), nil).Doc(),
+		"range-bounds":    AggregateDocBuilder.Search(Search.Range("year", SearchRange{Gt: 1, Gte: 2}), nil).Doc(),
+		"range-type":      AggregateDocBuilder.Search(Search.Range("year", SearchRange{Lt: "x"}), nil).Doc(),
+		"range-empty":     AggregateDocBuilder.Search(Search.Range("year", SearchRange{}), nil).Doc(),
+		"compound-empty":  AggregateDocBuilder.Search(Search.Compound(SearchCompound{}), nil).Doc(),
+		"compound-nested": AggregateDocBuilder.Search(Search.Compound(SearchCompound{Must: []SearchOperator{Search.Exists("")}}), nil).Doc(),
+		"should-match":    AggregateDocBuilder.Search(Search.Compound(SearchCompound{Must: []SearchOperator{Search.Exists("a")}, MinimumShouldMatch: 1}), nil).Doc(),
+		"facet-type":      AggregateDocBuilder.SearchMeta(Search.Facet(nil, SearchFacet{Name: "a", Type: "bool", Path: "a"}), nil).Doc(),
+		"facet-bounds":    AggregateDocBuilder.SearchMeta(Search.Facet(nil, SearchFacet{Name: "a", Type: "date", Path: "a"}), nil).Doc(),
+		"meta-highlight":  AggregateDocBuilder.SearchMeta(Search.Exists("a"), &AggregateSearchOptions{Highlight: &SearchHighlight{Path: "a"}}).Doc(),
+		"count-type":      AggregateDocBuilder.Search(Search.Exists("a"), &AggregateSearchOptions{Count: &SearchCount{Type: "all"}}).Doc(),
+		"no-operator":     AggregateDocBuilder.Search(SearchOperator{}, nil).Doc(),
+		"not-first":       AggregateDocBuilder.Limit(1).Search(Search.Exists("a"), nil).Doc(),
+	}
+	for name, doc := range cases {
+		require.True(t, errors.Is(doc.Err(), ErrInvalidStage), name)
+	}
+}
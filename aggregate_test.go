@@ -1,6 +1,7 @@
 package hamster
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -17,3 +18,37 @@ func TestAggregateDocBuilder(t *testing.T) {
 	require.Len(t, doc.ToA(), 3)
 	require.EqualValues(t, bson.D{{Key: "$limit", Value: int64(10)}}, doc.ToA()[2])
 }
+
+func TestAggregateDocBuilderDocuments(t *testing.T) {
+	filter := bson.D{{Key: "year", Value: bson.D{{Key: "$gte", Value: 2000}}}}
+	want := bson.A{
+		bson.D{{Key: "$match", Value: filter}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "rating", Value: SortDesc}}}},
+		bson.D{{Key: "$project", Value: bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 1}}}},
+	}
+
+	fromBuilders := AggregateDocBuilder.
+		Match(FilterDocBuilder.GtE("year", 2000)).
+		Sort(SortDocBuilder.OrderDescBy("rating")).
+		Project(bson.M{"b": 1, "a": 1}).
+		Doc()
+	require.NoError(t, fromBuilders.Err())
+	require.EqualValues(t, want, fromBuilders.ToA())
+
+	fromDocs := AggregateDocBuilder.
+		Match(FilterDocBuilder.GtE("year", 2000).Doc()).
+		Sort(SortDocBuilder.OrderDescBy("rating").Doc()).
+		Project(bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 1}}).
+		Doc()
+	require.EqualValues(t, want, fromDocs.ToA())
+
+	// errors of nested docs are kept
+	bad := AggregateDocBuilder.Match(FilterDocBuilder.Near("loc", Point{Lng: 200})).Doc()
+	require.True(t, errors.Is(bad.Err(), ErrInvalidGeometry))
+
+	require.True(t, errors.Is(AggregateDocBuilder.Sort(bson.M{"a": 1, "b": 1}).Doc().Err(), ErrInvalidStage))
+	require.True(t, errors.Is(AggregateDocBuilder.Match("year").Doc().Err(), ErrInvalidStage))
+
+	pipeline := AggregateDocBuilder.Limit(1).Doc()
+	require.EqualValues(t, bson.D{{Key: "pipeline", Value: pipeline.ToA()}}, pipeline.ToD())
+}
@@ -0,0 +1,24 @@
+package hamster
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// UnionWith adds a $unionWith stage, the short form { $unionWith: <coll> } is
+// used when pipeline has no stages
+// { $unionWith: { coll: <coll>, pipeline: [ <stage>, ... ] } }
+func (a aggregateDocBuilder) UnionWith(coll string, pipeline aggregateDoc) aggregateDocBuilder {
+	if coll == "" {
+		return a.failf("$unionWith requires a collection")
+	}
+	a = a.inherit(pipeline)
+	for _, stage := range pipeline.ToA() {
+		if op := stageName(stage); outputStages[op] {
+			return a.failf("$unionWith pipeline must not contain a %s stage", op)
+		}
+	}
+	if len(pipeline.ToA()) == 0 {
+		return a.stage("$unionWith", coll)
+	}
+	return a.stage("$unionWith", bson.D{{Key: "coll", Value: coll}, {Key: "pipeline", Value: pipeline.ToA()}})
+}
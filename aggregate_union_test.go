@@ -0,0 +1,40 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAggregateUnionWith(t *testing.T) {
+	// { $unionWith: "sales_2018" }
+	doc := AggregateDocBuilder.UnionWith("sales_2018", AggregateDocBuilder.Doc()).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "$unionWith", Value: "sales_2018"}}, doc.ToA()[0])
+
+	// { $unionWith: { coll: "warehouses", pipeline: [ { $project: { state: 1, _id: 0 } } ] } }
+	project := ProjectDocBuilder.Include("state").ExcludeId().Doc().ToD()
+	doc = AggregateDocBuilder.
+		Project(project).
+		UnionWith("warehouses", AggregateDocBuilder.Project(project).Doc()).
+		Doc()
+	require.NoError(t, doc.Err())
+	require.Len(t, doc.ToA(), 2)
+	require.EqualValues(t, bson.D{{Key: "$unionWith", Value: bson.D{
+		{Key: "coll", Value: "warehouses"},
+		{Key: "pipeline", Value: bson.A{bson.D{{Key: "$project", Value: project}}}},
+	}}}, doc.ToA()[1])
+}
+
+func TestAggregateUnionWithValidate(t *testing.T) {
+	doc := AggregateDocBuilder.UnionWith("", AggregateDocBuilder.Doc()).Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+
+	doc = AggregateDocBuilder.UnionWith("archive", AggregateDocBuilder.Out("x").Doc()).Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+
+	doc = AggregateDocBuilder.UnionWith("archive", AggregateDocBuilder.Merge("x", nil).Doc()).Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+}
@@ -0,0 +1,130 @@
+package hamster
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lann/builder"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// firstStages are the stages the server only accepts as the first of a pipeline
+var firstStages = map[string]bool{
+	"$geoNear":      true,
+	"$collStats":    true,
+	"$indexStats":   true,
+	"$documents":    true,
+	"$changeStream": true,
+	"$search":       true,
+	"$searchMeta":   true,
+	"$vectorSearch": true,
+}
+
+// checkFirstStages records an error for every stage of firstStages that is not the first
+func (a aggregateDocBuilder) checkFirstStages() aggregateDocBuilder {
+	doc := builder.GetStruct(a).(aggregateDoc)
+	for i := 1; i < len(doc.Pipeline); i++ {
+		if op := stageName(doc.Pipeline[i]); firstStages[op] {
+			a = a.failf("%s must be the first stage, found at %d of %d", op, i, len(doc.Pipeline))
+		}
+	}
+	return a
+}
+
+// Validate checks the pipeline against the placement rules of the server and
+// returns nil when it is valid. A pipeline with build errors returns its Err.
+// Every stage must be a single key document whose key starts with $, the
+// stages of firstStages must be first, $out and $merge must be last and
+// appear once, and $facet sub-pipelines must not contain forbidden stages
+func (a aggregateDoc) Validate() error {
+	if err := a.Err(); err != nil {
+		return err
+	}
+	problems := validatePipeline(a.Pipeline, "")
+	switch len(problems) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%w: %s", ErrInvalidStage, problems[0])
+	}
+	return fmt.Errorf("%w: %d problems: %s", ErrInvalidStage, len(problems), strings.Join(problems, "; "))
+}
+
+// validatePipeline returns the problems of a pipeline, prefix locates a sub-pipeline
+func validatePipeline(pipeline bson.A, prefix string) []string {
+	var problems []string
+	outputs := 0
+	for i, stage := range pipeline {
+		at := fmt.Sprintf("%sstage %d", prefix, i)
+		op, value, err := splitStage(stage)
+		if err != "" {
+			problems = append(problems, at+": "+err)
+			continue
+		}
+		if firstStages[op] && i != 0 {
+			problems = append(problems, fmt.Sprintf("%s: %s must be the first stage", at, op))
+		}
+		if outputStages[op] {
+			outputs++
+			if outputs > 1 {
+				problems = append(problems, fmt.Sprintf("%s: only one $out or $merge is allowed", at))
+			}
+			if i != len(pipeline)-1 {
+				problems = append(problems, fmt.Sprintf("%s: %s must be the last stage", at, op))
+			}
+		}
+		if op == "$facet" {
+			problems = append(problems, validateFacet(value, at)...)
+		}
+	}
+	return problems
+}
+
+// splitStage returns the operator and the value of a stage, or why it is malformed
+func splitStage(stage interface{}) (string, interface{}, string) {
+	var key string
+	var value interface{}
+	switch s := stage.(type) {
+	case bson.D:
+		if len(s) != 1 {
+			return "", nil, fmt.Sprintf("a stage must have exactly one key, got %d", len(s))
+		}
+		key, value = s[0].Key, s[0].Value
+	case bson.M:
+		if len(s) != 1 {
+			return "", nil, fmt.Sprintf("a stage must have exactly one key, got %d", len(s))
+		}
+		for k, v := range s {
+			key, value = k, v
+		}
+	default:
+		return "", nil, fmt.Sprintf("a stage must be a document, got %T", stage)
+	}
+	if !strings.HasPrefix(key, "$") {
+		return "", nil, fmt.Sprintf("stage key %q must start with $", key)
+	}
+	return key, value, ""
+}
+
+func validateFacet(value interface{}, at string) []string {
+	facets := documentOf(value)
+	if facets == nil {
+		return []string{at + ": $facet must be a document of sub-pipelines"}
+	}
+	var problems []string
+	for _, facet := range facets {
+		sub := arrayOf(facet.Value)
+		if sub == nil {
+			problems = append(problems, fmt.Sprintf("%s: $facet %q must be a pipeline", at, facet.Key))
+			continue
+		}
+		prefix := fmt.Sprintf("%s $facet %q ", at, facet.Key)
+		for i, stage := range sub {
+			if op := stageName(stage); facetForbiddenStages[op] {
+				problems = append(problems, fmt.Sprintf("%sstage %d: %s is not allowed in $facet", prefix, i, op))
+			}
+		}
+		problems = append(problems, validatePipeline(sub, prefix)...)
+	}
+	return problems
+}
@@ -0,0 +1,59 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAggregateValidate(t *testing.T) {
+	valid := AggregateDocBuilder.
+		AddStage(bson.D{{Key: "$search", Value: bson.D{{Key: "text", Value: bson.D{}}}}}).
+		Match(bson.D{{Key: "a", Value: 1}}).
+		Facet("items", AggregateDocBuilder.Limit(10).Doc()).
+		Merge("out", nil).
+		Doc()
+	require.NoError(t, valid.Validate())
+	require.NoError(t, AggregateDocBuilder.Doc().Validate())
+
+	// pipelines decoded from elsewhere skip the builder checks
+	cases := map[string]bson.A{
+		"two-keys":      {bson.D{{Key: "$match", Value: bson.D{}}, {Key: "$limit", Value: 1}}},
+		"no-dollar":     {bson.D{{Key: "match", Value: bson.D{}}}},
+		"empty":         {bson.D{}},
+		"not-document":  {"$match"},
+		"map-two-keys":  {bson.M{"$match": bson.D{}, "$limit": 1}},
+		"geo-near":      {bson.D{{Key: "$limit", Value: 1}}, bson.D{{Key: "$geoNear", Value: bson.D{}}}},
+		"coll-stats":    {bson.D{{Key: "$limit", Value: 1}}, bson.D{{Key: "$collStats", Value: bson.D{}}}},
+		"index-stats":   {bson.D{{Key: "$limit", Value: 1}}, bson.D{{Key: "$indexStats", Value: bson.D{}}}},
+		"documents":     {bson.D{{Key: "$limit", Value: 1}}, bson.D{{Key: "$documents", Value: bson.A{}}}},
+		"change-stream": {bson.D{{Key: "$limit", Value: 1}}, bson.D{{Key: "$changeStream", Value: bson.D{}}}},
+		"search":        {bson.D{{Key: "$limit", Value: 1}}, bson.D{{Key: "$search", Value: bson.D{}}}},
+		"out-not-last":  {bson.D{{Key: "$out", Value: "a"}}, bson.D{{Key: "$limit", Value: 1}}},
+		"two-outputs":   {bson.D{{Key: "$merge", Value: bson.D{}}}, bson.D{{Key: "$out", Value: "a"}}},
+		"facet-out": {bson.D{{Key: "$facet", Value: bson.D{
+			{Key: "a", Value: bson.A{bson.D{{Key: "$out", Value: "a"}}}},
+		}}}},
+		"facet-malformed": {bson.D{{Key: "$facet", Value: bson.D{
+			{Key: "a", Value: bson.A{bson.D{{Key: "limit", Value: 1}}}},
+		}}}},
+		"facet-not-pipeline": {bson.D{{Key: "$facet", Value: bson.D{{Key: "a", Value: 1}}}}},
+	}
+	for name, pipeline := range cases {
+		err := aggregateDoc{Pipeline: pipeline}.Validate()
+		require.True(t, errors.Is(err, ErrInvalidStage), name)
+	}
+
+	// every problem is reported
+	err := aggregateDoc{Pipeline: bson.A{
+		bson.D{{Key: "limit", Value: 1}},
+		bson.D{{Key: "$geoNear", Value: bson.D{}}},
+	}}.Validate()
+	require.EqualError(t, err, `hamster: invalid aggregate stage: 2 problems: stage 0: stage key "limit" must start with $; stage 1: $geoNear must be the first stage`)
+
+	// build errors come first
+	doc := AggregateDocBuilder.Out("").Doc()
+	require.Equal(t, doc.Err(), doc.Validate())
+}
@@ -0,0 +1,137 @@
+package hamster
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// vectorFilterOperators are the query operators a $vectorSearch pre-filter supports
+var vectorFilterOperators = map[string]bool{
+	"$eq":     true,
+	"$ne":     true,
+	"$gt":     true,
+	"$gte":    true,
+	"$lt":     true,
+	"$lte":    true,
+	"$in":     true,
+	"$nin":    true,
+	"$exists": true,
+	"$not":    true,
+}
+
+// VectorSearch adds an approximate nearest neighbor Atlas Vector Search stage, which
+// must be the first of the pipeline. queryVector is a []float32 or a []float64,
+// numCandidates must be at least limit and filter, which may be nil, is a filterDoc,
+// a FilterDocBuilder, a bson.D or a bson.M using the operators of vectorFilterOperators.
+// { $vectorSearch: { index: <index>, path: <path>, queryVector: [ ... ], numCandidates: <n>, limit: <n>, filter: <filter> } }
+func (a aggregateDocBuilder) VectorSearch(index, path string, queryVector interface{}, numCandidates, limit int, filter interface{}) aggregateDocBuilder {
+	if numCandidates < limit {
+		return a.failf("$vectorSearch numCandidates %d must be at least limit %d", numCandidates, limit)
+	}
+	if numCandidates > 10000 {
+		return a.failf("$vectorSearch numCandidates %d is above 10000", numCandidates)
+	}
+	return a.vectorSearch(index, path, queryVector, bson.E{Key: "numCandidates", Value: numCandidates}, limit, filter)
+}
+
+// VectorSearchExact adds an exact nearest neighbor (ENN) Atlas Vector Search stage,
+// which compares queryVector with every document matching filter.
+// { $vectorSearch: { index: <index>, path: <path>, queryVector: [ ... ], exact: true, limit: <n>, filter: <filter> } }
+func (a aggregateDocBuilder) VectorSearchExact(index, path string, queryVector interface{}, limit int, filter interface{}) aggregateDocBuilder {
+	return a.vectorSearch(index, path, queryVector, bson.E{Key: "exact", Value: true}, limit, filter)
+}
+
+func (a aggregateDocBuilder) vectorSearch(index, path string, queryVector interface{}, mode bson.E, limit int, filter interface{}) aggregateDocBuilder {
+	if index == "" || path == "" {
+		return a.failf("$vectorSearch requires an index and a path")
+	}
+	switch v := queryVector.(type) {
+	case []float32:
+		if len(v) == 0 {
+			return a.failf("$vectorSearch requires a queryVector")
+		}
+	case []float64:
+		if len(v) == 0 {
+			return a.failf("$vectorSearch requires a queryVector")
+		}
+	default:
+		return a.failf("$vectorSearch queryVector must be a []float32 or a []float64, got %T", queryVector)
+	}
+	if limit <= 0 {
+		return a.failf("$vectorSearch limit must be positive, got %d", limit)
+	}
+
+	d := bson.D{
+		{Key: "index", Value: index},
+		{Key: "path", Value: path},
+		{Key: "queryVector", Value: queryVector},
+		mode,
+		{Key: "limit", Value: limit},
+	}
+	if filter != nil {
+		f, ok := toDocument(filter)
+		if !ok {
+			return a.failf("$vectorSearch filter must be a document, got %T", filter)
+		}
+		for _, err := range docErrors(filter) {
+			a = a.fail(err)
+		}
+		if problem := vectorFilterProblem(f); problem != "" {
+			return a.failf("$vectorSearch filter %s", problem)
+		}
+		if len(f) > 0 {
+			d = append(d, bson.E{Key: "filter", Value: f})
+		}
+	}
+	return a.stage("$vectorSearch", d)
+}
+
+// vectorFilterProblem returns why filter is not a valid $vectorSearch pre-filter, or ""
+func vectorFilterProblem(filter bson.D) string {
+	for _, e := range filter {
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			filters, ok := filterList(e.Value)
+			if !ok || len(filters) == 0 {
+				return e.Key + " must be a non-empty array of filters"
+			}
+			for _, f := range filters {
+				if problem := vectorFilterProblem(f); problem != "" {
+					return problem
+				}
+			}
+			continue
+		}
+		if len(e.Key) > 0 && e.Key[0] == '$' {
+			return "does not support " + e.Key
+		}
+		if problem := vectorConditionProblem(e.Key, e.Value); problem != "" {
+			return problem
+		}
+	}
+	return ""
+}
+
+// vectorConditionProblem checks the condition on a field, a value or a document of operators
+func vectorConditionProblem(field string, cond interface{}) string {
+	ops, ok := isOperatorDoc(cond)
+	if !ok {
+		if documentOf(cond) != nil || arrayOf(cond) != nil {
+			return "on " + field + " must compare with a scalar"
+		}
+		return ""
+	}
+	for _, op := range ops {
+		if !vectorFilterOperators[op.Key] {
+			return "does not support " + op.Key + " on " + field
+		}
+		if op.Key == "$not" {
+			if _, ok := isOperatorDoc(op.Value); !ok {
+				return "$not on " + field + " needs operators"
+			}
+			if problem := vectorConditionProblem(field, op.Value); problem != "" {
+				return problem
+			}
+		}
+	}
+	return ""
+}
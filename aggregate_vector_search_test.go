@@ -0,0 +1,63 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAggregateVectorSearch(t *testing.T) {
+	vector := []float32{0.1, 0.2, 0.3}
+	filter := FilterDocBuilder.
+		Eq("lang", "en").
+		Or(FilterDocBuilder.GtE("year", 2000), bson.D{{Key: "tags", Value: bson.D{{Key: "$in", Value: bson.A{"go"}}}}})
+
+	doc := AggregateDocBuilder.
+		VectorSearch("embeddings", "plot_embedding", vector, 100, 10, filter).
+		Project(ProjectDocBuilder.Include("title").MetaVectorSearchScore("score")).
+		Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "$vectorSearch", Value: bson.D{
+		{Key: "index", Value: "embeddings"},
+		{Key: "path", Value: "plot_embedding"},
+		{Key: "queryVector", Value: vector},
+		{Key: "numCandidates", Value: 100},
+		{Key: "limit", Value: 10},
+		{Key: "filter", Value: filter.Doc().ToD()},
+	}}}, doc.ToA()[0])
+
+	exact := AggregateDocBuilder.VectorSearchExact("embeddings", "plot_embedding", []float64{1, 0}, 5, nil).Doc()
+	require.NoError(t, exact.Err())
+	require.EqualValues(t, bson.A{bson.D{{Key: "$vectorSearch", Value: bson.D{
+		{Key: "index", Value: "embeddings"},
+		{Key: "path", Value: "plot_embedding"},
+		{Key: "queryVector", Value: []float64{1, 0}},
+		{Key: "exact", Value: true},
+		{Key: "limit", Value: 5},
+	}}}}, exact.ToA())
+}
+
+func TestAggregateVectorSearchErrors(t *testing.T) {
+	vector := []float64{1, 2}
+	cases := map[string]aggregateDoc{
+		"candidates": AggregateDocBuilder.VectorSearch("i", "p", vector, 5, 10, nil).Doc(),
+		"too-many":   AggregateDocBuilder.VectorSearch("i", "p", vector, 10001, 10, nil).Doc(),
+		"limit":      AggregateDocBuilder.VectorSearchExact("i", "p", vector, 0, nil).Doc(),
+		"vector":     AggregateDocBuilder.VectorSearchExact("i", "p", []int{1}, 1, nil).Doc(),
+		"empty":      AggregateDocBuilder.VectorSearchExact("i", "p", []float32{}, 1, nil).Doc(),
+		"index":      AggregateDocBuilder.VectorSearchExact("", "p", vector, 1, nil).Doc(),
+		"regex":      AggregateDocBuilder.VectorSearchExact("i", "p", vector, 1, FilterDocBuilder.Regex("a", "^x", "")).Doc(),
+		"nested":     AggregateDocBuilder.VectorSearchExact("i", "p", vector, 1, FilterDocBuilder.Or(FilterDocBuilder.Size("a", 1))).Doc(),
+		"expr":       AggregateDocBuilder.VectorSearchExact("i", "p", vector, 1, FilterDocBuilder.Expr(true)).Doc(),
+		"document":   AggregateDocBuilder.VectorSearchExact("i", "p", vector, 1, bson.M{"a": bson.D{{Key: "b", Value: 1}}}).Doc(),
+		"not-first":  AggregateDocBuilder.Limit(1).VectorSearchExact("i", "p", vector, 1, nil).Doc(),
+	}
+	for name, doc := range cases {
+		require.True(t, errors.Is(doc.Err(), ErrInvalidStage), name)
+	}
+
+	ok := AggregateDocBuilder.VectorSearchExact("i", "p", vector, 1, bson.M{"a": bson.D{{Key: "$not", Value: bson.D{{Key: "$eq", Value: 1}}}}}).Doc()
+	require.NoError(t, ok.Err())
+}
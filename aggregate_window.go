@@ -0,0 +1,391 @@
+package hamster
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lann/builder"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// timeUnits are the units accepted by window ranges, $densify and the date operators
+var timeUnits = map[string]bool{
+	"year":        true,
+	"quarter":     true,
+	"month":       true,
+	"week":        true,
+	"day":         true,
+	"hour":        true,
+	"minute":      true,
+	"second":      true,
+	"millisecond": true,
+}
+
+// WindowBounds is the window of a $setWindowFields output, the zero value
+// spans the whole partition
+type WindowBounds struct {
+	kind  string
+	lower interface{}
+	upper interface{}
+	unit  string
+}
+
+// windowFactory creates window bounds
+type windowFactory struct{}
+
+var (
+	// Window creates the bounds of $setWindowFields outputs, a bound is a
+	// number, "current" or "unbounded"
+	Window = windowFactory{}
+)
+
+// Documents is a window of documents relative to the current one, { documents: [ <lower>, <upper> ] }
+func (windowFactory) Documents(lower, upper interface{}) WindowBounds {
+	return WindowBounds{kind: "documents", lower: lower, upper: upper}
+}
+
+// Range is a window of sortBy values relative to the current one, { range: [ <lower>, <upper> ] }
+func (windowFactory) Range(lower, upper interface{}) WindowBounds {
+	return WindowBounds{kind: "range", lower: lower, upper: upper}
+}
+
+// TimeRange is a window of dates relative to the current one, { range: [ <lower>, <upper> ], unit: <unit> }
+func (windowFactory) TimeRange(lower, upper interface{}, unit string) WindowBounds {
+	return WindowBounds{kind: "range", lower: lower, upper: upper, unit: unit}
+}
+
+// bound returns the numeric position of a window bound
+func (w WindowBounds) bound(v interface{}, integral bool) (float64, error) {
+	if v == "current" || v == "unbounded" {
+		return 0, nil
+	}
+	f, ok := toFloat(v)
+	if !ok || (integral && f != float64(int64(f))) {
+		return 0, fmt.Errorf("%s window bound %v must be an integer, \"current\" or \"unbounded\"", w.kind, v)
+	}
+	return f, nil
+}
+
+func (w WindowBounds) validate() error {
+	if w.kind == "" {
+		return nil
+	}
+	if w.unit != "" && !timeUnits[w.unit] {
+		return fmt.Errorf("invalid window unit %q", w.unit)
+	}
+	integral := w.kind == "documents" || w.unit != ""
+	lower, err := w.bound(w.lower, integral)
+	if err != nil {
+		return err
+	}
+	upper, err := w.bound(w.upper, integral)
+	if err != nil {
+		return err
+	}
+	if w.lower == "unbounded" || w.upper == "unbounded" {
+		return nil
+	}
+	if lower > upper {
+		return fmt.Errorf("%s window lower bound %v is above upper bound %v", w.kind, w.lower, w.upper)
+	}
+	return nil
+}
+
+func (w WindowBounds) toD() bson.D {
+	d := bson.D{{Key: w.kind, Value: bson.A{w.lower, w.upper}}}
+	if w.unit != "" {
+		d = append(d, bson.E{Key: "unit", Value: w.unit})
+	}
+	return d
+}
+
+// windowDoc is the output document of a $setWindowFields stage
+type windowDoc struct {
+	Fields bson.D
+	// SortedBy lists the outputs that require a sortBy
+	SortedBy []string
+	// SingleSortedBy lists the outputs that require a sortBy on one field
+	SingleSortedBy []string
+	// DateSortedBy lists the outputs that require a date sortBy
+	DateSortedBy []string
+	// NumericSortedBy lists the outputs that require a numeric sortBy
+	NumericSortedBy []string
+	// DateFields lists the sortBy fields the caller declared as dates
+	DateFields []string
+	// Errors collects the problems found while building the document
+	Errors []error
+}
+
+// windowDocBuilder is a builder for windowDoc
+type windowDocBuilder builder.Builder
+
+var (
+	// WindowDocBuilder is a singleton builder for $setWindowFields outputs,
+	// use it with AggregateDocBuilder.SetWindowFields
+	WindowDocBuilder = builder.Register(windowDocBuilder{}, windowDoc{}).(windowDocBuilder)
+)
+
+// Doc returns the windowDoc instance
+func (w windowDocBuilder) Doc() windowDoc {
+	return builder.GetStruct(w).(windowDoc)
+}
+
+// ToD convert windowDoc to a bson.D output document
+func (w windowDoc) ToD() bson.D {
+	return w.Fields
+}
+
+// ToM convert windowDoc to a bson.M output document
+func (w windowDoc) ToM() bson.M {
+	return w.ToD().Map()
+}
+
+// Err returns the first error found while building the document
+func (w windowDoc) Err() error {
+	if len(w.Errors) == 0 {
+		return nil
+	}
+	return w.Errors[0]
+}
+
+func (w windowDocBuilder) failf(format string, args ...interface{}) windowDocBuilder {
+	err := fmt.Errorf("%w: $setWindowFields "+format, append([]interface{}{ErrInvalidStage}, args...)...)
+	return builder.Append(w, "Errors", err).(windowDocBuilder)
+}
+
+// DateField declares sortBy fields holding dates, the sortBy of outputs with a
+// time unit must be declared and the sortBy of numeric range windows must not
+func (w windowDocBuilder) DateField(fields ...string) windowDocBuilder {
+	return builder.Extend(w, "DateFields", fields).(windowDocBuilder)
+}
+
+// requires records a sortBy requirement of an output
+func (w windowDocBuilder) requires(list, field string) windowDocBuilder {
+	return builder.Append(w, list, field).(windowDocBuilder)
+}
+
+// output adds an output field, requirements are the sortBy requirement lists the
+// output is recorded in once added
+func (w windowDocBuilder) output(field, operator string, args interface{}, window WindowBounds, requirements ...string) windowDocBuilder {
+	if field == "" || strings.HasPrefix(field, "$") {
+		return w.failf("invalid output field name %q", field)
+	}
+	for _, e := range w.Doc().Fields {
+		if e.Key == field {
+			return w.failf("duplicate output field %q", field)
+		}
+	}
+	if err := window.validate(); err != nil {
+		return w.failf("output %q: %v", field, err)
+	}
+
+	d := bson.D{{Key: operator, Value: bsonValue(args)}}
+	if window.kind != "" {
+		d = append(d, bson.E{Key: "window", Value: window.toD()})
+	}
+	if window.kind == "range" {
+		w = w.requires("SingleSortedBy", field)
+		if window.unit != "" {
+			w = w.requires("DateSortedBy", field)
+		} else {
+			w = w.requires("NumericSortedBy", field)
+		}
+	}
+	if window.kind == "documents" && (window.lower != "unbounded" || window.upper != "unbounded") {
+		w = w.requires("SortedBy", field)
+	}
+	for _, list := range requirements {
+		w = w.requires(list, field)
+	}
+	return builder.Append(w, "Fields", bson.E{Key: field, Value: d}).(windowDocBuilder)
+}
+
+// Rank adds { <field>: { $rank: {} } }
+func (w windowDocBuilder) Rank(field string) windowDocBuilder {
+	return w.output(field, "$rank", bson.D{}, WindowBounds{}, "SingleSortedBy")
+}
+
+// DenseRank adds { <field>: { $denseRank: {} } }
+func (w windowDocBuilder) DenseRank(field string) windowDocBuilder {
+	return w.output(field, "$denseRank", bson.D{}, WindowBounds{}, "SingleSortedBy")
+}
+
+// DocumentNumber adds { <field>: { $documentNumber: {} } }
+func (w windowDocBuilder) DocumentNumber(field string) windowDocBuilder {
+	return w.output(field, "$documentNumber", bson.D{}, WindowBounds{}, "SortedBy")
+}
+
+// Shift adds { <field>: { $shift: { output: <output>, by: <by>, default: <default> } } },
+// a nil defaultValue is left out
+func (w windowDocBuilder) Shift(field string, output interface{}, by int64, defaultValue interface{}) windowDocBuilder {
+	d := bson.D{{Key: "output", Value: output}, {Key: "by", Value: by}}
+	if defaultValue != nil {
+		d = append(d, bson.E{Key: "default", Value: defaultValue})
+	}
+	return w.output(field, "$shift", d, WindowBounds{}, "SortedBy")
+}
+
+// Derivative adds { <field>: { $derivative: { input: <input>, unit: <unit> }, window: <window> } },
+// a unit requires a date sortBy and no unit a numeric one
+func (w windowDocBuilder) Derivative(field string, input interface{}, unit string, window WindowBounds) windowDocBuilder {
+	return w.rateOfChange(field, "$derivative", input, unit, window)
+}
+
+// Integral adds { <field>: { $integral: { input: <input>, unit: <unit> }, window: <window> } },
+// a unit requires a date sortBy and no unit a numeric one
+func (w windowDocBuilder) Integral(field string, input interface{}, unit string, window WindowBounds) windowDocBuilder {
+	return w.rateOfChange(field, "$integral", input, unit, window)
+}
+
+func (w windowDocBuilder) rateOfChange(field, operator string, input interface{}, unit string, window WindowBounds) windowDocBuilder {
+	d := bson.D{{Key: "input", Value: input}}
+	if unit != "" {
+		if !timeUnits[unit] || unit == "month" || unit == "quarter" || unit == "year" {
+			return w.failf("%s unit %q must be week or shorter", operator, unit)
+		}
+		d = append(d, bson.E{Key: "unit", Value: unit})
+	}
+	if operator == "$derivative" && window.kind == "" {
+		return w.failf("$derivative output %q requires a window", field)
+	}
+	if unit != "" {
+		return w.output(field, operator, d, window, "SingleSortedBy", "DateSortedBy")
+	}
+	return w.output(field, operator, d, window, "SingleSortedBy", "NumericSortedBy")
+}
+
+// ExpMovingAvg adds { <field>: { $expMovingAvg: { input: <input>, N: <n> } } }
+func (w windowDocBuilder) ExpMovingAvg(field string, input interface{}, n int64) windowDocBuilder {
+	if n < 1 {
+		return w.failf("$expMovingAvg N must be positive, got %d", n)
+	}
+	d := bson.D{{Key: "input", Value: input}, {Key: "N", Value: n}}
+	return w.output(field, "$expMovingAvg", d, WindowBounds{}, "SortedBy")
+}
+
+// ExpMovingAvgAlpha adds { <field>: { $expMovingAvg: { input: <input>, alpha: <alpha> } } }
+func (w windowDocBuilder) ExpMovingAvgAlpha(field string, input interface{}, alpha float64) windowDocBuilder {
+	if alpha <= 0 || alpha >= 1 {
+		return w.failf("$expMovingAvg alpha must be between 0 and 1, got %v", alpha)
+	}
+	d := bson.D{{Key: "input", Value: input}, {Key: "alpha", Value: alpha}}
+	return w.output(field, "$expMovingAvg", d, WindowBounds{}, "SortedBy")
+}
+
+// CovariancePop adds { <field>: { $covariancePop: [ <x>, <y> ] }, window: <window> }
+func (w windowDocBuilder) CovariancePop(field string, x, y interface{}, window WindowBounds) windowDocBuilder {
+	return w.output(field, "$covariancePop", bson.A{x, y}, window)
+}
+
+// CovarianceSamp adds { <field>: { $covarianceSamp: [ <x>, <y> ] }, window: <window> }
+func (w windowDocBuilder) CovarianceSamp(field string, x, y interface{}, window WindowBounds) windowDocBuilder {
+	return w.output(field, "$covarianceSamp", bson.A{x, y}, window)
+}
+
+// Sum adds { <field>: { $sum: <expr> }, window: <window> }
+func (w windowDocBuilder) Sum(field string, expr interface{}, window WindowBounds) windowDocBuilder {
+	return w.output(field, "$sum", expr, window)
+}
+
+// Avg adds { <field>: { $avg: <expr> }, window: <window> }
+func (w windowDocBuilder) Avg(field string, expr interface{}, window WindowBounds) windowDocBuilder {
+	return w.output(field, "$avg", expr, window)
+}
+
+// Min adds { <field>: { $min: <expr> }, window: <window> }
+func (w windowDocBuilder) Min(field string, expr interface{}, window WindowBounds) windowDocBuilder {
+	return w.output(field, "$min", expr, window)
+}
+
+// Max adds { <field>: { $max: <expr> }, window: <window> }
+func (w windowDocBuilder) Max(field string, expr interface{}, window WindowBounds) windowDocBuilder {
+	return w.output(field, "$max", expr, window)
+}
+
+// Count adds { <field>: { $count: {} }, window: <window> }
+func (w windowDocBuilder) Count(field string, window WindowBounds) windowDocBuilder {
+	return w.output(field, "$count", bson.D{}, window)
+}
+
+// Push adds { <field>: { $push: <expr> }, window: <window> }
+func (w windowDocBuilder) Push(field string, expr interface{}, window WindowBounds) windowDocBuilder {
+	return w.output(field, "$push", expr, window)
+}
+
+// AddToSet adds { <field>: { $addToSet: <expr> }, window: <window> }
+func (w windowDocBuilder) AddToSet(field string, expr interface{}, window WindowBounds) windowDocBuilder {
+	return w.output(field, "$addToSet", expr, window)
+}
+
+// First adds { <field>: { $first: <expr> }, window: <window> }
+func (w windowDocBuilder) First(field string, expr interface{}, window WindowBounds) windowDocBuilder {
+	return w.output(field, "$first", expr, window)
+}
+
+// Last adds { <field>: { $last: <expr> }, window: <window> }
+func (w windowDocBuilder) Last(field string, expr interface{}, window WindowBounds) windowDocBuilder {
+	return w.output(field, "$last", expr, window)
+}
+
+// StdDevPop adds { <field>: { $stdDevPop: <expr> }, window: <window> }
+func (w windowDocBuilder) StdDevPop(field string, expr interface{}, window WindowBounds) windowDocBuilder {
+	return w.output(field, "$stdDevPop", expr, window)
+}
+
+// StdDevSamp adds { <field>: { $stdDevSamp: <expr> }, window: <window> }
+func (w windowDocBuilder) StdDevSamp(field string, expr interface{}, window WindowBounds) windowDocBuilder {
+	return w.output(field, "$stdDevSamp", expr, window)
+}
+
+// SetWindowFields adds a $setWindowFields stage, a nil partitionBy is left out.
+// Outputs using range windows, $rank, $derivative or $integral need a sortBy on
+// a single field, which must be a date for time units and a number otherwise,
+// so one stage cannot mix both. A date sortBy is declared with WindowDocBuilder.DateField.
+// { $setWindowFields: { partitionBy: <expression>, sortBy: { <field>: <order> }, output: { <field>: { <operator>: <args>, window: <window> }, ... } } }
+func (a aggregateDocBuilder) SetWindowFields(partitionBy interface{}, sortBy sortDoc, output windowDoc) aggregateDocBuilder {
+	for _, err := range output.Errors {
+		a = a.fail(err)
+	}
+	if len(output.Fields) == 0 {
+		return a.failf("$setWindowFields requires at least one output")
+	}
+	if len(sortBy.ToD()) == 0 {
+		if len(output.SortedBy) > 0 {
+			return a.failf("$setWindowFields output %q requires sortBy", output.SortedBy[0])
+		}
+		if len(output.SingleSortedBy) > 0 {
+			return a.failf("$setWindowFields output %q requires sortBy", output.SingleSortedBy[0])
+		}
+	}
+	if len(sortBy.ToD()) > 1 && len(output.SingleSortedBy) > 0 {
+		return a.failf("$setWindowFields output %q requires a sortBy on exactly one field", output.SingleSortedBy[0])
+	}
+	if len(output.DateSortedBy) > 0 && len(output.NumericSortedBy) > 0 {
+		return a.failf("$setWindowFields output %q requires a date sortBy but %q requires a numeric one",
+			output.DateSortedBy[0], output.NumericSortedBy[0])
+	}
+	if sort := sortBy.ToD(); len(sort) == 1 {
+		isDate := false
+		for _, f := range output.DateFields {
+			isDate = isDate || f == sort[0].Key
+		}
+		if len(output.DateSortedBy) > 0 && !isDate {
+			return a.failf("$setWindowFields output %q has a time unit and requires a date sortBy, declare %q with DateField",
+				output.DateSortedBy[0], sort[0].Key)
+		}
+		if len(output.NumericSortedBy) > 0 && isDate {
+			return a.failf("$setWindowFields output %q requires a numeric sortBy but %q is a date",
+				output.NumericSortedBy[0], sort[0].Key)
+		}
+	}
+
+	d := bson.D{}
+	if partitionBy != nil {
+		d = append(d, bson.E{Key: "partitionBy", Value: bsonValue(partitionBy)})
+	}
+	if len(sortBy.ToD()) > 0 {
+		d = append(d, bson.E{Key: "sortBy", Value: sortBy.ToD()})
+	}
+	d = append(d, bson.E{Key: "output", Value: output.ToD()})
+	return a.stage("$setWindowFields", d)
+}
@@ -0,0 +1,130 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAggregateSetWindowFields(t *testing.T) {
+	// { $setWindowFields: { partitionBy: "$state", sortBy: { orderDate: 1 },
+	//   output: { cumulativeQuantity: { $sum: "$quantity", window: { documents: [ "unbounded", "current" ] } },
+	//   weeklyAvg: { $avg: "$quantity", window: { range: [ -1, 0 ], unit: "week" } },
+	//   rank: { $rank: {} }, previous: { $shift: { output: "$quantity", by: -1, default: 0 } } } } }
+	sortBy := SortDocBuilder.OrderAscBy("orderDate").Doc()
+	output := WindowDocBuilder.
+		Sum("cumulativeQuantity", Expr.Field("quantity"), Window.Documents("unbounded", "current")).
+		Avg("weeklyAvg", "$quantity", Window.TimeRange(-1, 0, "week")).
+		Rank("rank").
+		DenseRank("denseRank").
+		DocumentNumber("n").
+		Shift("previous", "$quantity", -1, 0).
+		Derivative("speed", "$miles", "hour", Window.TimeRange(-10, 0, "second")).
+		Integral("distance", "$speed", "hour", Window.Documents(-1, "current")).
+		ExpMovingAvg("ema", "$price", 2).
+		CovariancePop("cov", "$a", "$b", WindowBounds{}).
+		Count("count", Window.Documents("unbounded", "unbounded")).
+		DateField("orderDate").
+		Doc()
+	doc := AggregateDocBuilder.SetWindowFields(Expr.Field("state"), sortBy, output).Doc()
+
+	std := bson.D{{Key: "$setWindowFields", Value: bson.D{
+		{Key: "partitionBy", Value: "$state"},
+		{Key: "sortBy", Value: bson.D{{Key: "orderDate", Value: SortAsc}}},
+		{Key: "output", Value: bson.D{
+			{Key: "cumulativeQuantity", Value: bson.D{
+				{Key: "$sum", Value: "$quantity"},
+				{Key: "window", Value: bson.D{{Key: "documents", Value: bson.A{"unbounded", "current"}}}},
+			}},
+			{Key: "weeklyAvg", Value: bson.D{
+				{Key: "$avg", Value: "$quantity"},
+				{Key: "window", Value: bson.D{{Key: "range", Value: bson.A{-1, 0}}, {Key: "unit", Value: "week"}}},
+			}},
+			{Key: "rank", Value: bson.D{{Key: "$rank", Value: bson.D{}}}},
+			{Key: "denseRank", Value: bson.D{{Key: "$denseRank", Value: bson.D{}}}},
+			{Key: "n", Value: bson.D{{Key: "$documentNumber", Value: bson.D{}}}},
+			{Key: "previous", Value: bson.D{{Key: "$shift", Value: bson.D{
+				{Key: "output", Value: "$quantity"}, {Key: "by", Value: int64(-1)}, {Key: "default", Value: 0},
+			}}}},
+			{Key: "speed", Value: bson.D{
+				{Key: "$derivative", Value: bson.D{{Key: "input", Value: "$miles"}, {Key: "unit", Value: "hour"}}},
+				{Key: "window", Value: bson.D{{Key: "range", Value: bson.A{-10, 0}}, {Key: "unit", Value: "second"}}},
+			}},
+			{Key: "distance", Value: bson.D{
+				{Key: "$integral", Value: bson.D{{Key: "input", Value: "$speed"}, {Key: "unit", Value: "hour"}}},
+				{Key: "window", Value: bson.D{{Key: "documents", Value: bson.A{-1, "current"}}}},
+			}},
+			{Key: "ema", Value: bson.D{{Key: "$expMovingAvg", Value: bson.D{{Key: "input", Value: "$price"}, {Key: "N", Value: int64(2)}}}}},
+			{Key: "cov", Value: bson.D{{Key: "$covariancePop", Value: bson.A{"$a", "$b"}}}},
+			{Key: "count", Value: bson.D{
+				{Key: "$count", Value: bson.D{}},
+				{Key: "window", Value: bson.D{{Key: "documents", Value: bson.A{"unbounded", "unbounded"}}}},
+			}},
+		}},
+	}}}
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, std, doc.ToA()[0])
+
+	// no partitionBy and no sortBy
+	output = WindowDocBuilder.Sum("total", "$quantity", WindowBounds{}).Doc()
+	doc = AggregateDocBuilder.SetWindowFields(nil, SortDocBuilder.Doc(), output).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "$setWindowFields", Value: bson.D{
+		{Key: "output", Value: bson.D{{Key: "total", Value: bson.D{{Key: "$sum", Value: "$quantity"}}}}},
+	}}}, doc.ToA()[0])
+}
+
+func TestAggregateSetWindowFieldsValidate(t *testing.T) {
+	byDate := SortDocBuilder.OrderAscBy("orderDate").Doc()
+	noSort := SortDocBuilder.Doc()
+	twoFields := SortDocBuilder.OrderAscBy("a", "b").Doc()
+
+	cases := map[string]aggregateDoc{
+		"no-output": AggregateDocBuilder.SetWindowFields(nil, byDate, WindowDocBuilder.Doc()).Doc(),
+		"bad-unit": AggregateDocBuilder.SetWindowFields(nil, byDate,
+			WindowDocBuilder.Sum("s", "$q", Window.TimeRange(-1, 0, "fortnight")).Doc()).Doc(),
+		"reversed-bounds": AggregateDocBuilder.SetWindowFields(nil, byDate,
+			WindowDocBuilder.Sum("s", "$q", Window.Documents(1, -1)).Doc()).Doc(),
+		"fractional-documents": AggregateDocBuilder.SetWindowFields(nil, byDate,
+			WindowDocBuilder.Sum("s", "$q", Window.Documents(-1.5, 0)).Doc()).Doc(),
+		"rank-without-sort": AggregateDocBuilder.SetWindowFields(nil, noSort,
+			WindowDocBuilder.Rank("r").Doc()).Doc(),
+		"shift-without-sort": AggregateDocBuilder.SetWindowFields(nil, noSort,
+			WindowDocBuilder.Shift("s", "$q", 1, nil).Doc()).Doc(),
+		"range-with-two-sort-fields": AggregateDocBuilder.SetWindowFields(nil, twoFields,
+			WindowDocBuilder.Sum("s", "$q", Window.Range(-10, 10)).Doc()).Doc(),
+		"time-and-numeric-ranges": AggregateDocBuilder.SetWindowFields(nil, byDate,
+			WindowDocBuilder.
+				Sum("s", "$q", Window.TimeRange(-1, 0, "day")).
+				Sum("t", "$q", Window.Range(-10, 0)).
+				Doc()).Doc(),
+		"derivative-without-window": AggregateDocBuilder.SetWindowFields(nil, byDate,
+			WindowDocBuilder.Derivative("d", "$q", "hour", WindowBounds{}).Doc()).Doc(),
+		"derivative-month": AggregateDocBuilder.SetWindowFields(nil, byDate,
+			WindowDocBuilder.Derivative("d", "$q", "month", Window.Documents(-1, 0)).Doc()).Doc(),
+		"ema-alpha": AggregateDocBuilder.SetWindowFields(nil, byDate,
+			WindowDocBuilder.ExpMovingAvgAlpha("e", "$q", 1.5).Doc()).Doc(),
+		"time-range-undeclared-date": AggregateDocBuilder.SetWindowFields(nil, byDate,
+			WindowDocBuilder.Avg("a", "$q", Window.TimeRange(-1, 0, "day")).Doc()).Doc(),
+		"derivative-undeclared-date": AggregateDocBuilder.SetWindowFields(nil, byDate,
+			WindowDocBuilder.Derivative("d", "$q", "hour", Window.Documents(-1, 0)).Doc()).Doc(),
+		"numeric-range-over-date": AggregateDocBuilder.SetWindowFields(nil, byDate,
+			WindowDocBuilder.Sum("s", "$q", Window.Range(-10, 0)).DateField("orderDate").Doc()).Doc(),
+		"duplicate-output": AggregateDocBuilder.SetWindowFields(nil, byDate,
+			WindowDocBuilder.Rank("r").Rank("r").Doc()).Doc(),
+	}
+	for name, doc := range cases {
+		require.True(t, errors.Is(doc.Err(), ErrInvalidStage), name)
+	}
+
+	// an output that failed adds no sortBy requirement
+	output := WindowDocBuilder.Rank("$r").DocumentNumber("").Derivative("d", "$q", "hour", WindowBounds{}).Doc()
+	require.Len(t, output.Errors, 3)
+	require.Empty(t, output.SingleSortedBy)
+	require.Empty(t, output.SortedBy)
+	require.Empty(t, output.DateSortedBy)
+	doc := AggregateDocBuilder.SetWindowFields(nil, noSort, WindowDocBuilder.Rank("$r").Sum("s", "$q", WindowBounds{}).Doc()).Doc()
+	require.Len(t, doc.Errors, 1)
+}
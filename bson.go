@@ -1,8 +1,133 @@
 package hamster
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
+// Bsoner is implemented by the hamster docs. The stages of AggregateDocBuilder
+// and the logical operators of FilterDocBuilder accept a Bsoner, a hamster
+// builder, a bson.D or a bson.M wherever they take a document
 type Bsoner interface {
 	ToM() primitive.M
 	ToD() primitive.D
 }
+
+// bsonValue converts hamster documents and expressions inside v to their plain bson form
+func bsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case Expression:
+		return t.Value()
+	case aggregateDoc:
+		return t.ToA()
+	case Bsoner:
+		return t.ToD()
+	case bson.D:
+		if t == nil {
+			return t
+		}
+		d := make(bson.D, 0, len(t))
+		for _, e := range t {
+			d = append(d, bson.E{Key: e.Key, Value: bsonValue(e.Value)})
+		}
+		return d
+	case bson.A:
+		if t == nil {
+			return t
+		}
+		arr := make(bson.A, 0, len(t))
+		for _, e := range t {
+			arr = append(arr, bsonValue(e))
+		}
+		return arr
+	case bson.M:
+		if t == nil {
+			return t
+		}
+		m := make(bson.M, len(t))
+		for k, e := range t {
+			m[k] = bsonValue(e)
+		}
+		return m
+	}
+	return v
+}
+
+// built returns the doc of a hamster builder, other values are returned as is
+func built(v interface{}) interface{} {
+	switch b := v.(type) {
+	case filterDocBuilder:
+		return b.Doc()
+	case projectDocBuilder:
+		return b.Doc()
+	case sortDocBuilder:
+		return b.Doc()
+	case groupDocBuilder:
+		return b.Doc()
+	case updateDocBuilder:
+		return b.Doc()
+	case documentBuilder:
+		return b.Doc()
+	case indexDocBuilder:
+		return b.Doc()
+	case aggregateDocBuilder:
+		return b.Doc()
+	case windowDocBuilder:
+		return b.Doc()
+	case fillDocBuilder:
+		return b.Doc()
+	}
+	return v
+}
+
+// toDocument converts a hamster doc or builder, a bson.D or a bson.M to a bson.D,
+// bson.M keys are sorted and nil is an empty document
+func toDocument(v interface{}) (bson.D, bool) {
+	switch t := built(v).(type) {
+	case nil:
+		return bson.D{}, true
+	case bson.D:
+		return t, true
+	case bson.M:
+		return sortedDocument(t), true
+	case Bsoner:
+		return t.ToD(), true
+	}
+	return nil, false
+}
+
+// nestedErrors returns the errors of v and of the hamster docs nested in it
+func nestedErrors(v interface{}) []error {
+	if errs := docErrors(v); len(errs) > 0 {
+		return errs
+	}
+	var errs []error
+	switch t := v.(type) {
+	case bson.D:
+		for _, e := range t {
+			errs = append(errs, nestedErrors(e.Value)...)
+		}
+	case bson.M:
+		for _, k := range sortedDocument(t) {
+			errs = append(errs, nestedErrors(k.Value)...)
+		}
+	case bson.A:
+		for _, e := range t {
+			errs = append(errs, nestedErrors(e)...)
+		}
+	}
+	return errs
+}
+
+// docErrors returns the errors recorded while building a hamster doc or builder
+func docErrors(v interface{}) []error {
+	switch t := built(v).(type) {
+	case aggregateDoc:
+		return t.Errors
+	case interface{ Err() error }:
+		if err := t.Err(); err != nil {
+			return []error{err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package hamster
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ChangeEvent is the part of a change event a ChangeRouter reads, it can be
+// decoded from a change stream with stream.Decode(&event)
+type ChangeEvent struct {
+	OperationType            string                   `bson:"operationType"`
+	DocumentKey              bson.D                   `bson:"documentKey,omitempty"`
+	FullDocument             bson.D                   `bson:"fullDocument,omitempty"`
+	FullDocumentBeforeChange bson.D                   `bson:"fullDocumentBeforeChange,omitempty"`
+	UpdateDescription        *ChangeUpdateDescription `bson:"updateDescription,omitempty"`
+}
+
+// ChangeUpdateDescription is the updateDescription of an update event
+type ChangeUpdateDescription struct {
+	UpdatedFields   bson.D   `bson:"updatedFields,omitempty"`
+	RemovedFields   []string `bson:"removedFields,omitempty"`
+	TruncatedArrays bson.A   `bson:"truncatedArrays,omitempty"`
+}
+
+// ChangeTransition tells how a change moved a document relative to the result
+// set of a subscriber filter
+type ChangeTransition int
+
+const (
+	// TransitionUnknown is used when the event lacks the image needed to tell
+	TransitionUnknown ChangeTransition = iota
+	// TransitionEntered is a document that matches now and did not before
+	TransitionEntered
+	// TransitionStayed is a document that matched before and still matches
+	TransitionStayed
+	// TransitionLeft is a document that matched before and does not anymore
+	TransitionLeft
+)
+
+func (t ChangeTransition) String() string {
+	switch t {
+	case TransitionEntered:
+		return "entered"
+	case TransitionStayed:
+		return "stayed"
+	case TransitionLeft:
+		return "left"
+	}
+	return "unknown"
+}
+
+// ChangeDelivery is a subscriber an event is routed to
+type ChangeDelivery struct {
+	Subscriber string
+	Transition ChangeTransition
+}
+
+type changeSubscriber struct {
+	id     string
+	filter bson.D
+}
+
+// ChangeRouter routes the events of one change stream to the in-process
+// subscribers whose filter matches, filters are evaluated with filterDoc.Matches.
+// It is safe for concurrent use
+type ChangeRouter struct {
+	mu          sync.RWMutex
+	subscribers []changeSubscriber
+}
+
+// NewChangeRouter returns a router without subscribers
+func NewChangeRouter() *ChangeRouter {
+	return &ChangeRouter{}
+}
+
+// Subscribe adds a subscriber, it fails on a duplicate id, on a filter with build
+// errors and on a filter using, in any branch, operators the in-memory evaluator
+// does not support
+func (r *ChangeRouter) Subscribe(id string, filter filterDoc) error {
+	if err := filter.Err(); err != nil {
+		return err
+	}
+	if err := checkFilter(filter.ToD()); err != nil {
+		return fmt.Errorf("subscriber %s: %w", id, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.subscribers {
+		if s.id == id {
+			return fmt.Errorf("%w: subscriber %s already exists", ErrInvalidFilter, id)
+		}
+	}
+	r.subscribers = append(r.subscribers, changeSubscriber{id: id, filter: filter.ToD()})
+	return nil
+}
+
+// Unsubscribe removes a subscriber and reports whether it existed
+func (r *ChangeRouter) Unsubscribe(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, s := range r.subscribers {
+		if s.id == id {
+			r.subscribers = append(r.subscribers[:i:i], r.subscribers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Route returns the subscribers event is for, in subscription order:
+//   - insert: the subscribers whose filter matches fullDocument, which entered
+//   - update and replace: the subscribers whose filter matches the post-image, and
+//     with a pre-image the subscribers it left. Without fullDocument the post-image
+//     is rebuilt from the pre-image and updateDescription
+//   - delete: the subscribers whose filter matched the pre-image, which left
+//
+// A delete without pre-image and the other operation types, like drop or
+// invalidate, go to every subscriber with TransitionUnknown. On an error no
+// subscriber is returned
+func (r *ChangeRouter) Route(event ChangeEvent) ([]ChangeDelivery, error) {
+	r.mu.RLock()
+	subscribers := r.subscribers
+	r.mu.RUnlock()
+
+	before, after := event.FullDocumentBeforeChange, event.FullDocument
+	switch event.OperationType {
+	case "insert":
+		before = nil
+		if after == nil {
+			return nil, fmt.Errorf("%w: insert event without fullDocument", ErrUnsupported)
+		}
+	case "update", "replace":
+		if after == nil {
+			var ok bool
+			if after, ok = postImage(before, event.UpdateDescription); !ok {
+				return nil, fmt.Errorf("%w: %s event without fullDocument nor a pre-image to rebuild it", ErrUnsupported, event.OperationType)
+			}
+		}
+	case "delete":
+		after = nil
+		if before == nil {
+			return everySubscriber(subscribers), nil
+		}
+	default:
+		return everySubscriber(subscribers), nil
+	}
+
+	var deliveries []ChangeDelivery
+	for _, s := range subscribers {
+		transition, routed, err := transitionOf(s.filter, before, after, event.OperationType == "insert")
+		if err != nil {
+			return nil, fmt.Errorf("subscriber %s: %w", s.id, err)
+		}
+		if routed {
+			deliveries = append(deliveries, ChangeDelivery{Subscriber: s.id, Transition: transition})
+		}
+	}
+	return deliveries, nil
+}
+
+// transitionOf compares the images of a document with filter, a nil image is absent
+// and inserted documents did not exist before
+func transitionOf(filter, before, after bson.D, inserted bool) (ChangeTransition, bool, error) {
+	matchedAfter := false
+	if after != nil {
+		ok, err := matchDocument(after, filter)
+		if err != nil {
+			return TransitionUnknown, false, err
+		}
+		matchedAfter = ok
+	}
+	if before == nil {
+		if inserted && matchedAfter {
+			return TransitionEntered, true, nil
+		}
+		return TransitionUnknown, matchedAfter, nil
+	}
+	matchedBefore, err := matchDocument(before, filter)
+	if err != nil {
+		return TransitionUnknown, false, err
+	}
+	switch {
+	case matchedBefore && matchedAfter:
+		return TransitionStayed, true, nil
+	case matchedAfter:
+		return TransitionEntered, true, nil
+	case matchedBefore:
+		return TransitionLeft, true, nil
+	}
+	return TransitionUnknown, false, nil
+}
+
+func everySubscriber(subscribers []changeSubscriber) []ChangeDelivery {
+	deliveries := make([]ChangeDelivery, 0, len(subscribers))
+	for _, s := range subscribers {
+		deliveries = append(deliveries, ChangeDelivery{Subscriber: s.id})
+	}
+	return deliveries
+}
+
+// postImage applies an update description to the pre-image, it gives up on
+// truncated arrays and on paths going through arrays
+func postImage(before bson.D, desc *ChangeUpdateDescription) (bson.D, bool) {
+	if before == nil || desc == nil || len(desc.TruncatedArrays) > 0 {
+		return nil, false
+	}
+	after := before
+	for _, e := range desc.UpdatedFields {
+		path := strings.Split(e.Key, ".")
+		if throughArray(after, path) {
+			return nil, false
+		}
+		after = setPath(after, path, e.Value)
+	}
+	for _, field := range desc.RemovedFields {
+		path := strings.Split(field, ".")
+		if throughArray(after, path) {
+			return nil, false
+		}
+		after = documentOf(removePath(after, path))
+	}
+	return after, true
+}
+
+// throughArray reports whether path goes through an array of d
+func throughArray(d bson.D, path []string) bool {
+	var v interface{} = d
+	for _, key := range path {
+		if arrayOf(v) != nil {
+			return true
+		}
+		doc := documentOf(v)
+		if doc == nil {
+			return false
+		}
+		v = nil
+		for _, e := range doc {
+			if e.Key == key {
+				v = e.Value
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestChangeRouter(t *testing.T) {
+	router := NewChangeRouter()
+	require.NoError(t, router.Subscribe("active", FilterDocBuilder.Eq("status", "active").Doc()))
+	require.NoError(t, router.Subscribe("adults", FilterDocBuilder.GtE("age", 18).Doc()))
+
+	alice := bson.D{{Key: "_id", Value: 1}, {Key: "status", Value: "active"}, {Key: "age", Value: 17}}
+	older := bson.D{{Key: "_id", Value: 1}, {Key: "status", Value: "active"}, {Key: "age", Value: 18}}
+	banned := bson.D{{Key: "_id", Value: 1}, {Key: "status", Value: "banned"}, {Key: "age", Value: 18}}
+
+	cases := map[string]struct {
+		event ChangeEvent
+		want  []ChangeDelivery
+	}{
+		"insert": {
+			ChangeEvent{OperationType: "insert", FullDocument: alice},
+			[]ChangeDelivery{{Subscriber: "active", Transition: TransitionEntered}},
+		},
+		"update": {
+			ChangeEvent{OperationType: "update", FullDocumentBeforeChange: alice, FullDocument: older},
+			[]ChangeDelivery{{Subscriber: "active", Transition: TransitionStayed}, {Subscriber: "adults", Transition: TransitionEntered}},
+		},
+		"update-left": {
+			ChangeEvent{OperationType: "replace", FullDocumentBeforeChange: older, FullDocument: banned},
+			[]ChangeDelivery{{Subscriber: "active", Transition: TransitionLeft}, {Subscriber: "adults", Transition: TransitionStayed}},
+		},
+		"update-no-pre-image": {
+			ChangeEvent{OperationType: "update", FullDocument: banned},
+			[]ChangeDelivery{{Subscriber: "adults", Transition: TransitionUnknown}},
+		},
+		"update-rebuilt": {
+			ChangeEvent{
+				OperationType:            "update",
+				FullDocumentBeforeChange: alice,
+				UpdateDescription: &ChangeUpdateDescription{
+					UpdatedFields: bson.D{{Key: "age", Value: 18}},
+					RemovedFields: []string{"status"},
+				},
+			},
+			[]ChangeDelivery{{Subscriber: "active", Transition: TransitionLeft}, {Subscriber: "adults", Transition: TransitionEntered}},
+		},
+		"delete": {
+			ChangeEvent{OperationType: "delete", FullDocumentBeforeChange: banned},
+			[]ChangeDelivery{{Subscriber: "adults", Transition: TransitionLeft}},
+		},
+		"delete-no-pre-image": {
+			ChangeEvent{OperationType: "delete", DocumentKey: bson.D{{Key: "_id", Value: 1}}},
+			[]ChangeDelivery{{Subscriber: "active"}, {Subscriber: "adults"}},
+		},
+		"drop": {
+			ChangeEvent{OperationType: "drop"},
+			[]ChangeDelivery{{Subscriber: "active"}, {Subscriber: "adults"}},
+		},
+	}
+	for name, c := range cases {
+		got, err := router.Route(c.event)
+		require.NoError(t, err, name)
+		require.Equal(t, c.want, got, name)
+	}
+
+	require.True(t, router.Unsubscribe("active"))
+	require.False(t, router.Unsubscribe("active"))
+	got, err := router.Route(ChangeEvent{OperationType: "insert", FullDocument: older})
+	require.NoError(t, err)
+	require.Equal(t, []ChangeDelivery{{Subscriber: "adults", Transition: TransitionEntered}}, got)
+	require.Equal(t, "entered", TransitionEntered.String())
+}
+
+func TestChangeRouterDecode(t *testing.T) {
+	raw, err := bson.Marshal(bson.D{
+		{Key: "_id", Value: bson.D{{Key: "_data", Value: "token"}}},
+		{Key: "operationType", Value: "update"},
+		{Key: "documentKey", Value: bson.D{{Key: "_id", Value: 1}}},
+		{Key: "fullDocumentBeforeChange", Value: bson.D{{Key: "_id", Value: 1}, {Key: "age", Value: int32(20)}}},
+		{Key: "updateDescription", Value: bson.D{
+			{Key: "updatedFields", Value: bson.D{{Key: "age", Value: int32(10)}}},
+			{Key: "removedFields", Value: bson.A{}},
+		}},
+	})
+	require.NoError(t, err)
+	var event ChangeEvent
+	require.NoError(t, bson.Unmarshal(raw, &event))
+
+	router := NewChangeRouter()
+	require.NoError(t, router.Subscribe("adults", FilterDocBuilder.GtE("age", 18).Doc()))
+	got, err := router.Route(event)
+	require.NoError(t, err)
+	require.Equal(t, []ChangeDelivery{{Subscriber: "adults", Transition: TransitionLeft}}, got)
+}
+
+func TestChangeRouterErrors(t *testing.T) {
+	router := NewChangeRouter()
+	require.NoError(t, router.Subscribe("a", FilterDocBuilder.Eq("a", 1).Doc()))
+	require.True(t, errors.Is(router.Subscribe("a", FilterDocBuilder.Eq("a", 2).Doc()), ErrInvalidFilter))
+	require.True(t, errors.Is(router.Subscribe("b", FilterDocBuilder.Where("true").Doc()), ErrUnsupported))
+	require.True(t, errors.Is(router.Subscribe("c", FilterDocBuilder.Near("loc", Point{Lat: 100}).Doc()), ErrInvalidGeometry))
+
+	events := map[string]ChangeEvent{
+		"insert":    {OperationType: "insert"},
+		"update":    {OperationType: "update", DocumentKey: bson.D{{Key: "_id", Value: 1}}},
+		"truncated": {OperationType: "update", FullDocumentBeforeChange: bson.D{}, UpdateDescription: &ChangeUpdateDescription{TruncatedArrays: bson.A{"x"}}},
+		"array": {OperationType: "update", FullDocumentBeforeChange: bson.D{{Key: "tags", Value: bson.A{"a"}}},
+			UpdateDescription: &ChangeUpdateDescription{UpdatedFields: bson.D{{Key: "tags.0", Value: "b"}}}},
+	}
+	for name, event := range events {
+		_, err := router.Route(event)
+		require.True(t, errors.Is(err, ErrUnsupported), name)
+	}
+}
+
+func TestChangeRouterSubscribeWalksFilter(t *testing.T) {
+	// branches the empty document would never reach are checked as well
+	near := FilterDocBuilder.Near("loc", Point{Lng: 1, Lat: 1})
+	filters := map[string]filterDoc{
+		"and":        FilterDocBuilder.Eq("a", 1).Near("loc", Point{Lng: 1, Lat: 1}).Doc(),
+		"or":         FilterDocBuilder.Or(bson.D{{Key: "a", Value: bson.D{{Key: "$exists", Value: false}}}}, near).Doc(),
+		"elem-match": FilterDocBuilder.ElemMatch("items", bson.D{{Key: "loc", Value: bson.D{{Key: "$geoWithin", Value: bson.D{}}}}}).Doc(),
+		"not":        {Filters: bson.D{{Key: "a", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$bitsAllSet", Value: 1}}}}}}},
+		"expr": FilterDocBuilder.Expr(bson.D{{Key: "$cond", Value: bson.A{
+			true, 1, bson.D{{Key: "$function", Value: bson.D{}}},
+		}}}).Doc(),
+	}
+	for name, filter := range filters {
+		router := NewChangeRouter()
+		require.True(t, errors.Is(router.Subscribe(name, filter), ErrUnsupported), name)
+	}
+	require.True(t, errors.Is(NewChangeRouter().Subscribe("size", FilterDocBuilder.Or(
+		bson.D{{Key: "a", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "b", Value: bson.D{{Key: "$size", Value: "x"}}}},
+	).Doc()), ErrInvalidFilter))
+
+	// variables bound inside an expression are fine
+	mapped := FilterDocBuilder.Expr(bson.D{{Key: "$in", Value: bson.A{true, bson.D{{Key: "$map", Value: bson.D{
+		{Key: "input", Value: "$scores"}, {Key: "as", Value: "s"}, {Key: "in", Value: bson.D{{Key: "$gt", Value: bson.A{"$$s", 5}}}},
+	}}}}}}).Doc()
+	require.NoError(t, NewChangeRouter().Subscribe("mapped", mapped))
+}
+
+func TestChangeRouterRouteError(t *testing.T) {
+	// an error returns no partial deliveries
+	router := NewChangeRouter()
+	require.NoError(t, router.Subscribe("all", FilterDocBuilder.Doc()))
+	require.NoError(t, router.Subscribe("ratio", FilterDocBuilder.Expr(bson.D{{Key: "$gt", Value: bson.A{
+		bson.D{{Key: "$divide", Value: bson.A{1, "$d"}}}, 0,
+	}}}).Doc()))
+	got, err := router.Route(ChangeEvent{OperationType: "insert", FullDocument: bson.D{{Key: "d", Value: 0}}})
+	require.Error(t, err)
+	require.Nil(t, got)
+}
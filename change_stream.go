@@ -0,0 +1,306 @@
+package hamster
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lann/builder"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// changeOperationTypes are the operationType values of change events
+var changeOperationTypes = map[string]bool{
+	"insert":       true,
+	"update":       true,
+	"replace":      true,
+	"delete":       true,
+	"drop":         true,
+	"rename":       true,
+	"dropDatabase": true,
+	"invalidate":   true,
+}
+
+// changeStream is the pipeline and the options of a change stream
+type changeStream struct {
+	// Filters are the conditions of the $match stage, combined with $and
+	Filters    []bson.D
+	Projection bson.D
+	// FullDocument is one of "default", "updateLookup", "whenAvailable", "required"
+	FullDocument string
+	// FullDocumentBeforeChange is one of "off", "whenAvailable", "required"
+	FullDocumentBeforeChange string
+	BatchSize                *int32
+	MaxAwaitTime             *time.Duration
+	ResumeAfter              interface{}
+	StartAfter               interface{}
+	StartAtOperationTime     *primitive.Timestamp
+	// Errors collects the problems found while building the change stream
+	Errors []error
+}
+
+// changeStreamBuilder is a builder for changeStream
+type changeStreamBuilder builder.Builder
+
+var (
+	// ChangeStreamBuilder is a singleton builder for the pipeline and the options of Watch:
+	//
+	//	pipeline, opts, err := ChangeStreamBuilder.OperationType("insert").Doc().Build()
+	//	stream, err := collection.Watch(ctx, pipeline, opts)
+	ChangeStreamBuilder = builder.Register(changeStreamBuilder{}, changeStream{}).(changeStreamBuilder)
+)
+
+// Doc returns the changeStream instance
+func (c changeStreamBuilder) Doc() changeStream {
+	return builder.GetStruct(c).(changeStream)
+}
+
+func (c changeStreamBuilder) fail(err error) changeStreamBuilder {
+	return builder.Append(c, "Errors", err).(changeStreamBuilder)
+}
+
+func (c changeStreamBuilder) failf(format string, args ...interface{}) changeStreamBuilder {
+	return c.fail(fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidStage}, args...)...))
+}
+
+// Match matches change events on their own fields, such as ns.coll or documentKey._id.
+// filter is a filterDoc, a FilterDocBuilder, a bson.D or a bson.M
+func (c changeStreamBuilder) Match(filter interface{}) changeStreamBuilder {
+	d, ok := toDocument(filter)
+	if !ok {
+		return c.fail(fmt.Errorf("%w: change stream filter must be a document, got %T", ErrInvalidFilter, filter))
+	}
+	for _, err := range docErrors(filter) {
+		c = c.fail(err)
+	}
+	if len(d) == 0 {
+		return c
+	}
+	return builder.Append(c, "Filters", d).(changeStreamBuilder)
+}
+
+// prefixed matches events whose field under prefix matches filter
+func (c changeStreamBuilder) prefixed(prefix string, filter interface{}) changeStreamBuilder {
+	d, ok := toDocument(filter)
+	if !ok {
+		return c.fail(fmt.Errorf("%w: change stream filter must be a document, got %T", ErrInvalidFilter, filter))
+	}
+	for _, err := range docErrors(filter) {
+		c = c.fail(err)
+	}
+	d, err := prefixFilter(d, prefix)
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.Match(d)
+}
+
+// MatchFullDocument matches events whose fullDocument matches filter, the paths of
+// filter are prefixed with "fullDocument." so filters on the collection can be reused.
+// It needs FullDocument("updateLookup") or better to match update events
+func (c changeStreamBuilder) MatchFullDocument(filter interface{}) changeStreamBuilder {
+	return c.prefixed("fullDocument.", filter)
+}
+
+// MatchFullDocumentBeforeChange matches events whose pre-image matches filter, the
+// paths of filter are prefixed with "fullDocumentBeforeChange."
+func (c changeStreamBuilder) MatchFullDocumentBeforeChange(filter interface{}) changeStreamBuilder {
+	return c.prefixed("fullDocumentBeforeChange.", filter)
+}
+
+// OperationType matches the events of the given types, such as "insert" or "update"
+func (c changeStreamBuilder) OperationType(types ...string) changeStreamBuilder {
+	if len(types) == 0 {
+		return c.failf("operationType requires a type")
+	}
+	for _, t := range types {
+		if !changeOperationTypes[t] {
+			return c.failf("unknown operationType %q", t)
+		}
+	}
+	if len(types) == 1 {
+		return c.Match(bson.D{{Key: "operationType", Value: types[0]}})
+	}
+	return c.Match(bson.D{{Key: "operationType", Value: bson.D{{Key: "$in", Value: types}}}})
+}
+
+// UpdatedFields matches update events that set any of fields. Fields are top-level
+// names or dotted paths set as a whole, the server reports "a.b" as a single key
+// which a query cannot address
+func (c changeStreamBuilder) UpdatedFields(fields ...string) changeStreamBuilder {
+	if len(fields) == 0 {
+		return c.failf("updatedFields requires a field")
+	}
+	if len(fields) == 1 {
+		return c.Match(bson.D{{Key: "updateDescription.updatedFields." + fields[0], Value: bson.D{{Key: "$exists", Value: true}}}})
+	}
+	or := make([]bson.D, 0, len(fields))
+	for _, f := range fields {
+		or = append(or, bson.D{{Key: "updateDescription.updatedFields." + f, Value: bson.D{{Key: "$exists", Value: true}}}})
+	}
+	return c.Match(bson.D{{Key: "$or", Value: or}})
+}
+
+// RemovedFields matches update events that unset any of fields
+func (c changeStreamBuilder) RemovedFields(fields ...string) changeStreamBuilder {
+	if len(fields) == 0 {
+		return c.failf("removedFields requires a field")
+	}
+	return c.Match(bson.D{{Key: "updateDescription.removedFields", Value: bson.D{{Key: "$in", Value: fields}}}})
+}
+
+// Project reshapes the events, projection is a projectDoc, a ProjectDocBuilder, a bson.D
+// or a bson.M. It must keep _id, the resume token
+func (c changeStreamBuilder) Project(projection interface{}) changeStreamBuilder {
+	d, ok := toDocument(projection)
+	if !ok {
+		return c.failf("change stream projection must be a document, got %T", projection)
+	}
+	for _, e := range d {
+		if e.Key == "_id" && !truthy(e.Value) {
+			return c.failf("change stream projection must keep _id, the resume token")
+		}
+	}
+	return builder.Set(c, "Projection", d).(changeStreamBuilder)
+}
+
+// FullDocument sets the post-image of update events: "default", "updateLookup",
+// "whenAvailable" or "required"
+func (c changeStreamBuilder) FullDocument(mode string) changeStreamBuilder {
+	switch mode {
+	case "default", "updateLookup", "whenAvailable", "required":
+		return builder.Set(c, "FullDocument", mode).(changeStreamBuilder)
+	}
+	return c.failf("unknown fullDocument mode %q", mode)
+}
+
+// FullDocumentBeforeChange sets the pre-image of update, replace and delete events:
+// "off", "whenAvailable" or "required". The collection must record pre-images
+func (c changeStreamBuilder) FullDocumentBeforeChange(mode string) changeStreamBuilder {
+	switch mode {
+	case "off", "whenAvailable", "required":
+		return builder.Set(c, "FullDocumentBeforeChange", mode).(changeStreamBuilder)
+	}
+	return c.failf("unknown fullDocumentBeforeChange mode %q", mode)
+}
+
+// BatchSize sets the number of events per batch
+func (c changeStreamBuilder) BatchSize(size int32) changeStreamBuilder {
+	return builder.Set(c, "BatchSize", &size).(changeStreamBuilder)
+}
+
+// MaxAwaitTime sets how long the server waits for new events
+func (c changeStreamBuilder) MaxAwaitTime(d time.Duration) changeStreamBuilder {
+	return builder.Set(c, "MaxAwaitTime", &d).(changeStreamBuilder)
+}
+
+// ResumeAfter resumes the stream after the event of token
+func (c changeStreamBuilder) ResumeAfter(token interface{}) changeStreamBuilder {
+	return builder.Set(c, "ResumeAfter", token).(changeStreamBuilder)
+}
+
+// StartAfter starts the stream after the event of token, even an invalidate event
+func (c changeStreamBuilder) StartAfter(token interface{}) changeStreamBuilder {
+	return builder.Set(c, "StartAfter", token).(changeStreamBuilder)
+}
+
+// StartAtOperationTime starts the stream at the operation time ts
+func (c changeStreamBuilder) StartAtOperationTime(ts primitive.Timestamp) changeStreamBuilder {
+	return builder.Set(c, "StartAtOperationTime", &ts).(changeStreamBuilder)
+}
+
+// Err returns the first error found while building the change stream
+func (c changeStream) Err() error {
+	if len(c.Errors) == 0 {
+		return nil
+	}
+	return c.Errors[0]
+}
+
+// Filter returns the condition of the $match stage, several filters are combined with $and
+func (c changeStream) Filter() bson.D {
+	switch len(c.Filters) {
+	case 0:
+		return nil
+	case 1:
+		return c.Filters[0]
+	}
+	return bson.D{{Key: "$and", Value: c.Filters}}
+}
+
+// Pipeline returns the stages to pass to Watch
+func (c changeStream) Pipeline() bson.A {
+	pipeline := bson.A{}
+	if filter := c.Filter(); filter != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: filter}})
+	}
+	if len(c.Projection) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: c.Projection}})
+	}
+	return pipeline
+}
+
+// Options returns the options to pass to Watch
+func (c changeStream) Options() *options.ChangeStreamOptions {
+	opt := options.ChangeStream()
+	if c.FullDocument != "" {
+		opt.SetFullDocument(options.FullDocument(c.FullDocument))
+	}
+	if c.FullDocumentBeforeChange != "" {
+		// driver v1.9.0 has no setter for fullDocumentBeforeChange, the custom
+		// pipeline options are added to the $changeStream stage as they are
+		if opt.CustomPipeline == nil {
+			opt.CustomPipeline = bson.M{}
+		}
+		opt.CustomPipeline["fullDocumentBeforeChange"] = c.FullDocumentBeforeChange
+	}
+	opt.BatchSize = c.BatchSize
+	opt.MaxAwaitTime = c.MaxAwaitTime
+	opt.ResumeAfter = c.ResumeAfter
+	opt.StartAfter = c.StartAfter
+	opt.StartAtOperationTime = c.StartAtOperationTime
+	return opt
+}
+
+// Build returns the pipeline and the options to pass to Watch, or the first build error
+func (c changeStream) Build() (bson.A, *options.ChangeStreamOptions, error) {
+	if err := c.Err(); err != nil {
+		return nil, nil, err
+	}
+	if c.ResumeAfter != nil && c.StartAfter != nil {
+		return nil, nil, fmt.Errorf("%w: resumeAfter and startAfter are exclusive", ErrInvalidStage)
+	}
+	return c.Pipeline(), c.Options(), nil
+}
+
+// prefixFilter prefixes the field paths of filter, through $and, $or and $nor
+func prefixFilter(filter bson.D, prefix string) (bson.D, error) {
+	out := make(bson.D, 0, len(filter))
+	for _, e := range filter {
+		switch {
+		case e.Key == "$and" || e.Key == "$or" || e.Key == "$nor":
+			filters, ok := filterList(e.Value)
+			if !ok {
+				return nil, fmt.Errorf("%w: %s must be an array of filters", ErrInvalidFilter, e.Key)
+			}
+			prefixed := make([]bson.D, 0, len(filters))
+			for _, f := range filters {
+				p, err := prefixFilter(f, prefix)
+				if err != nil {
+					return nil, err
+				}
+				prefixed = append(prefixed, p)
+			}
+			out = append(out, bson.E{Key: e.Key, Value: prefixed})
+		case e.Key == "$comment":
+			out = append(out, e)
+		case strings.HasPrefix(e.Key, "$"):
+			return nil, fmt.Errorf("%w: %s paths cannot be prefixed with %s", ErrInvalidFilter, e.Key, prefix)
+		default:
+			out = append(out, bson.E{Key: prefix + e.Key, Value: e.Value})
+		}
+	}
+	return out, nil
+}
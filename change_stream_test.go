@@ -0,0 +1,96 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestChangeStreamBuilder(t *testing.T) {
+	active := FilterDocBuilder.
+		Eq("status", "active").
+		Or(FilterDocBuilder.Gt("age", 18), FilterDocBuilder.Eq("role", "admin"))
+
+	pipeline, opt, err := ChangeStreamBuilder.
+		OperationType("insert", "update").
+		MatchFullDocument(active).
+		UpdatedFields("status", "role").
+		Project(ProjectDocBuilder.Include("operationType", "fullDocument")).
+		FullDocument("updateLookup").
+		FullDocumentBeforeChange("whenAvailable").
+		BatchSize(50).
+		MaxAwaitTime(time.Second).
+		Doc().
+		Build()
+	require.NoError(t, err)
+	require.EqualValues(t, bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "$and", Value: []bson.D{
+			{{Key: "operationType", Value: bson.D{{Key: "$in", Value: []string{"insert", "update"}}}}},
+			{
+				{Key: "fullDocument.status", Value: "active"},
+				{Key: "$or", Value: []bson.D{
+					{{Key: "fullDocument.age", Value: bson.D{{Key: "$gt", Value: 18}}}},
+					{{Key: "fullDocument.role", Value: "admin"}},
+				}},
+			},
+			{{Key: "$or", Value: []bson.D{
+				{{Key: "updateDescription.updatedFields.status", Value: bson.D{{Key: "$exists", Value: true}}}},
+				{{Key: "updateDescription.updatedFields.role", Value: bson.D{{Key: "$exists", Value: true}}}},
+			}}},
+		}}}}},
+		bson.D{{Key: "$project", Value: bson.D{{Key: "operationType", Value: int32(1)}, {Key: "fullDocument", Value: int32(1)}}}},
+	}, pipeline)
+	require.Equal(t, options.UpdateLookup, *opt.FullDocument)
+	require.EqualValues(t, bson.M{"fullDocumentBeforeChange": "whenAvailable"}, opt.CustomPipeline)
+	require.EqualValues(t, 50, *opt.BatchSize)
+	require.Equal(t, time.Second, *opt.MaxAwaitTime)
+
+	ts := primitive.Timestamp{T: 1, I: 2}
+	pipeline, opt, err = ChangeStreamBuilder.
+		OperationType("delete").
+		MatchFullDocumentBeforeChange(bson.M{"tenant": "acme"}).
+		RemovedFields("legacy").
+		StartAtOperationTime(ts).
+		Doc().
+		Build()
+	require.NoError(t, err)
+	require.EqualValues(t, bson.A{bson.D{{Key: "$match", Value: bson.D{{Key: "$and", Value: []bson.D{
+		{{Key: "operationType", Value: "delete"}},
+		{{Key: "fullDocumentBeforeChange.tenant", Value: "acme"}},
+		{{Key: "updateDescription.removedFields", Value: bson.D{{Key: "$in", Value: []string{"legacy"}}}}},
+	}}}}}}, pipeline)
+	require.Equal(t, options.Default, *opt.FullDocument)
+	require.Equal(t, ts, *opt.StartAtOperationTime)
+
+	pipeline, _, err = ChangeStreamBuilder.Doc().Build()
+	require.NoError(t, err)
+	require.Empty(t, pipeline)
+}
+
+func TestChangeStreamErrors(t *testing.T) {
+	cases := map[string]struct {
+		stream changeStream
+		want   error
+	}{
+		"operation":   {ChangeStreamBuilder.OperationType("upsert").Doc(), ErrInvalidStage},
+		"full-doc":    {ChangeStreamBuilder.FullDocument("always").Doc(), ErrInvalidStage},
+		"before":      {ChangeStreamBuilder.FullDocumentBeforeChange("updateLookup").Doc(), ErrInvalidStage},
+		"resume-id":   {ChangeStreamBuilder.Project(bson.D{{Key: "_id", Value: 0}}).Doc(), ErrInvalidStage},
+		"exclusive":   {ChangeStreamBuilder.ResumeAfter(bson.D{}).StartAfter(bson.D{}).Doc(), ErrInvalidStage},
+		"expr":        {ChangeStreamBuilder.MatchFullDocument(FilterDocBuilder.Expr(true)).Doc(), ErrInvalidFilter},
+		"nested":      {ChangeStreamBuilder.MatchFullDocument(FilterDocBuilder.Near("loc", Point{Lat: 100})).Doc(), ErrInvalidGeometry},
+		"not-doc":     {ChangeStreamBuilder.Match(42).Doc(), ErrInvalidFilter},
+		"no-fields":   {ChangeStreamBuilder.UpdatedFields().Doc(), ErrInvalidStage},
+		"no-removed":  {ChangeStreamBuilder.RemovedFields().Doc(), ErrInvalidStage},
+		"no-op-types": {ChangeStreamBuilder.OperationType().Doc(), ErrInvalidStage},
+	}
+	for name, c := range cases {
+		_, _, err := c.stream.Build()
+		require.True(t, errors.Is(err, c.want), name)
+	}
+}
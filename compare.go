@@ -0,0 +1,400 @@
+package hamster
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// typeOrder returns the rank of v in the server's BSON comparison order, a
+// missing field sorts below every value in aggregation expressions
+// https://www.mongodb.com/docs/manual/reference/bson-type-comparison-order/
+func typeOrder(v interface{}) int {
+	switch v.(type) {
+	case missingValue:
+		return 0
+	case primitive.MinKey:
+		return 1
+	case nil, primitive.Null, primitive.Undefined:
+		return 2
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, primitive.Decimal128:
+		return 3
+	case string, primitive.Symbol:
+		return 4
+	case bson.D, bson.M, bson.Raw:
+		return 5
+	case bson.A, []interface{}:
+		return 6
+	case primitive.Binary, []byte:
+		return 7
+	case primitive.ObjectID:
+		return 8
+	case bool:
+		return 9
+	case time.Time, primitive.DateTime:
+		return 10
+	case primitive.Timestamp:
+		return 11
+	case primitive.Regex:
+		return 12
+	case primitive.MaxKey:
+		return 13
+	}
+	if arrayOf(v) != nil {
+		return 6
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice && rv.IsNil() {
+		// the driver encodes a nil slice as null
+		return 2
+	}
+	return 14
+}
+
+// toFloat converts a BSON number to float64
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case primitive.Decimal128:
+		f, err := strconv.ParseFloat(n.String(), 64)
+		if err != nil {
+			return math.NaN(), true
+		}
+		return f, true
+	}
+	return 0, false
+}
+
+// integerOf returns a Go integer as a negative int64 or a non-negative uint64,
+// so integers compare exactly where float64 would round them above 2^53
+func integerOf(v interface{}) (neg int64, pos uint64, negative, ok bool) {
+	switch n := v.(type) {
+	case int:
+		return signed(int64(n))
+	case int8:
+		return signed(int64(n))
+	case int16:
+		return signed(int64(n))
+	case int32:
+		return signed(int64(n))
+	case int64:
+		return signed(n)
+	case uint:
+		return 0, uint64(n), false, true
+	case uint8:
+		return 0, uint64(n), false, true
+	case uint16:
+		return 0, uint64(n), false, true
+	case uint32:
+		return 0, uint64(n), false, true
+	case uint64:
+		return 0, n, false, true
+	}
+	return 0, 0, false, false
+}
+
+func signed(n int64) (int64, uint64, bool, bool) {
+	if n < 0 {
+		return n, 0, true, true
+	}
+	return 0, uint64(n), false, true
+}
+
+// compareIntegers compares two Go integers exactly, ok is false if either is not one
+func compareIntegers(a, b interface{}) (int, bool) {
+	na, pa, negA, okA := integerOf(a)
+	nb, pb, negB, okB := integerOf(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	switch {
+	case negA && negB:
+		return compareInts64(na, nb), true
+	case negA:
+		return -1, true
+	case negB:
+		return 1, true
+	case pa < pb:
+		return -1, true
+	case pa > pb:
+		return 1, true
+	}
+	return 0, true
+}
+
+// compareNumbers compares two BSON numbers, integers are compared exactly with
+// integers and floats, and NaN sorts below every other number
+func compareNumbers(a, b interface{}) int {
+	if c, ok := compareIntegers(a, b); ok {
+		return c
+	}
+	fa, _ := toFloat(a)
+	fb, _ := toFloat(b)
+	switch nanA, nanB := math.IsNaN(fa), math.IsNaN(fb); {
+	case nanA && nanB:
+		return 0
+	case nanA:
+		return -1
+	case nanB:
+		return 1
+	}
+	if _, _, _, ok := integerOf(a); ok {
+		return -compareFloatInteger(fb, a)
+	}
+	if _, _, _, ok := integerOf(b); ok {
+		return compareFloatInteger(fa, b)
+	}
+	switch {
+	case fa < fb:
+		return -1
+	case fa > fb:
+		return 1
+	}
+	return 0
+}
+
+// compareFloatInteger compares f, a number that is not NaN, with the Go integer i
+// without rounding i to a float
+func compareFloatInteger(f float64, i interface{}) int {
+	switch {
+	case f >= 1<<64:
+		return 1
+	case f < -(1 << 63):
+		return -1
+	}
+	whole := math.Trunc(f)
+	var c int
+	if whole < 0 {
+		c, _ = compareIntegers(int64(whole), i)
+	} else {
+		c, _ = compareIntegers(uint64(whole), i)
+	}
+	if c != 0 {
+		return c
+	}
+	switch fraction := f - whole; {
+	case fraction > 0:
+		return 1
+	case fraction < 0:
+		return -1
+	}
+	return 0
+}
+
+func compareInts64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// toTime converts a BSON date to time.Time
+func toTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case primitive.DateTime:
+		return t.Time(), true
+	}
+	return time.Time{}, false
+}
+
+// compareValues compares two BSON values the way the server sorts them,
+// returning -1, 0 or 1
+func compareValues(a, b interface{}) int {
+	oa, ob := typeOrder(a), typeOrder(b)
+	if oa != ob {
+		return compareInts(oa, ob)
+	}
+
+	switch oa {
+	case 3:
+		return compareNumbers(a, b)
+	case 4:
+		return strings.Compare(stringOf(a), stringOf(b))
+	case 5:
+		return compareDocuments(documentOf(a), documentOf(b))
+	case 6:
+		return compareArrays(arrayOf(a), arrayOf(b))
+	case 7:
+		return bytes.Compare(bytesOf(a), bytesOf(b))
+	case 8:
+		ia, ib := a.(primitive.ObjectID), b.(primitive.ObjectID)
+		return bytes.Compare(ia[:], ib[:])
+	case 9:
+		ba, bb := a.(bool), b.(bool)
+		switch {
+		case ba == bb:
+			return 0
+		case !ba:
+			return -1
+		}
+		return 1
+	case 10:
+		ta, _ := toTime(a)
+		tb, _ := toTime(b)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+		return 0
+	case 11:
+		ta, tb := a.(primitive.Timestamp), b.(primitive.Timestamp)
+		return primitive.CompareTimestamp(ta, tb)
+	case 12:
+		ra, rb := a.(primitive.Regex), b.(primitive.Regex)
+		if c := strings.Compare(ra.Pattern, rb.Pattern); c != 0 {
+			return c
+		}
+		return strings.Compare(ra.Options, rb.Options)
+	}
+	return 0
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareDocuments(a, b bson.D) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareInts(typeOrder(a[i].Value), typeOrder(b[i].Value)); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a[i].Key, b[i].Key); c != 0 {
+			return c
+		}
+		if c := compareValues(a[i].Value, b[i].Value); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(a), len(b))
+}
+
+func compareArrays(a, b bson.A) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareValues(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(a), len(b))
+}
+
+func stringOf(v interface{}) string {
+	if s, ok := v.(primitive.Symbol); ok {
+		return string(s)
+	}
+	return v.(string)
+}
+
+func bytesOf(v interface{}) []byte {
+	if b, ok := v.(primitive.Binary); ok {
+		return b.Data
+	}
+	return v.([]byte)
+}
+
+// documentOf returns v as a bson.D, bson.M keys are sorted
+func documentOf(v interface{}) bson.D {
+	switch d := v.(type) {
+	case bson.D:
+		return d
+	case bson.M:
+		return sortedDocument(d)
+	case bson.Raw:
+		var out bson.D
+		_ = bson.Unmarshal(d, &out)
+		return out
+	}
+	return nil
+}
+
+// arrayOf returns v as a bson.A, Go slices such as []string or []bson.D are
+// arrays once stored, except []byte which is binary data
+func arrayOf(v interface{}) bson.A {
+	switch a := v.(type) {
+	case bson.A:
+		return a
+	case []interface{}:
+		return bson.A(a)
+	case nil, []byte, bson.D:
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	if !isGoArray(rv) {
+		return nil
+	}
+	out := make(bson.A, rv.Len())
+	for i := range out {
+		out[i] = rv.Index(i).Interface()
+	}
+	return out
+}
+
+// isGoArray reports whether rv is a slice or an array the driver encodes as a
+// BSON array, byte slices, arrays such as ObjectID and documents are not
+func isGoArray(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Slice:
+		if rv.IsNil() {
+			return false
+		}
+	case reflect.Array:
+	default:
+		return false
+	}
+	elem := rv.Type().Elem()
+	return elem.Kind() != reflect.Uint8 && elem != reflect.TypeOf(bson.E{})
+}
+
+func sortedDocument(m bson.M) bson.D {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	d := make(bson.D, 0, len(keys))
+	for _, k := range keys {
+		d = append(d, bson.E{Key: k, Value: m[k]})
+	}
+	return d
+}
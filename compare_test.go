@@ -0,0 +1,62 @@
+package hamster
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCompareValues(t *testing.T) {
+	now := time.Now().Truncate(time.Millisecond)
+	ordered := []interface{}{
+		primitive.MinKey{},
+		nil,
+		int32(-1), 0.5, int64(2),
+		"a", "b",
+		bson.D{{Key: "a", Value: 1}},
+		bson.A{1, 2},
+		primitive.NewObjectID(),
+		false, true,
+		now, now.Add(time.Second),
+		primitive.MaxKey{},
+	}
+	for i := 1; i < len(ordered); i++ {
+		require.Equal(t, -1, compareValues(ordered[i-1], ordered[i]), "%v < %v", ordered[i-1], ordered[i])
+		require.Equal(t, 1, compareValues(ordered[i], ordered[i-1]), "%v > %v", ordered[i], ordered[i-1])
+	}
+
+	require.Equal(t, 0, compareValues(int32(1), 1.0))
+	require.Equal(t, 0, compareValues(now, primitive.NewDateTimeFromTime(now)))
+	require.Equal(t, 0, compareValues(bson.M{"b": 1, "a": 2}, bson.D{{Key: "a", Value: 2}, {Key: "b", Value: 1}}))
+
+	// Go typed slices are arrays, []byte is binary data
+	require.Equal(t, 6, typeOrder([]string{"a"}))
+	require.Equal(t, 7, typeOrder([]byte("a")))
+	require.Equal(t, 0, compareValues([]int{1, 2}, bson.A{1, 2}))
+	require.EqualValues(t, bson.A{"a", "b"}, arrayOf([]string{"a", "b"}))
+	require.Nil(t, arrayOf(primitive.NewObjectID()))
+
+	// unsigned integers are numbers and integers compare exactly above 2^53
+	require.Equal(t, 3, typeOrder(uint(1)))
+	require.Equal(t, 3, typeOrder(uint64(1)))
+	require.Equal(t, 0, compareValues(uint64(7), int32(7)))
+	require.Equal(t, -1, compareValues(int64(-1), uint64(0)))
+	require.Equal(t, -1, compareValues(int64(1<<53), int64(1<<53+1)))
+	require.Equal(t, 1, compareValues(uint64(math.MaxUint64), int64(math.MaxInt64)))
+
+	// integers compare exactly with floats, NaN sorts below every number
+	require.Equal(t, 1, compareValues(int64(1<<53+1), float64(1<<53)))
+	require.Equal(t, -1, compareValues(float64(1<<53), int64(1<<53+1)))
+	require.Equal(t, 0, compareValues(int64(-3), -3.0))
+	require.Equal(t, -1, compareValues(-3.5, int64(-3)))
+	require.Equal(t, 1, compareValues(2.5, 2))
+	require.Equal(t, 1, compareValues(math.Inf(1), uint64(math.MaxUint64)))
+	require.Equal(t, -1, compareValues(math.Inf(-1), int64(math.MinInt64)))
+	require.Equal(t, -1, compareValues(math.NaN(), math.Inf(-1)))
+	require.Equal(t, -1, compareValues(math.NaN(), int64(math.MinInt64)))
+	require.Equal(t, 0, compareValues(math.NaN(), math.NaN()))
+}
@@ -0,0 +1,159 @@
+package hamster
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lann/builder"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrPathConflict is returned when two dotted paths of a document collide
+var ErrPathConflict = errors.New("hamster: document path conflict")
+
+// document is a BSON document assembled from dotted field paths
+type document struct {
+	Fields []documentField
+}
+
+// documentField is a single Set or Append recorded by the builder
+type documentField struct {
+	Path   string
+	Value  interface{}
+	Append bool
+}
+
+// documentBuilder is a builder for document
+type documentBuilder builder.Builder
+
+var (
+	// DocumentBuilder is a singleton builder for documents to insert.
+	// Dotted paths like "address.city" are expanded into nested documents
+	// in insertion order.
+	DocumentBuilder = builder.Register(documentBuilder{}, document{}).(documentBuilder)
+)
+
+// Doc returns the document instance
+func (d documentBuilder) Doc() document {
+	return builder.GetStruct(d).(document)
+}
+
+// Set sets the value at the given dotted path
+func (d documentBuilder) Set(path string, value interface{}) documentBuilder {
+	return builder.Append(d, "Fields", documentField{Path: path, Value: value}).(documentBuilder)
+}
+
+// Append appends values to the array at the given dotted path, the array is created if absent
+func (d documentBuilder) Append(path string, values ...interface{}) documentBuilder {
+	return builder.Append(d, "Fields", documentField{Path: path, Value: values, Append: true}).(documentBuilder)
+}
+
+// ToD convert document to a nested bson.D, conflicting paths are left out
+func (doc document) ToD() bson.D {
+	d, _ := doc.build()
+	return d
+}
+
+// ToM convert document to a bson.M
+func (doc document) ToM() bson.M {
+	return doc.ToD().Map()
+}
+
+// ToRaw marshals document to bson.Raw
+func (doc document) ToRaw() (bson.Raw, error) {
+	data, err := doc.MarshalBSON()
+	if err != nil {
+		return nil, err
+	}
+	return bson.Raw(data), nil
+}
+
+// Err returns the first path conflict of the document, if any
+func (doc document) Err() error {
+	_, err := doc.build()
+	return err
+}
+
+// MarshalBSON marshals document to BSON
+func (doc document) MarshalBSON() ([]byte, error) {
+	d, err := doc.build()
+	if err != nil {
+		return nil, err
+	}
+	return bson.Marshal(d)
+}
+
+func (doc document) build() (bson.D, error) {
+	var firstErr error
+	d := bson.D{}
+	for _, f := range doc.Fields {
+		segments := strings.Split(f.Path, ".")
+		next, err := setDocumentPath(d, segments, f)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		d = next
+	}
+	return d, firstErr
+}
+
+// setDocumentPath returns a copy of d with field f stored under segments
+func setDocumentPath(d bson.D, segments []string, f documentField) (bson.D, error) {
+	key := segments[0]
+	if key == "" {
+		return nil, fmt.Errorf("%w: empty segment in path %q", ErrPathConflict, f.Path)
+	}
+
+	idx := -1
+	for i, e := range d {
+		if e.Key == key {
+			idx = i
+			break
+		}
+	}
+
+	var value interface{}
+	switch {
+	case len(segments) > 1:
+		sub := bson.D{}
+		if idx >= 0 {
+			existing, ok := d[idx].Value.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("%w: %q is not a document in path %q", ErrPathConflict, key, f.Path)
+			}
+			sub = existing
+		}
+		next, err := setDocumentPath(sub, segments[1:], f)
+		if err != nil {
+			return nil, err
+		}
+		value = next
+	case f.Append:
+		var arr bson.A
+		if idx >= 0 {
+			existing, ok := d[idx].Value.(bson.A)
+			if !ok {
+				return nil, fmt.Errorf("%w: cannot append to non-array path %q", ErrPathConflict, f.Path)
+			}
+			arr = append(arr, existing...)
+		}
+		value = append(arr, f.Value.([]interface{})...)
+	default:
+		if idx >= 0 {
+			return nil, fmt.Errorf("%w: path %q is already set", ErrPathConflict, f.Path)
+		}
+		value = f.Value
+	}
+
+	out := make(bson.D, len(d), len(d)+1)
+	copy(out, d)
+	if idx >= 0 {
+		out[idx] = bson.E{Key: key, Value: value}
+		return out, nil
+	}
+	return append(out, bson.E{Key: key, Value: value}), nil
+}
@@ -0,0 +1,74 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestDocumentBuilder(t *testing.T) {
+	doc := DocumentBuilder.
+		Set("name", "hamster").
+		Set("address.city", "Paris").
+		Set("address.zip", "75001").
+		Append("tags", "x").
+		Set("address.geo.lat", 48.86).
+		Append("tags", "y", "z").
+		Doc()
+
+	std := bson.D{
+		{Key: "name", Value: "hamster"},
+		{Key: "address", Value: bson.D{
+			{Key: "city", Value: "Paris"},
+			{Key: "zip", Value: "75001"},
+			{Key: "geo", Value: bson.D{{Key: "lat", Value: 48.86}}},
+		}},
+		{Key: "tags", Value: bson.A{"x", "y", "z"}},
+	}
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, std, doc.ToD())
+
+	raw, err := doc.ToRaw()
+	require.NoError(t, err)
+	data, err := bson.Marshal(std)
+	require.NoError(t, err)
+	require.EqualValues(t, bson.Raw(data), raw)
+}
+
+func TestDocumentBuilderConflict(t *testing.T) {
+	t.Run("scalar-then-nested", func(t *testing.T) {
+		doc := DocumentBuilder.Set("a", 1).Set("a.b", 2).Doc()
+		require.True(t, errors.Is(doc.Err(), ErrPathConflict))
+		require.EqualValues(t, bson.D{{Key: "a", Value: 1}}, doc.ToD())
+		_, err := doc.ToRaw()
+		require.Error(t, err)
+	})
+
+	t.Run("nested-then-scalar", func(t *testing.T) {
+		doc := DocumentBuilder.Set("a.b", 1).Set("a", 2).Doc()
+		require.True(t, errors.Is(doc.Err(), ErrPathConflict))
+	})
+
+	t.Run("append-to-scalar", func(t *testing.T) {
+		doc := DocumentBuilder.Set("tags", "x").Append("tags", "y").Doc()
+		require.True(t, errors.Is(doc.Err(), ErrPathConflict))
+	})
+
+	t.Run("empty-segment", func(t *testing.T) {
+		doc := DocumentBuilder.Set("a..b", 1).Doc()
+		require.True(t, errors.Is(doc.Err(), ErrPathConflict))
+	})
+
+	t.Run("merge-into-given-document", func(t *testing.T) {
+		given := bson.D{{Key: "city", Value: "Paris"}}
+		doc := DocumentBuilder.Set("address", given).Set("address.zip", "75001").Doc()
+		require.NoError(t, doc.Err())
+		require.EqualValues(t, bson.D{{Key: "address", Value: bson.D{
+			{Key: "city", Value: "Paris"},
+			{Key: "zip", Value: "75001"},
+		}}}, doc.ToD())
+		require.Len(t, given, 1)
+	})
+}
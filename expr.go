@@ -0,0 +1,460 @@
+package hamster
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Expression is an aggregation expression, it renders to plain BSON values
+// and can be used wherever an expression is accepted: ProjectDocBuilder.Field,
+// FilterDocBuilder.Expr, GroupDocBuilder accumulators and aggregate stages.
+type Expression struct {
+	value interface{}
+}
+
+// exprFactory creates aggregation expressions
+type exprFactory struct{}
+
+var (
+	// Expr creates aggregation expressions, arguments may be Expressions,
+	// hamster docs or plain values
+	// https://www.mongodb.com/docs/manual/reference/operator/aggregation/#expression-operators
+	Expr = exprFactory{}
+)
+
+// Value returns the plain BSON value of the expression
+func (e Expression) Value() interface{} {
+	return e.value
+}
+
+// MarshalBSONValue marshals the expression as a BSON value
+func (e Expression) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(e.value)
+}
+
+// exprArgs renders the arguments of an operator
+func exprArgs(args []interface{}) bson.A {
+	arr := make(bson.A, 0, len(args))
+	for _, arg := range args {
+		arr = append(arr, bsonValue(arg))
+	}
+	return arr
+}
+
+func exprOperator(operator string, value interface{}) Expression {
+	return Expression{value: bson.D{{Key: operator, Value: value}}}
+}
+
+// exprNamed renders operators with named arguments, nil arguments are left out
+func exprNamed(operator string, args ...bson.E) Expression {
+	d := make(bson.D, 0, len(args))
+	for _, e := range args {
+		if e.Value == nil {
+			continue
+		}
+		d = append(d, bson.E{Key: e.Key, Value: bsonValue(e.Value)})
+	}
+	return exprOperator(operator, d)
+}
+
+// Field references a field of the current document, "$<path>"
+func (exprFactory) Field(path string) Expression {
+	return Expression{value: "$" + strings.TrimPrefix(path, "$")}
+}
+
+// Var references a variable, "$$<name>"
+func (exprFactory) Var(name string) Expression {
+	return Expression{value: "$$" + strings.TrimPrefix(name, "$$")}
+}
+
+// Root references the root document, "$$ROOT"
+func (exprFactory) Root() Expression {
+	return Expression{value: "$$ROOT"}
+}
+
+// Literal returns a value without parsing it as an expression, { $literal: <value> }
+func (exprFactory) Literal(value interface{}) Expression {
+	return exprOperator("$literal", value)
+}
+
+// Value wraps a plain value or raw expression document
+func (exprFactory) Value(value interface{}) Expression {
+	return Expression{value: bsonValue(value)}
+}
+
+// Let binds variables for use in the in expression, { $let: { vars: <vars>, in: <in> } }
+func (exprFactory) Let(vars bson.D, in interface{}) Expression {
+	return exprNamed("$let", bson.E{Key: "vars", Value: vars}, bson.E{Key: "in", Value: in})
+}
+
+// Arithmetic
+
+// Add adds numbers or a date and numbers, { $add: [ <args>... ] }
+func (exprFactory) Add(args ...interface{}) Expression {
+	return exprOperator("$add", exprArgs(args))
+}
+
+// Subtract { $subtract: [ <a>, <b> ] }
+func (exprFactory) Subtract(a, b interface{}) Expression {
+	return exprOperator("$subtract", exprArgs([]interface{}{a, b}))
+}
+
+// Multiply { $multiply: [ <args>... ] }
+func (exprFactory) Multiply(args ...interface{}) Expression {
+	return exprOperator("$multiply", exprArgs(args))
+}
+
+// Divide { $divide: [ <a>, <b> ] }
+func (exprFactory) Divide(a, b interface{}) Expression {
+	return exprOperator("$divide", exprArgs([]interface{}{a, b}))
+}
+
+// Mod { $mod: [ <a>, <b> ] }
+func (exprFactory) Mod(a, b interface{}) Expression {
+	return exprOperator("$mod", exprArgs([]interface{}{a, b}))
+}
+
+// Pow { $pow: [ <a>, <b> ] }
+func (exprFactory) Pow(a, b interface{}) Expression {
+	return exprOperator("$pow", exprArgs([]interface{}{a, b}))
+}
+
+// Abs { $abs: <x> }
+func (exprFactory) Abs(x interface{}) Expression {
+	return exprOperator("$abs", bsonValue(x))
+}
+
+// Ceil { $ceil: <x> }
+func (exprFactory) Ceil(x interface{}) Expression {
+	return exprOperator("$ceil", bsonValue(x))
+}
+
+// Floor { $floor: <x> }
+func (exprFactory) Floor(x interface{}) Expression {
+	return exprOperator("$floor", bsonValue(x))
+}
+
+// Sqrt { $sqrt: <x> }
+func (exprFactory) Sqrt(x interface{}) Expression {
+	return exprOperator("$sqrt", bsonValue(x))
+}
+
+// Round { $round: [ <x>, <place> ] }
+func (exprFactory) Round(x interface{}, place int32) Expression {
+	return exprOperator("$round", bson.A{bsonValue(x), place})
+}
+
+// Trunc { $trunc: [ <x>, <place> ] }
+func (exprFactory) Trunc(x interface{}, place int32) Expression {
+	return exprOperator("$trunc", bson.A{bsonValue(x), place})
+}
+
+// Comparison
+
+// Eq { $eq: [ <a>, <b> ] }
+func (exprFactory) Eq(a, b interface{}) Expression {
+	return exprOperator("$eq", exprArgs([]interface{}{a, b}))
+}
+
+// Ne { $ne: [ <a>, <b> ] }
+func (exprFactory) Ne(a, b interface{}) Expression {
+	return exprOperator("$ne", exprArgs([]interface{}{a, b}))
+}
+
+// Gt { $gt: [ <a>, <b> ] }
+func (exprFactory) Gt(a, b interface{}) Expression {
+	return exprOperator("$gt", exprArgs([]interface{}{a, b}))
+}
+
+// Gte { $gte: [ <a>, <b> ] }
+func (exprFactory) Gte(a, b interface{}) Expression {
+	return exprOperator("$gte", exprArgs([]interface{}{a, b}))
+}
+
+// Lt { $lt: [ <a>, <b> ] }
+func (exprFactory) Lt(a, b interface{}) Expression {
+	return exprOperator("$lt", exprArgs([]interface{}{a, b}))
+}
+
+// Lte { $lte: [ <a>, <b> ] }
+func (exprFactory) Lte(a, b interface{}) Expression {
+	return exprOperator("$lte", exprArgs([]interface{}{a, b}))
+}
+
+// Cmp { $cmp: [ <a>, <b> ] }
+func (exprFactory) Cmp(a, b interface{}) Expression {
+	return exprOperator("$cmp", exprArgs([]interface{}{a, b}))
+}
+
+// Boolean
+
+// And { $and: [ <args>... ] }
+func (exprFactory) And(args ...interface{}) Expression {
+	return exprOperator("$and", exprArgs(args))
+}
+
+// Or { $or: [ <args>... ] }
+func (exprFactory) Or(args ...interface{}) Expression {
+	return exprOperator("$or", exprArgs(args))
+}
+
+// Not { $not: [ <x> ] }
+func (exprFactory) Not(x interface{}) Expression {
+	return exprOperator("$not", exprArgs([]interface{}{x}))
+}
+
+// String
+
+// Concat { $concat: [ <args>... ] }
+func (exprFactory) Concat(args ...interface{}) Expression {
+	return exprOperator("$concat", exprArgs(args))
+}
+
+// Substr { $substr: [ <s>, <start>, <length> ] }
+func (exprFactory) Substr(s interface{}, start, length int64) Expression {
+	return exprOperator("$substr", bson.A{bsonValue(s), start, length})
+}
+
+// SubstrCP { $substrCP: [ <s>, <start>, <length> ] }
+func (exprFactory) SubstrCP(s interface{}, start, length int64) Expression {
+	return exprOperator("$substrCP", bson.A{bsonValue(s), start, length})
+}
+
+// ToLower { $toLower: <s> }
+func (exprFactory) ToLower(s interface{}) Expression {
+	return exprOperator("$toLower", bsonValue(s))
+}
+
+// ToUpper { $toUpper: <s> }
+func (exprFactory) ToUpper(s interface{}) Expression {
+	return exprOperator("$toUpper", bsonValue(s))
+}
+
+// StrLenCP { $strLenCP: <s> }
+func (exprFactory) StrLenCP(s interface{}) Expression {
+	return exprOperator("$strLenCP", bsonValue(s))
+}
+
+// Split { $split: [ <s>, <delimiter> ] }
+func (exprFactory) Split(s interface{}, delimiter string) Expression {
+	return exprOperator("$split", bson.A{bsonValue(s), delimiter})
+}
+
+// Trim { $trim: { input: <s> } }
+func (exprFactory) Trim(s interface{}) Expression {
+	return exprNamed("$trim", bson.E{Key: "input", Value: s})
+}
+
+// RegexMatch { $regexMatch: { input: <input>, regex: <regex>, options: <options> } }
+func (exprFactory) RegexMatch(input interface{}, regex string, options string) Expression {
+	args := []bson.E{{Key: "input", Value: input}, {Key: "regex", Value: regex}}
+	if options != "" {
+		args = append(args, bson.E{Key: "options", Value: options})
+	}
+	return exprNamed("$regexMatch", args...)
+}
+
+// Date
+
+// ExprDateOptions are the optional arguments of the date operators.
+// DateToString reads Timezone and OnNull, DateTrunc reads BinSize, Timezone
+// and StartOfWeek, DateDiff reads Timezone and StartOfWeek.
+type ExprDateOptions struct {
+	Timezone    *string
+	StartOfWeek *string
+	BinSize     *int64
+	OnNull      interface{}
+}
+
+// DateToString { $dateToString: { date: <date>, format: <format>, timezone: <tz>, onNull: <onNull> } }
+func (exprFactory) DateToString(date interface{}, format string, opt *ExprDateOptions) Expression {
+	args := []bson.E{{Key: "date", Value: date}}
+	if format != "" {
+		args = append(args, bson.E{Key: "format", Value: format})
+	}
+	if opt != nil {
+		if opt.Timezone != nil {
+			args = append(args, bson.E{Key: "timezone", Value: *opt.Timezone})
+		}
+		args = append(args, bson.E{Key: "onNull", Value: opt.OnNull})
+	}
+	return exprNamed("$dateToString", args...)
+}
+
+// DateTrunc { $dateTrunc: { date: <date>, unit: <unit>, binSize: <n>, timezone: <tz>, startOfWeek: <day> } }
+func (exprFactory) DateTrunc(date interface{}, unit string, opt *ExprDateOptions) Expression {
+	args := []bson.E{{Key: "date", Value: date}, {Key: "unit", Value: unit}}
+	if opt != nil {
+		if opt.BinSize != nil {
+			args = append(args, bson.E{Key: "binSize", Value: *opt.BinSize})
+		}
+		args = append(args, exprWeekOptions(opt)...)
+	}
+	return exprNamed("$dateTrunc", args...)
+}
+
+// DateDiff { $dateDiff: { startDate: <start>, endDate: <end>, unit: <unit>, timezone: <tz>, startOfWeek: <day> } }
+func (exprFactory) DateDiff(start, end interface{}, unit string, opt *ExprDateOptions) Expression {
+	args := []bson.E{{Key: "startDate", Value: start}, {Key: "endDate", Value: end}, {Key: "unit", Value: unit}}
+	if opt != nil {
+		args = append(args, exprWeekOptions(opt)...)
+	}
+	return exprNamed("$dateDiff", args...)
+}
+
+func exprWeekOptions(opt *ExprDateOptions) []bson.E {
+	var args []bson.E
+	if opt.Timezone != nil {
+		args = append(args, bson.E{Key: "timezone", Value: *opt.Timezone})
+	}
+	if opt.StartOfWeek != nil {
+		args = append(args, bson.E{Key: "startOfWeek", Value: *opt.StartOfWeek})
+	}
+	return args
+}
+
+// Array
+
+// Map { $map: { input: <input>, as: <as>, in: <in> } }
+func (exprFactory) Map(input interface{}, as string, in interface{}) Expression {
+	args := []bson.E{{Key: "input", Value: input}}
+	if as != "" {
+		args = append(args, bson.E{Key: "as", Value: as})
+	}
+	return exprNamed("$map", append(args, bson.E{Key: "in", Value: in})...)
+}
+
+// Filter { $filter: { input: <input>, as: <as>, cond: <cond> } }
+func (exprFactory) Filter(input interface{}, as string, cond interface{}) Expression {
+	args := []bson.E{{Key: "input", Value: input}}
+	if as != "" {
+		args = append(args, bson.E{Key: "as", Value: as})
+	}
+	return exprNamed("$filter", append(args, bson.E{Key: "cond", Value: cond})...)
+}
+
+// Reduce { $reduce: { input: <input>, initialValue: <initial>, in: <in> } },
+// in refers to $$value and $$this
+func (exprFactory) Reduce(input, initialValue, in interface{}) Expression {
+	return exprOperator("$reduce", bson.D{
+		{Key: "input", Value: bsonValue(input)},
+		{Key: "initialValue", Value: bsonValue(initialValue)},
+		{Key: "in", Value: bsonValue(in)},
+	})
+}
+
+// ArrayElemAt { $arrayElemAt: [ <array>, <idx> ] }
+func (exprFactory) ArrayElemAt(array interface{}, idx int64) Expression {
+	return exprOperator("$arrayElemAt", bson.A{bsonValue(array), idx})
+}
+
+// Size { $size: <array> }
+func (exprFactory) Size(array interface{}) Expression {
+	return exprOperator("$size", bsonValue(array))
+}
+
+// In { $in: [ <x>, <array> ] }
+func (exprFactory) In(x, array interface{}) Expression {
+	return exprOperator("$in", exprArgs([]interface{}{x, array}))
+}
+
+// ConcatArrays { $concatArrays: [ <arrays>... ] }
+func (exprFactory) ConcatArrays(arrays ...interface{}) Expression {
+	return exprOperator("$concatArrays", exprArgs(arrays))
+}
+
+// IsArray { $isArray: [ <x> ] }
+func (exprFactory) IsArray(x interface{}) Expression {
+	return exprOperator("$isArray", exprArgs([]interface{}{x}))
+}
+
+// Conditional
+
+// Cond { $cond: { if: <if>, then: <then>, else: <else> } }
+func (exprFactory) Cond(ifExpr, thenExpr, elseExpr interface{}) Expression {
+	return exprOperator("$cond", bson.D{
+		{Key: "if", Value: bsonValue(ifExpr)},
+		{Key: "then", Value: bsonValue(thenExpr)},
+		{Key: "else", Value: bsonValue(elseExpr)},
+	})
+}
+
+// ExprCase is a branch of a $switch expression
+type ExprCase struct {
+	Case interface{}
+	Then interface{}
+}
+
+// Switch { $switch: { branches: [ { case: <case>, then: <then> }... ], default: <default> } },
+// a nil defaultExpr is left out
+func (exprFactory) Switch(branches []ExprCase, defaultExpr interface{}) Expression {
+	arr := make(bson.A, 0, len(branches))
+	for _, b := range branches {
+		arr = append(arr, bson.D{{Key: "case", Value: bsonValue(b.Case)}, {Key: "then", Value: bsonValue(b.Then)}})
+	}
+	return exprNamed("$switch", bson.E{Key: "branches", Value: arr}, bson.E{Key: "default", Value: defaultExpr})
+}
+
+// IfNull { $ifNull: [ <args>... ] }, the last argument is the replacement
+func (exprFactory) IfNull(args ...interface{}) Expression {
+	return exprOperator("$ifNull", exprArgs(args))
+}
+
+// Type conversion
+
+// Convert { $convert: { input: <input>, to: <to>, onError: <onError>, onNull: <onNull> } },
+// nil onError and onNull are left out
+func (exprFactory) Convert(input interface{}, to string, onError, onNull interface{}) Expression {
+	return exprNamed("$convert",
+		bson.E{Key: "input", Value: input},
+		bson.E{Key: "to", Value: to},
+		bson.E{Key: "onError", Value: onError},
+		bson.E{Key: "onNull", Value: onNull})
+}
+
+// Type { $type: <x> }
+func (exprFactory) Type(x interface{}) Expression {
+	return exprOperator("$type", bsonValue(x))
+}
+
+// ToInt { $toInt: <x> }
+func (exprFactory) ToInt(x interface{}) Expression {
+	return exprOperator("$toInt", bsonValue(x))
+}
+
+// ToLong { $toLong: <x> }
+func (exprFactory) ToLong(x interface{}) Expression {
+	return exprOperator("$toLong", bsonValue(x))
+}
+
+// ToDouble { $toDouble: <x> }
+func (exprFactory) ToDouble(x interface{}) Expression {
+	return exprOperator("$toDouble", bsonValue(x))
+}
+
+// ToDecimal { $toDecimal: <x> }
+func (exprFactory) ToDecimal(x interface{}) Expression {
+	return exprOperator("$toDecimal", bsonValue(x))
+}
+
+// ToString { $toString: <x> }
+func (exprFactory) ToString(x interface{}) Expression {
+	return exprOperator("$toString", bsonValue(x))
+}
+
+// ToBool { $toBool: <x> }
+func (exprFactory) ToBool(x interface{}) Expression {
+	return exprOperator("$toBool", bsonValue(x))
+}
+
+// ToDate { $toDate: <x> }
+func (exprFactory) ToDate(x interface{}) Expression {
+	return exprOperator("$toDate", bsonValue(x))
+}
+
+// ToObjectId { $toObjectId: <x> }
+func (exprFactory) ToObjectId(x interface{}) Expression {
+	return exprOperator("$toObjectId", bsonValue(x))
+}
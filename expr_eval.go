@@ -0,0 +1,753 @@
+package hamster
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// missingValue is the result of a field path that does not exist,
+// object expressions and projections leave such fields out
+type missingValue struct{}
+
+var missing = missingValue{}
+
+// evalContext evaluates aggregation expressions against a document
+type evalContext struct {
+	root bson.D
+	vars map[string]interface{}
+}
+
+// with returns a context where name is bound to value
+func (c evalContext) with(name string, value interface{}) evalContext {
+	vars := make(map[string]interface{}, len(c.vars)+1)
+	for k, v := range c.vars {
+		vars[k] = v
+	}
+	vars[name] = value
+	return evalContext{root: c.root, vars: vars}
+}
+
+// truthy follows the server's boolean conversion:
+// false, null, missing and zero are false, anything else is true
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil, missingValue, primitive.Null, primitive.Undefined:
+		return false
+	case bool:
+		return t
+	}
+	if f, ok := toFloat(v); ok {
+		return f != 0
+	}
+	return true
+}
+
+// nullish reports whether v is null or missing
+func nullish(v interface{}) bool {
+	switch v.(type) {
+	case nil, missingValue, primitive.Null, primitive.Undefined:
+		return true
+	}
+	return false
+}
+
+// orNull turns missing into null
+func orNull(v interface{}) interface{} {
+	if _, ok := v.(missingValue); ok {
+		return nil
+	}
+	return v
+}
+
+// fieldValue returns the value at path, arrays of documents give the array
+// of their values
+func fieldValue(v interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return v
+	}
+	if d := documentOf(v); d != nil {
+		for _, e := range d {
+			if e.Key == path[0] {
+				return fieldValue(e.Value, path[1:])
+			}
+		}
+		return missing
+	}
+	if arr := arrayOf(v); arr != nil {
+		out := bson.A{}
+		for _, elem := range arr {
+			if documentOf(elem) == nil {
+				continue
+			}
+			if r := fieldValue(elem, path); r != missing {
+				out = append(out, r)
+			}
+		}
+		return out
+	}
+	return missing
+}
+
+// eval evaluates an aggregation expression
+func (c evalContext) eval(expr interface{}) (interface{}, error) {
+	switch e := expr.(type) {
+	case Expression:
+		return c.eval(e.Value())
+	case string:
+		if strings.HasPrefix(e, "$$") {
+			return c.variable(e[2:])
+		}
+		if strings.HasPrefix(e, "$") {
+			return fieldValue(c.root, strings.Split(e[1:], ".")), nil
+		}
+		return e, nil
+	case bson.A, []interface{}:
+		arr := arrayOf(e)
+		out := make(bson.A, 0, len(arr))
+		for _, elem := range arr {
+			v, err := c.eval(elem)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, orNull(v))
+		}
+		return out, nil
+	case bson.D, bson.M:
+		d := documentOf(e)
+		if len(d) == 1 && strings.HasPrefix(d[0].Key, "$") {
+			return c.operator(d[0].Key, d[0].Value)
+		}
+		out := make(bson.D, 0, len(d))
+		for _, field := range d {
+			v, err := c.eval(field.Value)
+			if err != nil {
+				return nil, err
+			}
+			if v != missing {
+				out = append(out, bson.E{Key: field.Key, Value: v})
+			}
+		}
+		return out, nil
+	}
+	return expr, nil
+}
+
+func (c evalContext) variable(ref string) (interface{}, error) {
+	parts := strings.Split(ref, ".")
+	var v interface{}
+	switch parts[0] {
+	case "ROOT", "CURRENT":
+		v = c.root
+	case "REMOVE":
+		return missing, nil
+	default:
+		bound, ok := c.vars[parts[0]]
+		if !ok {
+			if systemVariables[parts[0]] {
+				return nil, fmt.Errorf("%w: variable $$%s", ErrUnsupported, parts[0])
+			}
+			return nil, fmt.Errorf("%w: $$%s", ErrUndeclaredVariable, parts[0])
+		}
+		v = bound
+	}
+	return fieldValue(v, parts[1:]), nil
+}
+
+// args evaluates the arguments of an operator, a single argument may be
+// given without the array
+func (c evalContext) args(op string, arg interface{}, min, max int) ([]interface{}, error) {
+	arr := arrayOf(arg)
+	if arr == nil {
+		arr = bson.A{arg}
+	}
+	if len(arr) < min || (max >= 0 && len(arr) > max) {
+		return nil, fmt.Errorf("%w: %s takes %d to %d arguments, got %d", ErrInvalidStage, op, min, max, len(arr))
+	}
+	out := make([]interface{}, 0, len(arr))
+	for _, a := range arr {
+		v, err := c.eval(a)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// named evaluates the fields of an operator taking a document
+func (c evalContext) named(op string, arg interface{}, fields ...string) (map[string]interface{}, error) {
+	d := documentOf(arg)
+	if d == nil {
+		return nil, fmt.Errorf("%w: %s takes a document", ErrInvalidStage, op)
+	}
+	out := make(map[string]interface{}, len(d))
+	for _, e := range d {
+		known := false
+		for _, f := range fields {
+			known = known || f == e.Key
+		}
+		if !known {
+			return nil, fmt.Errorf("%w: %s has no field %q", ErrInvalidStage, op, e.Key)
+		}
+		out[e.Key] = e.Value
+	}
+	return out, nil
+}
+
+func (c evalContext) operator(op string, arg interface{}) (interface{}, error) {
+	switch op {
+	case "$literal":
+		return arg, nil
+
+	case "$add", "$multiply":
+		args, err := c.args(op, arg, 0, -1)
+		if err != nil {
+			return nil, err
+		}
+		return arithmetic(op, args)
+	case "$subtract", "$divide", "$mod", "$pow":
+		args, err := c.args(op, arg, 2, 2)
+		if err != nil {
+			return nil, err
+		}
+		return arithmetic(op, args)
+	case "$abs", "$ceil", "$floor", "$sqrt":
+		args, err := c.args(op, arg, 1, 1)
+		if err != nil {
+			return nil, err
+		}
+		return unaryMath(op, args[0])
+
+	case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte", "$cmp":
+		args, err := c.args(op, arg, 2, 2)
+		if err != nil {
+			return nil, err
+		}
+		cmp := compareValues(args[0], args[1])
+		switch op {
+		case "$eq":
+			return cmp == 0, nil
+		case "$ne":
+			return cmp != 0, nil
+		case "$gt":
+			return cmp > 0, nil
+		case "$gte":
+			return cmp >= 0, nil
+		case "$lt":
+			return cmp < 0, nil
+		case "$lte":
+			return cmp <= 0, nil
+		}
+		return int32(cmp), nil
+
+	case "$and", "$or":
+		arr := arrayOf(arg)
+		if arr == nil {
+			arr = bson.A{arg}
+		}
+		for _, a := range arr {
+			v, err := c.eval(a)
+			if err != nil {
+				return nil, err
+			}
+			if op == "$and" && !truthy(v) {
+				return false, nil
+			}
+			if op == "$or" && truthy(v) {
+				return true, nil
+			}
+		}
+		return op == "$and", nil
+	case "$not":
+		args, err := c.args(op, arg, 1, 1)
+		if err != nil {
+			return nil, err
+		}
+		return !truthy(args[0]), nil
+
+	case "$concat":
+		args, err := c.args(op, arg, 0, -1)
+		if err != nil {
+			return nil, err
+		}
+		var sb strings.Builder
+		for _, a := range args {
+			if nullish(a) {
+				return nil, nil
+			}
+			s, ok := a.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: $concat takes strings, got %T", ErrInvalidStage, a)
+			}
+			sb.WriteString(s)
+		}
+		return sb.String(), nil
+	case "$toLower", "$toUpper":
+		args, err := c.args(op, arg, 1, 1)
+		if err != nil {
+			return nil, err
+		}
+		if nullish(args[0]) {
+			return "", nil
+		}
+		s := fmt.Sprint(args[0])
+		if op == "$toLower" {
+			return strings.ToLower(s), nil
+		}
+		return strings.ToUpper(s), nil
+
+	case "$cond":
+		var parts []interface{}
+		if d := documentOf(arg); d != nil {
+			m, err := c.named(op, arg, "if", "then", "else")
+			if err != nil {
+				return nil, err
+			}
+			parts = []interface{}{m["if"], m["then"], m["else"]}
+		} else if arr := arrayOf(arg); len(arr) == 3 {
+			parts = arr
+		} else {
+			return nil, fmt.Errorf("%w: $cond takes [ if, then, else ] or a document", ErrInvalidStage)
+		}
+		cond, err := c.eval(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		if truthy(cond) {
+			return c.eval(parts[1])
+		}
+		return c.eval(parts[2])
+	case "$ifNull":
+		args, err := c.args(op, arg, 2, -1)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range args[:len(args)-1] {
+			if !nullish(a) {
+				return a, nil
+			}
+		}
+		return args[len(args)-1], nil
+	case "$switch":
+		m, err := c.named(op, arg, "branches", "default")
+		if err != nil {
+			return nil, err
+		}
+		for _, branch := range arrayOf(m["branches"]) {
+			b, err := c.named(op, branch, "case", "then")
+			if err != nil {
+				return nil, err
+			}
+			cond, err := c.eval(b["case"])
+			if err != nil {
+				return nil, err
+			}
+			if truthy(cond) {
+				return c.eval(b["then"])
+			}
+		}
+		if _, ok := m["default"]; !ok {
+			return nil, fmt.Errorf("%w: $switch matched no branch and has no default", ErrInvalidStage)
+		}
+		return c.eval(m["default"])
+
+	case "$size", "$isArray":
+		args, err := c.args(op, arg, 1, 1)
+		if err != nil {
+			return nil, err
+		}
+		arr := arrayOf(args[0])
+		if op == "$isArray" {
+			return arr != nil, nil
+		}
+		if arr == nil {
+			return nil, fmt.Errorf("%w: $size takes an array, got %T", ErrInvalidStage, args[0])
+		}
+		return int32(len(arr)), nil
+	case "$arrayElemAt":
+		args, err := c.args(op, arg, 2, 2)
+		if err != nil {
+			return nil, err
+		}
+		if nullish(args[0]) {
+			return nil, nil
+		}
+		arr := arrayOf(args[0])
+		i, ok := intOf(args[1])
+		if arr == nil || !ok {
+			return nil, fmt.Errorf("%w: $arrayElemAt takes an array and an integer", ErrInvalidStage)
+		}
+		if i < 0 {
+			i += int64(len(arr))
+		}
+		if i < 0 || i >= int64(len(arr)) {
+			return missing, nil
+		}
+		return arr[i], nil
+	case "$in":
+		args, err := c.args(op, arg, 2, 2)
+		if err != nil {
+			return nil, err
+		}
+		arr := arrayOf(args[1])
+		if arr == nil {
+			return nil, fmt.Errorf("%w: $in takes an array, got %T", ErrInvalidStage, args[1])
+		}
+		for _, v := range arr {
+			if compareValues(args[0], v) == 0 {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$concatArrays":
+		args, err := c.args(op, arg, 0, -1)
+		if err != nil {
+			return nil, err
+		}
+		out := bson.A{}
+		for _, a := range args {
+			if nullish(a) {
+				return nil, nil
+			}
+			arr := arrayOf(a)
+			if arr == nil {
+				return nil, fmt.Errorf("%w: $concatArrays takes arrays, got %T", ErrInvalidStage, a)
+			}
+			out = append(out, arr...)
+		}
+		return out, nil
+	case "$map", "$filter":
+		fields := []string{"input", "as", "in"}
+		if op == "$filter" {
+			fields = []string{"input", "as", "cond", "limit"}
+		}
+		m, err := c.named(op, arg, fields...)
+		if err != nil {
+			return nil, err
+		}
+		input, err := c.eval(m["input"])
+		if err != nil || nullish(input) {
+			return nil, err
+		}
+		as := "this"
+		if s, ok := m["as"].(string); ok {
+			as = s
+		}
+		out := bson.A{}
+		for _, elem := range arrayOf(input) {
+			scope := c.with(as, elem)
+			if op == "$map" {
+				v, err := scope.eval(m["in"])
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, orNull(v))
+				continue
+			}
+			keep, err := scope.eval(m["cond"])
+			if err != nil {
+				return nil, err
+			}
+			if truthy(keep) {
+				out = append(out, elem)
+			}
+		}
+		return out, nil
+	case "$let":
+		m, err := c.named(op, arg, "vars", "in")
+		if err != nil {
+			return nil, err
+		}
+		scope := c
+		for _, v := range documentOf(m["vars"]) {
+			value, err := c.eval(v.Value)
+			if err != nil {
+				return nil, err
+			}
+			scope = scope.with(v.Key, value)
+		}
+		return scope.eval(m["in"])
+
+	case "$sum", "$avg", "$min", "$max":
+		args, err := c.args(op, arg, 1, -1)
+		if err != nil {
+			return nil, err
+		}
+		values := args
+		if len(args) == 1 {
+			if arr := arrayOf(args[0]); arr != nil {
+				values = arr
+			}
+		}
+		return accumulate(op, values)
+	case "$mergeObjects":
+		args, err := c.args(op, arg, 0, -1)
+		if err != nil {
+			return nil, err
+		}
+		return accumulate(op, args)
+	}
+	return nil, fmt.Errorf("%w: expression operator %s", ErrUnsupported, op)
+}
+
+// numberRank orders the numeric result types: int32, int64, float64
+func numberRank(v interface{}) int {
+	switch v.(type) {
+	case int8, int16, int32, uint8, uint16:
+		return 1
+	case int, int64, uint32:
+		return 2
+	}
+	return 3
+}
+
+// numberOf returns v as a number of the given rank, promoting int32 to
+// int64 and int64 to float64 on overflow
+func numberOf(rank int, f float64) interface{} {
+	switch {
+	case rank == 1 && f >= math.MinInt32 && f <= math.MaxInt32:
+		return int32(f)
+	case rank <= 2 && f >= math.MinInt64 && f < math.MaxInt64:
+		return int64(f)
+	}
+	return f
+}
+
+func arithmetic(op string, args []interface{}) (interface{}, error) {
+	if op == "$subtract" {
+		// the difference of two dates is in milliseconds
+		a, ok1 := toTime(args[0])
+		b, ok2 := toTime(args[1])
+		if ok1 && ok2 {
+			return int64(a.Sub(b) / time.Millisecond), nil
+		}
+	}
+	rank := 1
+	var date *time.Time
+	var result float64
+	if op == "$multiply" {
+		result = 1
+	}
+	for i, a := range args {
+		if nullish(a) {
+			return nil, nil
+		}
+		if t, ok := toTime(a); ok && (op == "$add" || (op == "$subtract" && i == 0)) && date == nil {
+			date = &t
+			continue
+		}
+		f, ok := toFloat(a)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s takes numbers, got %T", ErrInvalidStage, op, a)
+		}
+		if r := numberRank(a); r > rank {
+			rank = r
+		}
+		switch {
+		case i == 0 && op != "$add" && op != "$multiply":
+			result = f
+		case op == "$add":
+			result += f
+		case op == "$multiply":
+			result *= f
+		case op == "$subtract":
+			result -= f
+		case op == "$divide":
+			if f == 0 {
+				return nil, fmt.Errorf("%w: $divide by zero", ErrInvalidStage)
+			}
+			result /= f
+			rank = 3
+		case op == "$mod":
+			if f == 0 {
+				return nil, fmt.Errorf("%w: $mod by zero", ErrInvalidStage)
+			}
+			result = math.Mod(result, f)
+		case op == "$pow":
+			result = math.Pow(result, f)
+		}
+	}
+	if date != nil {
+		return primitive.NewDateTimeFromTime(date.Add(time.Duration(result) * time.Millisecond)), nil
+	}
+	return numberOf(rank, result), nil
+}
+
+func unaryMath(op string, v interface{}) (interface{}, error) {
+	if nullish(v) {
+		return nil, nil
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s takes a number, got %T", ErrInvalidStage, op, v)
+	}
+	switch op {
+	case "$abs":
+		return numberOf(numberRank(v), math.Abs(f)), nil
+	case "$ceil":
+		return numberOf(numberRank(v), math.Ceil(f)), nil
+	case "$floor":
+		return numberOf(numberRank(v), math.Floor(f)), nil
+	}
+	if f < 0 {
+		return nil, fmt.Errorf("%w: $sqrt of a negative number", ErrInvalidStage)
+	}
+	return math.Sqrt(f), nil
+}
+
+// accumulate folds values with a $group accumulator, missing values are skipped
+func accumulate(op string, values []interface{}) (interface{}, error) {
+	present := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		if v != missing {
+			present = append(present, v)
+		}
+	}
+
+	switch op {
+	case "$sum", "$avg", "$stdDevPop", "$stdDevSamp":
+		rank, sum, n := 1, 0.0, 0
+		var nums []float64
+		for _, v := range present {
+			f, ok := toFloat(v)
+			if !ok {
+				continue
+			}
+			if r := numberRank(v); r > rank {
+				rank = r
+			}
+			sum += f
+			n++
+			nums = append(nums, f)
+		}
+		switch op {
+		case "$sum":
+			return numberOf(rank, sum), nil
+		case "$avg":
+			if n == 0 {
+				return nil, nil
+			}
+			return sum / float64(n), nil
+		}
+		div := float64(n)
+		if op == "$stdDevSamp" {
+			div--
+		}
+		if div <= 0 {
+			return nil, nil
+		}
+		mean, squares := sum/float64(n), 0.0
+		for _, f := range nums {
+			squares += (f - mean) * (f - mean)
+		}
+		return math.Sqrt(squares / div), nil
+	case "$min", "$max":
+		var best interface{}
+		for _, v := range present {
+			if nullish(v) {
+				continue
+			}
+			if best == nil || (op == "$min" && compareValues(v, best) < 0) || (op == "$max" && compareValues(v, best) > 0) {
+				best = v
+			}
+		}
+		return best, nil
+	case "$first", "$last":
+		if len(values) == 0 {
+			return nil, nil
+		}
+		if op == "$first" {
+			return orNull(values[0]), nil
+		}
+		return orNull(values[len(values)-1]), nil
+	case "$push":
+		return append(bson.A{}, present...), nil
+	case "$addToSet":
+		out := bson.A{}
+		for _, v := range present {
+			seen := false
+			for _, o := range out {
+				seen = seen || (typeOrder(o) == typeOrder(v) && compareValues(o, v) == 0)
+			}
+			if !seen {
+				out = append(out, v)
+			}
+		}
+		return out, nil
+	case "$count":
+		return int32(len(values)), nil
+	case "$mergeObjects":
+		out := bson.D{}
+		for _, v := range present {
+			if nullish(v) {
+				continue
+			}
+			d := documentOf(v)
+			if d == nil {
+				return nil, fmt.Errorf("%w: $mergeObjects takes documents, got %T", ErrInvalidStage, v)
+			}
+			for _, e := range d {
+				out = setField(out, e.Key, e.Value)
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%w: accumulator %s", ErrUnsupported, op)
+}
+
+// setField sets a top level field, keeping its position when it exists
+func setField(d bson.D, key string, value interface{}) bson.D {
+	out := make(bson.D, len(d), len(d)+1)
+	copy(out, d)
+	for i, e := range out {
+		if e.Key == key {
+			out[i].Value = value
+			return out
+		}
+	}
+	return append(out, bson.E{Key: key, Value: value})
+}
+
+// setPath sets a dotted path, creating or replacing the documents on the way
+func setPath(d bson.D, path []string, value interface{}) bson.D {
+	if len(path) == 1 {
+		return setField(d, path[0], value)
+	}
+	var sub bson.D
+	for _, e := range d {
+		if e.Key == path[0] {
+			sub = documentOf(e.Value)
+		}
+	}
+	return setField(d, path[0], setPath(sub, path[1:], value))
+}
+
+// removePath removes a dotted path, arrays of documents are traversed
+func removePath(v interface{}, path []string) interface{} {
+	if arr := arrayOf(v); arr != nil {
+		out := make(bson.A, 0, len(arr))
+		for _, elem := range arr {
+			out = append(out, removePath(elem, path))
+		}
+		return out
+	}
+	d := documentOf(v)
+	if d == nil {
+		return v
+	}
+	out := make(bson.D, 0, len(d))
+	for _, e := range d {
+		switch {
+		case e.Key != path[0]:
+			out = append(out, e)
+		case len(path) > 1:
+			out = append(out, bson.E{Key: e.Key, Value: removePath(e.Value, path[1:])})
+		}
+	}
+	return out
+}
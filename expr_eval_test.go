@@ -0,0 +1,84 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestEvalExpression(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	doc := bson.D{
+		{Key: "price", Value: int32(4)},
+		{Key: "qty", Value: int32(3)},
+		{Key: "discount", Value: 0.5},
+		{Key: "name", Value: "Hamster"},
+		{Key: "items", Value: bson.A{
+			bson.D{{Key: "sku", Value: "a"}, {Key: "n", Value: int64(1)}},
+			bson.D{{Key: "sku", Value: "b"}, {Key: "n", Value: int64(2)}},
+		}},
+		{Key: "created", Value: created},
+	}
+	ctx := evalContext{root: doc}
+
+	cases := []struct {
+		expr interface{}
+		want interface{}
+	}{
+		{Expr.Multiply("$price", "$qty"), int32(12)},
+		{Expr.Add("$price", int64(1)), int64(5)},
+		{Expr.Subtract("$price", "$discount"), 3.5},
+		{Expr.Divide("$price", 8), 0.5},
+		{Expr.Mod("$price", 3), int64(1)},
+		{Expr.Abs(-2.5), 2.5},
+		{Expr.Eq("$price", 4.0), true},
+		{Expr.Gt("$name", 1), true},
+		{Expr.Cmp("$qty", "$price"), int32(-1)},
+		{Expr.Eq("$missing", nil), false},
+		{Expr.Lt("$missing", nil), true},
+		{Expr.Eq("$missing", "$other"), true},
+		{Expr.In("$missing", bson.A{nil}), false},
+		{Expr.And(true, "$price"), true},
+		{Expr.Or(false, "$missing"), false},
+		{Expr.Not("$missing"), true},
+		{Expr.Concat("$name", "!"), "Hamster!"},
+		{Expr.Concat("$name", "$missing"), nil},
+		{Expr.ToLower("$name"), "hamster"},
+		{Expr.Cond(Expr.Gte("$qty", 3), "bulk", "single"), "bulk"},
+		{Expr.IfNull("$missing", "default"), "default"},
+		{Expr.Switch([]ExprCase{{Case: Expr.Lt("$qty", 2), Then: "few"}}, "many"), "many"},
+		{Expr.Size("$items"), int32(2)},
+		{"$items.sku", bson.A{"a", "b"}},
+		{Expr.ArrayElemAt("$items.sku", -1), "b"},
+		{Expr.In("a", "$items.sku"), true},
+		{Expr.ConcatArrays(bson.A{1}, bson.A{2}), bson.A{1, 2}},
+		{Expr.IsArray("$name"), false},
+		{Expr.Map("$items", "item", Expr.Var("item.n")), bson.A{int64(1), int64(2)}},
+		{Expr.Filter("$items", "item", Expr.Gt("$$item.n", 1)), bson.A{bson.D{{Key: "sku", Value: "b"}, {Key: "n", Value: int64(2)}}}},
+		{Expr.Let(bson.D{{Key: "total", Value: Expr.Multiply("$price", "$qty")}}, Expr.Add("$$total", 1)), int64(13)},
+		{bson.D{{Key: "$sum", Value: "$items.n"}}, int64(3)},
+		{bson.D{{Key: "$avg", Value: bson.A{"$price", "$qty"}}}, 3.5},
+		{bson.D{{Key: "$max", Value: "$items.sku"}}, "b"},
+		{Expr.Literal("$price"), "$price"},
+		{bson.D{{Key: "total", Value: "$price"}, {Key: "gone", Value: "$missing"}}, bson.D{{Key: "total", Value: int32(4)}}},
+		{"$$ROOT.qty", int32(3)},
+		{Expr.Add("$created", 1000), primitive.NewDateTimeFromTime(created.Add(time.Second))},
+		{Expr.Subtract("$created", created.Add(-time.Minute)), int64(60000)},
+	}
+	for _, c := range cases {
+		got, err := ctx.eval(c.expr)
+		require.NoError(t, err, "%v", c.expr)
+		require.EqualValues(t, c.want, got, "%v", c.expr)
+	}
+
+	_, err := ctx.eval(Expr.DateToString("$created", "%Y", nil))
+	require.True(t, errors.Is(err, ErrUnsupported))
+	_, err = ctx.eval("$$nope")
+	require.True(t, errors.Is(err, ErrUndeclaredVariable))
+	_, err = ctx.eval(Expr.Divide(1, 0))
+	require.True(t, errors.Is(err, ErrInvalidStage))
+}
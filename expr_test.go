@@ -0,0 +1,148 @@
+package hamster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestExprReferences(t *testing.T) {
+	require.Equal(t, "$price", Expr.Field("price").Value())
+	require.Equal(t, "$price", Expr.Field("$price").Value())
+	require.Equal(t, "$$item", Expr.Var("item").Value())
+	require.Equal(t, "$$ROOT", Expr.Root().Value())
+	require.EqualValues(t, bson.D{{Key: "$literal", Value: "$1"}}, Expr.Literal("$1").Value())
+	require.EqualValues(t, bson.D{{Key: "$let", Value: bson.D{
+		{Key: "vars", Value: bson.D{{Key: "total", Value: "$price"}}},
+		{Key: "in", Value: "$$total"},
+	}}}, Expr.Let(bson.D{{Key: "total", Value: "$price"}}, Expr.Var("total")).Value())
+}
+
+func TestExprOperators(t *testing.T) {
+	price, qty := Expr.Field("price"), Expr.Field("qty")
+
+	t.Run("test-arithmetic", func(t *testing.T) {
+		// { $multiply: [ "$price", { $add: [ "$qty", 1 ] } ] }
+		e := Expr.Multiply(price, Expr.Add(qty, 1))
+		require.EqualValues(t, bson.D{{Key: "$multiply", Value: bson.A{"$price",
+			bson.D{{Key: "$add", Value: bson.A{"$qty", 1}}}}}}, e.Value())
+		require.EqualValues(t, bson.D{{Key: "$round", Value: bson.A{"$price", int32(2)}}}, Expr.Round(price, 2).Value())
+		require.EqualValues(t, bson.D{{Key: "$abs", Value: "$price"}}, Expr.Abs(price).Value())
+	})
+
+	t.Run("test-comparison-boolean", func(t *testing.T) {
+		// { $and: [ { $gt: [ "$qty", 100 ] }, { $not: [ { $eq: [ "$price", 0 ] } ] } ] }
+		e := Expr.And(Expr.Gt(qty, 100), Expr.Not(Expr.Eq(price, 0)))
+		require.EqualValues(t, bson.D{{Key: "$and", Value: bson.A{
+			bson.D{{Key: "$gt", Value: bson.A{"$qty", 100}}},
+			bson.D{{Key: "$not", Value: bson.A{bson.D{{Key: "$eq", Value: bson.A{"$price", 0}}}}}},
+		}}}, e.Value())
+	})
+
+	t.Run("test-string", func(t *testing.T) {
+		require.EqualValues(t, bson.D{{Key: "$concat", Value: bson.A{"$first", " ", "$last"}}},
+			Expr.Concat(Expr.Field("first"), " ", Expr.Field("last")).Value())
+		require.EqualValues(t, bson.D{{Key: "$substr", Value: bson.A{"$name", int64(0), int64(3)}}},
+			Expr.Substr(Expr.Field("name"), 0, 3).Value())
+		require.EqualValues(t, bson.D{{Key: "$regexMatch", Value: bson.D{
+			{Key: "input", Value: "$description"},
+			{Key: "regex", Value: "line"},
+			{Key: "options", Value: "i"},
+		}}}, Expr.RegexMatch(Expr.Field("description"), "line", "i").Value())
+	})
+
+	t.Run("test-date", func(t *testing.T) {
+		tz := "Europe/Paris"
+		binSize := int64(2)
+		require.EqualValues(t, bson.D{{Key: "$dateToString", Value: bson.D{
+			{Key: "date", Value: "$date"},
+			{Key: "format", Value: "%Y-%m-%d"},
+			{Key: "timezone", Value: tz},
+		}}}, Expr.DateToString(Expr.Field("date"), "%Y-%m-%d", &ExprDateOptions{Timezone: &tz}).Value())
+		require.EqualValues(t, bson.D{{Key: "$dateTrunc", Value: bson.D{
+			{Key: "date", Value: "$date"},
+			{Key: "unit", Value: "week"},
+			{Key: "binSize", Value: int64(2)},
+		}}}, Expr.DateTrunc(Expr.Field("date"), "week", &ExprDateOptions{BinSize: &binSize}).Value())
+		require.EqualValues(t, bson.D{{Key: "$dateDiff", Value: bson.D{
+			{Key: "startDate", Value: "$purchased"},
+			{Key: "endDate", Value: "$delivered"},
+			{Key: "unit", Value: "day"},
+		}}}, Expr.DateDiff(Expr.Field("purchased"), Expr.Field("delivered"), "day", nil).Value())
+	})
+
+	t.Run("test-array", func(t *testing.T) {
+		// { $map: { input: "$items", as: "item", in: { $multiply: [ "$$item.price", 2 ] } } }
+		require.EqualValues(t, bson.D{{Key: "$map", Value: bson.D{
+			{Key: "input", Value: "$items"},
+			{Key: "as", Value: "item"},
+			{Key: "in", Value: bson.D{{Key: "$multiply", Value: bson.A{"$$item.price", 2}}}},
+		}}}, Expr.Map(Expr.Field("items"), "item", Expr.Multiply(Expr.Var("item.price"), 2)).Value())
+
+		require.EqualValues(t, bson.D{{Key: "$filter", Value: bson.D{
+			{Key: "input", Value: "$items"},
+			{Key: "cond", Value: bson.D{{Key: "$gte", Value: bson.A{"$$this.price", 100}}}},
+		}}}, Expr.Filter(Expr.Field("items"), "", Expr.Gte(Expr.Var("this.price"), 100)).Value())
+
+		require.EqualValues(t, bson.D{{Key: "$reduce", Value: bson.D{
+			{Key: "input", Value: "$items"},
+			{Key: "initialValue", Value: 0},
+			{Key: "in", Value: bson.D{{Key: "$add", Value: bson.A{"$$value", "$$this"}}}},
+		}}}, Expr.Reduce(Expr.Field("items"), 0, Expr.Add(Expr.Var("value"), Expr.Var("this"))).Value())
+
+		require.EqualValues(t, bson.D{{Key: "$arrayElemAt", Value: bson.A{"$items", int64(-1)}}},
+			Expr.ArrayElemAt(Expr.Field("items"), -1).Value())
+	})
+
+	t.Run("test-conditional", func(t *testing.T) {
+		require.EqualValues(t, bson.D{{Key: "$cond", Value: bson.D{
+			{Key: "if", Value: bson.D{{Key: "$gte", Value: bson.A{"$qty", 250}}}},
+			{Key: "then", Value: 30},
+			{Key: "else", Value: 20},
+		}}}, Expr.Cond(Expr.Gte(qty, 250), 30, 20).Value())
+
+		require.EqualValues(t, bson.D{{Key: "$switch", Value: bson.D{
+			{Key: "branches", Value: bson.A{
+				bson.D{{Key: "case", Value: bson.D{{Key: "$gte", Value: bson.A{"$qty", 100}}}}, {Key: "then", Value: "bulk"}},
+			}},
+			{Key: "default", Value: "retail"},
+		}}}, Expr.Switch([]ExprCase{{Case: Expr.Gte(qty, 100), Then: "bulk"}}, "retail").Value())
+
+		require.EqualValues(t, bson.D{{Key: "$ifNull", Value: bson.A{"$description", "Unspecified"}}},
+			Expr.IfNull(Expr.Field("description"), "Unspecified").Value())
+	})
+
+	t.Run("test-conversion", func(t *testing.T) {
+		require.EqualValues(t, bson.D{{Key: "$convert", Value: bson.D{
+			{Key: "input", Value: "$price"},
+			{Key: "to", Value: "decimal"},
+			{Key: "onError", Value: "Error"},
+		}}}, Expr.Convert(price, "decimal", "Error", nil).Value())
+		require.EqualValues(t, bson.D{{Key: "$toInt", Value: "$qty"}}, Expr.ToInt(qty).Value())
+	})
+}
+
+func TestExprUsage(t *testing.T) {
+	total := Expr.Multiply(Expr.Field("price"), Expr.Field("qty"))
+
+	// { total: { $multiply: [ "$price", "$qty" ] } }
+	project := ProjectDocBuilder.Field("total", total).Doc()
+	require.EqualValues(t, bson.D{{Key: "total", Value: total.Value()}}, project.ToD())
+
+	// { $expr: { $gt: [ "$spent", "$budget" ] } }
+	filter := FilterDocBuilder.Expr(Expr.Gt(Expr.Field("spent"), Expr.Field("budget"))).Doc()
+	require.EqualValues(t, bson.D{{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{"$spent", "$budget"}}}}}, filter.ToD())
+
+	group := GroupDocBuilder.IdNull().Sum("revenue", total).Doc()
+	require.EqualValues(t, bson.D{
+		{Key: "_id", Value: nil},
+		{Key: "revenue", Value: bson.D{{Key: "$sum", Value: total.Value()}}},
+	}, group.ToD())
+
+	data, err := bson.Marshal(bson.D{{Key: "total", Value: total}})
+	require.NoError(t, err)
+	std, err := bson.Marshal(bson.D{{Key: "total", Value: total.Value()}})
+	require.NoError(t, err)
+	require.EqualValues(t, std, data)
+}
@@ -1,14 +1,22 @@
 package hamster
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/lann/builder"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// ErrInvalidFilter is returned when a filter operator is malformed
+var ErrInvalidFilter = errors.New("hamster: invalid filter")
+
 // filterDoc is a MQL filter document
 type filterDoc struct {
 	Filters bson.D
+	// Errors collects the problems found while building the filter
+	Errors []error
 }
 
 // filterDocBuilder is a builder for filterDoc
@@ -38,8 +46,19 @@ func (f filterDoc) ToM() bson.M {
 	return f.ToD().Map()
 }
 
+// Err returns the first error found while building the filter
+func (f filterDoc) Err() error {
+	if len(f.Errors) == 0 {
+		return nil
+	}
+	return f.Errors[0]
+}
+
 // MarshalBSON marshals filterDoc to BSON
 func (f filterDoc) MarshalBSON() ([]byte, error) {
+	if err := f.Err(); err != nil {
+		return nil, err
+	}
 	return bson.Marshal(f.ToD())
 }
 
@@ -52,6 +71,11 @@ func (f filterDocBuilder) Doc() filterDoc {
 	return builder.GetStruct(f).(filterDoc)
 }
 
+// fail records err on the filter, it is reported by filterDoc.Err
+func (f filterDocBuilder) fail(err error) filterDocBuilder {
+	return builder.Append(f, "Errors", err).(filterDocBuilder)
+}
+
 func (f filterDocBuilder) Eq(fieldName string, value interface{}) filterDocBuilder {
 	return builder.Append(f, "Filters", bson.E{Key: fieldName, Value: value}).(filterDocBuilder)
 }
@@ -95,36 +119,45 @@ func (f filterDocBuilder) Empty() filterDocBuilder {
 	return builder.Set(f, "Filters", bson.D{}).(filterDocBuilder)
 }
 
-func (f filterDocBuilder) And(filters ...filterDoc) filterDocBuilder {
+// documents converts the filters of a logical operator and records their errors,
+// a filter is a filterDoc, a FilterDocBuilder, a bson.D or a bson.M
+func (f filterDocBuilder) documents(op string, filters []interface{}) (filterDocBuilder, []bson.D) {
 	v := make([]bson.D, 0, len(filters))
 	for _, filter := range filters {
-		v = append(v, filter.ToD())
+		d, ok := toDocument(filter)
+		if !ok {
+			f = f.fail(fmt.Errorf("%w: %s needs filter documents, got %T", ErrInvalidFilter, op, filter))
+			continue
+		}
+		for _, err := range docErrors(filter) {
+			f = f.fail(err)
+		}
+		v = append(v, d)
 	}
-	e := bson.E{Key: "$and", Value: v}
-	return builder.Append(f, "Filters", e).(filterDocBuilder)
+	return f, v
 }
 
-func (f filterDocBuilder) Or(filters ...filterDoc) filterDocBuilder {
-	v := make([]bson.D, 0, len(filters))
-	for _, filter := range filters {
-		v = append(v, filter.ToD())
-	}
-	e := bson.E{Key: "$or", Value: v}
-	return builder.Append(f, "Filters", e).(filterDocBuilder)
+func (f filterDocBuilder) And(filters ...interface{}) filterDocBuilder {
+	f, v := f.documents("$and", filters)
+	return builder.Append(f, "Filters", bson.E{Key: "$and", Value: v}).(filterDocBuilder)
 }
 
-func (f filterDocBuilder) Not(filter filterDoc) filterDocBuilder {
-	e := bson.E{Key: "$not", Value: filter.ToD()}
-	return builder.Append(f, "Filters", e).(filterDocBuilder)
+func (f filterDocBuilder) Or(filters ...interface{}) filterDocBuilder {
+	f, v := f.documents("$or", filters)
+	return builder.Append(f, "Filters", bson.E{Key: "$or", Value: v}).(filterDocBuilder)
 }
 
-func (f filterDocBuilder) Nor(filters ...filterDoc) filterDocBuilder {
-	v := make([]bson.D, 0, len(filters))
-	for _, filter := range filters {
-		v = append(v, filter.ToD())
+func (f filterDocBuilder) Not(filter interface{}) filterDocBuilder {
+	f, v := f.documents("$not", []interface{}{filter})
+	if len(v) == 0 {
+		return f
 	}
-	e := bson.E{Key: "$nor", Value: v}
-	return builder.Append(f, "Filters", e).(filterDocBuilder)
+	return builder.Append(f, "Filters", bson.E{Key: "$not", Value: v[0]}).(filterDocBuilder)
+}
+
+func (f filterDocBuilder) Nor(filters ...interface{}) filterDocBuilder {
+	f, v := f.documents("$nor", filters)
+	return builder.Append(f, "Filters", bson.E{Key: "$nor", Value: v}).(filterDocBuilder)
 }
 
 func (f filterDocBuilder) All(fieldName string, values []interface{}) filterDocBuilder {
@@ -209,6 +242,12 @@ func (f filterDocBuilder) Text(search string, opt *FilterDocTextSearchOptions) f
 	return builder.Append(f, "Filters", e).(filterDocBuilder)
 }
 
+// Expr matches documents with an aggregation expression, { $expr: <expression> }
+func (f filterDocBuilder) Expr(expression interface{}) filterDocBuilder {
+	e := bson.E{Key: "$expr", Value: bsonValue(expression)}
+	return builder.Append(f, "Filters", e).(filterDocBuilder)
+}
+
 func (f filterDocBuilder) Where(js primitive.JavaScript) filterDocBuilder {
 	e := bson.E{Key: "$where", Value: js}
 	return builder.Append(f, "Filters", e).(filterDocBuilder)
@@ -270,9 +309,15 @@ func (f filterDocBuilder) BitsAnySetWithBitPosition(fieldName string, position [
 	return builder.Append(f, "Filters", e).(filterDocBuilder)
 }
 
-func (f filterDocBuilder) GeoWithin(fieldName string, geoWithinDoc bson.D) filterDocBuilder {
-	e := bson.E{Key: fieldName, Value: bson.D{bson.E{Key: "$geoWithin", Value: geoWithinDoc}}}
-	return builder.Append(f, "Filters", e).(filterDocBuilder)
+// GeoWithin takes a raw $geoWithin document or a Polygon or MultiPolygon geometry
+// { <field>: { $geoWithin: { $geometry: <geometry> } } }
+func (f filterDocBuilder) GeoWithin(fieldName string, geoWithinDoc interface{}) filterDocBuilder {
+	switch g := geoWithinDoc.(type) {
+	case Polygon, MultiPolygon:
+	case Geometry:
+		return f.fail(fmt.Errorf("%w: $geoWithin requires a Polygon or MultiPolygon, got %T", ErrInvalidGeometry, g))
+	}
+	return f.geometry(fieldName, "$geoWithin", geoWithinDoc)
 }
 
 func (f filterDocBuilder) GeoWithinBox(fieldName string, lowerLeftX, lowerLeftY, upperRightX, upperRightY float64) filterDocBuilder {
@@ -306,12 +351,101 @@ func (f filterDocBuilder) GeoWithCenterSphere(fieldName string, x, y, radius flo
 	return builder.Append(f, "Filters", e).(filterDocBuilder)
 }
 
-func (f filterDocBuilder) GeoIntersects(fieldName string, geoIntersectsDoc bson.D) filterDocBuilder {
-	e := bson.E{Key: fieldName, Value: bson.D{bson.E{Key: "$geoIntersects", Value: geoIntersectsDoc}}}
-	return builder.Append(f, "Filters", e).(filterDocBuilder)
+// GeoIntersects takes a raw $geoIntersects document or any geometry
+// { <field>: { $geoIntersects: { $geometry: <geometry> } } }
+func (f filterDocBuilder) GeoIntersects(fieldName string, geoIntersectsDoc interface{}) filterDocBuilder {
+	return f.geometry(fieldName, "$geoIntersects", geoIntersectsDoc)
+}
+
+// Near takes a raw $near document, a Point or a LegacyPoint
+// { <field>: { $near: { $geometry: <point> } } } or { <field>: { $near: [ <x>, <y> ] } }
+func (f filterDocBuilder) Near(fieldName string, nearDoc interface{}) filterDocBuilder {
+	return f.near(fieldName, "$near", nearDoc, nil)
+}
+
+// FilterDocNearOptions are the distance bounds of $near and $nearSphere,
+// they are rendered in meters for a Point and in radians for a LegacyPoint
+type FilterDocNearOptions struct {
+	MinDistance *Distance
+	MaxDistance *Distance
+}
+
+// NearWithOptions is Near with $minDistance and $maxDistance
+// { <field>: { $near: { $geometry: <point>, $minDistance: <meters>, $maxDistance: <meters> } } }
+// { <field>: { $near: [ <x>, <y> ], $minDistance: <radians>, $maxDistance: <radians> } }
+func (f filterDocBuilder) NearWithOptions(fieldName string, near interface{}, opt *FilterDocNearOptions) filterDocBuilder {
+	return f.near(fieldName, "$near", near, opt)
+}
+
+// NearSphere takes a Point or a LegacyPoint and sorts by spherical distance
+// { <field>: { $nearSphere: { $geometry: <point>, $minDistance: <meters>, $maxDistance: <meters> } } }
+// { <field>: { $nearSphere: [ <x>, <y> ], $minDistance: <radians>, $maxDistance: <radians> } }
+func (f filterDocBuilder) NearSphere(fieldName string, near interface{}, opt *FilterDocNearOptions) filterDocBuilder {
+	return f.near(fieldName, "$nearSphere", near, opt)
+}
+
+func (f filterDocBuilder) near(fieldName, op string, near interface{}, opt *FilterDocNearOptions) filterDocBuilder {
+	if opt == nil {
+		opt = &FilterDocNearOptions{}
+	}
+	if opt.MinDistance != nil && *opt.MinDistance < 0 {
+		return f.fail(fmt.Errorf("%w: %s $minDistance must be non-negative, got %v", ErrInvalidFilter, op, *opt.MinDistance))
+	}
+	if opt.MaxDistance != nil && *opt.MaxDistance < 0 {
+		return f.fail(fmt.Errorf("%w: %s $maxDistance must be non-negative, got %v", ErrInvalidFilter, op, *opt.MaxDistance))
+	}
+	if opt.MinDistance != nil && opt.MaxDistance != nil && *opt.MinDistance > *opt.MaxDistance {
+		return f.fail(fmt.Errorf("%w: %s $minDistance is above $maxDistance", ErrInvalidFilter, op))
+	}
+
+	var value bson.D
+	switch p := near.(type) {
+	case Point:
+		if err := p.Validate(); err != nil {
+			return f.fail(err)
+		}
+		// GeoJSON distances are inside the operator document, in meters
+		value = bson.D{{Key: op, Value: opt.distances(bson.D{{Key: "$geometry", Value: p.ToD()}}, Distance.Meters)}}
+	case LegacyPoint:
+		// legacy distances are siblings of the operator, in radians
+		value = opt.distances(bson.D{{Key: op, Value: p.ToA()}}, Distance.Radians)
+	case bson.D:
+		if opt.MinDistance != nil || opt.MaxDistance != nil {
+			return f.fail(fmt.Errorf("%w: %s distances need a Point or a LegacyPoint, not a raw document", ErrInvalidFilter, op))
+		}
+		value = bson.D{{Key: op, Value: p}}
+	case Geometry:
+		return f.fail(fmt.Errorf("%w: %s requires a Point, got %T", ErrInvalidGeometry, op, p))
+	default:
+		return f.fail(fmt.Errorf("%w: %s takes a Point, a LegacyPoint or a bson.D, got %T", ErrInvalidGeometry, op, near))
+	}
+	return builder.Append(f, "Filters", bson.E{Key: fieldName, Value: value}).(filterDocBuilder)
 }
 
-func (f filterDocBuilder) Near(fieldName string, nearDoc bson.D) filterDocBuilder {
-	e := bson.E{Key: fieldName, Value: bson.D{bson.E{Key: "$near", Value: nearDoc}}}
+// distances appends the set $minDistance and $maxDistance to d in unit
+func (opt *FilterDocNearOptions) distances(d bson.D, unit func(Distance) float64) bson.D {
+	if opt.MinDistance != nil {
+		d = append(d, bson.E{Key: "$minDistance", Value: unit(*opt.MinDistance)})
+	}
+	if opt.MaxDistance != nil {
+		d = append(d, bson.E{Key: "$maxDistance", Value: unit(*opt.MaxDistance)})
+	}
+	return d
+}
+
+// geometry appends { <field>: { <op>: value } }, a Geometry value is validated
+// and wrapped in $geometry
+func (f filterDocBuilder) geometry(fieldName, op string, value interface{}) filterDocBuilder {
+	switch g := value.(type) {
+	case bson.D:
+	case Geometry:
+		if err := g.Validate(); err != nil {
+			return f.fail(err)
+		}
+		value = bson.D{{Key: "$geometry", Value: g.ToD()}}
+	default:
+		return f.fail(fmt.Errorf("%w: %s takes a bson.D or a Geometry, got %T", ErrInvalidGeometry, op, value))
+	}
+	e := bson.E{Key: fieldName, Value: bson.D{bson.E{Key: op, Value: value}}}
 	return builder.Append(f, "Filters", e).(filterDocBuilder)
 }
@@ -0,0 +1,516 @@
+package hamster
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrUnsupported is returned when the in-memory evaluator meets an operator
+// or a stage it cannot run
+var ErrUnsupported = errors.New("hamster: unsupported in memory")
+
+// Matches reports whether doc matches the filter, evaluated in memory.
+// It supports the comparison, logical, element and array operators,
+// $regex, $mod and $expr, other operators return ErrUnsupported
+func (f filterDoc) Matches(doc bson.D) (bool, error) {
+	if err := f.Err(); err != nil {
+		return false, err
+	}
+	return matchDocument(doc, f.ToD())
+}
+
+// matchDocument reports whether doc matches filter
+func matchDocument(doc bson.D, filter bson.D) (bool, error) {
+	for _, e := range filter {
+		ok, err := matchElement(doc, e)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchElement(doc bson.D, e bson.E) (bool, error) {
+	switch e.Key {
+	case "$and", "$or", "$nor":
+		filters, ok := filterList(e.Value)
+		if !ok || len(filters) == 0 {
+			return false, fmt.Errorf("%w: %s must be a non-empty array of filters", ErrInvalidFilter, e.Key)
+		}
+		for _, f := range filters {
+			ok, err := matchDocument(doc, f)
+			if err != nil {
+				return false, err
+			}
+			switch {
+			case e.Key == "$and" && !ok:
+				return false, nil
+			case e.Key == "$or" && ok:
+				return true, nil
+			case e.Key == "$nor" && ok:
+				return false, nil
+			}
+		}
+		return e.Key != "$or", nil
+	case "$expr":
+		v, err := evalContext{root: doc}.eval(e.Value)
+		if err != nil {
+			return false, err
+		}
+		return truthy(v), nil
+	case "$comment":
+		return true, nil
+	}
+	if strings.HasPrefix(e.Key, "$") {
+		return false, fmt.Errorf("%w: filter operator %s", ErrUnsupported, e.Key)
+	}
+	return matchField(filterValues(doc, strings.Split(e.Key, ".")), e.Value)
+}
+
+// checkFilter walks filter and returns the error matching would meet on an
+// unsupported operator or a malformed argument, whichever document is matched.
+// Unlike matching it visits every branch, $or does not stop at a match
+func checkFilter(filter bson.D) error {
+	for _, e := range filter {
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			filters, ok := filterList(e.Value)
+			if !ok || len(filters) == 0 {
+				return fmt.Errorf("%w: %s must be a non-empty array of filters", ErrInvalidFilter, e.Key)
+			}
+			for _, f := range filters {
+				if err := checkFilter(f); err != nil {
+					return err
+				}
+			}
+		case "$expr":
+			if err := checkExpression(e.Value); err != nil {
+				return err
+			}
+		case "$comment":
+		default:
+			if strings.HasPrefix(e.Key, "$") {
+				return fmt.Errorf("%w: filter operator %s", ErrUnsupported, e.Key)
+			}
+			if err := checkCondition(e.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkCondition checks the condition on a field, a value or a document of operators
+func checkCondition(cond interface{}) error {
+	ops, ok := isOperatorDoc(cond)
+	if !ok {
+		if re, ok := cond.(primitive.Regex); ok {
+			_, err := matchRegex(nil, re)
+			return err
+		}
+		return nil
+	}
+	var options string
+	for _, op := range ops {
+		if op.Key == "$options" {
+			options, _ = op.Value.(string)
+		}
+	}
+	for _, op := range ops {
+		var err error
+		switch op.Key {
+		case "$not":
+			err = checkCondition(op.Value)
+		case "$elemMatch":
+			if inner, ok := isOperatorDoc(op.Value); ok && inner[0].Key != "$and" && inner[0].Key != "$or" && inner[0].Key != "$nor" {
+				err = checkCondition(inner)
+			} else {
+				err = checkFilter(documentOf(op.Value))
+			}
+		default:
+			_, err = matchOperator(nil, op.Key, op.Value, options)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkExpression returns the first operator or system variable of expr the
+// evaluator does not support, every branch is visited
+func checkExpression(expr interface{}) error {
+	switch e := expr.(type) {
+	case Expression:
+		return checkExpression(e.Value())
+	case string:
+		if strings.HasPrefix(e, "$$") {
+			if _, err := (evalContext{}).variable(e[2:]); errors.Is(err, ErrUnsupported) {
+				return err
+			}
+		}
+	case bson.A, []interface{}:
+		for _, elem := range arrayOf(e) {
+			if err := checkExpression(elem); err != nil {
+				return err
+			}
+		}
+	case bson.D, bson.M:
+		d := documentOf(e)
+		if len(d) == 1 && strings.HasPrefix(d[0].Key, "$") {
+			if d[0].Key == "$literal" {
+				return nil
+			}
+			// variables bound by the operator are undeclared out of context,
+			// only the unsupported errors tell about the operator itself
+			if _, err := (evalContext{}).operator(d[0].Key, d[0].Value); errors.Is(err, ErrUnsupported) {
+				return err
+			}
+			return checkExpression(d[0].Value)
+		}
+		for _, field := range d {
+			if err := checkExpression(field.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// filterValues returns the values a filter on path compares against, arrays
+// of documents are traversed and numeric segments index arrays
+func filterValues(v interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{v}
+	}
+	if d := documentOf(v); d != nil {
+		for _, e := range d {
+			if e.Key == path[0] {
+				return filterValues(e.Value, path[1:])
+			}
+		}
+		return nil
+	}
+	arr := arrayOf(v)
+	if arr == nil {
+		return nil
+	}
+	var out []interface{}
+	if i, err := strconv.Atoi(path[0]); err == nil && i >= 0 && i < len(arr) {
+		out = append(out, filterValues(arr[i], path[1:])...)
+	}
+	for _, elem := range arr {
+		if documentOf(elem) != nil {
+			out = append(out, filterValues(elem, path)...)
+		}
+	}
+	return out
+}
+
+// isOperatorDoc reports whether v is a document of query operators
+func isOperatorDoc(v interface{}) (bson.D, bool) {
+	d := documentOf(v)
+	if len(d) == 0 {
+		return nil, false
+	}
+	for _, e := range d {
+		if !strings.HasPrefix(e.Key, "$") {
+			return nil, false
+		}
+	}
+	return d, true
+}
+
+// matchField reports whether the values of a field match a filter value
+func matchField(values []interface{}, cond interface{}) (bool, error) {
+	ops, ok := isOperatorDoc(cond)
+	if !ok {
+		if re, ok := cond.(primitive.Regex); ok {
+			return matchRegex(values, re)
+		}
+		return matchEq(values, cond), nil
+	}
+
+	var options string
+	for _, op := range ops {
+		if op.Key == "$options" {
+			options, _ = op.Value.(string)
+		}
+	}
+	for _, op := range ops {
+		ok, err := matchOperator(values, op.Key, op.Value, options)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// expand returns the values and the elements of the array values
+func expand(values []interface{}) []interface{} {
+	out := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		out = append(out, v)
+		out = append(out, arrayOf(v)...)
+	}
+	return out
+}
+
+func matchEq(values []interface{}, want interface{}) bool {
+	if want == nil && len(values) == 0 {
+		return true
+	}
+	for _, v := range expand(values) {
+		if typeOrder(v) == typeOrder(want) && compareValues(v, want) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOperator(values []interface{}, op string, arg interface{}, options string) (bool, error) {
+	switch op {
+	case "$eq":
+		return matchEq(values, arg), nil
+	case "$ne":
+		return !matchEq(values, arg), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, v := range expand(values) {
+			if typeOrder(v) != typeOrder(arg) {
+				continue
+			}
+			c := compareValues(v, arg)
+			if (op == "$gt" && c > 0) || (op == "$gte" && c >= 0) || (op == "$lt" && c < 0) || (op == "$lte" && c <= 0) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$in", "$nin":
+		arr := arrayOf(arg)
+		if arr == nil {
+			return false, fmt.Errorf("%w: %s needs an array", ErrInvalidFilter, op)
+		}
+		found := false
+		for _, want := range arr {
+			if re, ok := want.(primitive.Regex); ok {
+				if ok, _ := matchRegex(values, re); ok {
+					found = true
+				}
+			} else if matchEq(values, want) {
+				found = true
+			}
+		}
+		return found == (op == "$in"), nil
+	case "$exists":
+		return truthy(arg) == (len(values) > 0), nil
+	case "$size":
+		n, ok := intOf(arg)
+		if !ok {
+			return false, fmt.Errorf("%w: $size needs an integer", ErrInvalidFilter)
+		}
+		for _, v := range values {
+			if arr := arrayOf(v); arr != nil && int64(len(arr)) == n {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$all":
+		arr := arrayOf(arg)
+		if arr == nil {
+			return false, fmt.Errorf("%w: $all needs an array", ErrInvalidFilter)
+		}
+		for _, want := range arr {
+			if !matchEq(values, want) {
+				return false, nil
+			}
+		}
+		return len(arr) > 0, nil
+	case "$elemMatch":
+		for _, v := range values {
+			for _, elem := range arrayOf(v) {
+				ok, err := matchElem(elem, arg)
+				if err != nil {
+					return false, err
+				}
+				if ok {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "$regex":
+		re, ok := arg.(primitive.Regex)
+		if !ok {
+			s, isString := arg.(string)
+			if !isString {
+				return false, fmt.Errorf("%w: $regex needs a string", ErrInvalidFilter)
+			}
+			re = primitive.Regex{Pattern: s}
+		}
+		if options != "" {
+			re.Options = options
+		}
+		return matchRegex(values, re)
+	case "$options":
+		return true, nil
+	case "$not":
+		ok, err := matchField(values, arg)
+		return !ok, err
+	case "$mod":
+		arr := arrayOf(arg)
+		if len(arr) != 2 {
+			return false, fmt.Errorf("%w: $mod needs [ divisor, remainder ]", ErrInvalidFilter)
+		}
+		divisor, ok1 := toFloat(arr[0])
+		remainder, ok2 := toFloat(arr[1])
+		if !ok1 || !ok2 || divisor == 0 {
+			return false, fmt.Errorf("%w: $mod needs a non-zero divisor and a remainder", ErrInvalidFilter)
+		}
+		for _, v := range expand(values) {
+			if f, ok := toFloat(v); ok && math.Mod(math.Trunc(f), math.Trunc(divisor)) == math.Trunc(remainder) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$type":
+		kinds := arrayOf(arg)
+		if kinds == nil {
+			kinds = bson.A{arg}
+		}
+		for _, v := range expand(values) {
+			for _, kind := range kinds {
+				if typeMatches(v, kind) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: filter operator %s", ErrUnsupported, op)
+}
+
+// matchElem reports whether an array element matches an $elemMatch argument,
+// either operators applied to the element or a filter on its fields
+func matchElem(elem, arg interface{}) (bool, error) {
+	if ops, ok := isOperatorDoc(arg); ok && ops[0].Key != "$and" && ops[0].Key != "$or" && ops[0].Key != "$nor" {
+		return matchField([]interface{}{elem}, ops)
+	}
+	d := documentOf(elem)
+	if d == nil {
+		return false, nil
+	}
+	return matchDocument(d, documentOf(arg))
+}
+
+func matchRegex(values []interface{}, re primitive.Regex) (bool, error) {
+	flags := ""
+	for _, o := range re.Options {
+		switch o {
+		case 'i', 'm', 's':
+			flags += string(o)
+		case 'x', 'u':
+		default:
+			return false, fmt.Errorf("%w: regex option %q", ErrUnsupported, o)
+		}
+	}
+	pattern := re.Pattern
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+	}
+	for _, v := range expand(values) {
+		switch s := v.(type) {
+		case string:
+			if compiled.MatchString(s) {
+				return true, nil
+			}
+		case primitive.Regex:
+			if s == re {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// bsonTypeNames are the $type aliases by BSON type number
+var bsonTypeNames = map[int64]string{
+	1: "double", 2: "string", 3: "object", 4: "array", 5: "binData", 7: "objectId",
+	8: "bool", 9: "date", 10: "null", 11: "regex", 16: "int", 17: "timestamp",
+	18: "long", 19: "decimal", -1: "minKey", 127: "maxKey",
+}
+
+// typeName returns the $type alias of v, a Go int is an "int" when it fits in
+// an int32 as the driver encodes it so, and a "long" otherwise
+func typeName(v interface{}) string {
+	if i, ok := v.(int); ok {
+		if i >= math.MinInt32 && i <= math.MaxInt32 {
+			return "int"
+		}
+		return "long"
+	}
+	switch v.(type) {
+	case float32, float64:
+		return "double"
+	case string:
+		return "string"
+	case bson.D, bson.M, bson.Raw:
+		return "object"
+	case bson.A, []interface{}:
+		return "array"
+	case primitive.Binary, []byte:
+		return "binData"
+	case primitive.ObjectID:
+		return "objectId"
+	case bool:
+		return "bool"
+	case time.Time, primitive.DateTime:
+		return "date"
+	case nil, primitive.Null:
+		return "null"
+	case primitive.Regex:
+		return "regex"
+	case int8, int16, int32, uint8, uint16:
+		return "int"
+	case int64, uint32:
+		return "long"
+	case primitive.Timestamp:
+		return "timestamp"
+	case primitive.Decimal128:
+		return "decimal"
+	case primitive.MinKey:
+		return "minKey"
+	case primitive.MaxKey:
+		return "maxKey"
+	}
+	if arrayOf(v) != nil {
+		return "array"
+	}
+	return "missing"
+}
+
+func typeMatches(v, kind interface{}) bool {
+	name, ok := kind.(string)
+	if !ok {
+		n, isInt := intOf(kind)
+		if !isInt {
+			return false
+		}
+		name = bsonTypeNames[n]
+	}
+	if name == "number" {
+		return typeOrder(v) == 3
+	}
+	return typeName(v) == name
+}
@@ -0,0 +1,117 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFilterDocMatches(t *testing.T) {
+	doc := bson.D{
+		{Key: "name", Value: "hamster"},
+		{Key: "age", Value: int32(3)},
+		{Key: "tags", Value: bson.A{"small", "cute"}},
+		{Key: "scores", Value: bson.A{int32(70), int32(95)}},
+		{Key: "address", Value: bson.D{{Key: "city", Value: "Paris"}}},
+		{Key: "toys", Value: bson.A{
+			bson.D{{Key: "kind", Value: "wheel"}, {Key: "price", Value: 12.5}},
+			bson.D{{Key: "kind", Value: "ball"}, {Key: "price", Value: 3.0}},
+		}},
+		{Key: "owner", Value: nil},
+	}
+
+	matching := map[string]filterDoc{
+		"eq":           FilterDocBuilder.Eq("name", "hamster").Doc(),
+		"eq-number":    FilterDocBuilder.Eq("age", 3).Doc(),
+		"eq-element":   FilterDocBuilder.Eq("tags", "cute").Doc(),
+		"eq-array":     FilterDocBuilder.Eq("tags", bson.A{"small", "cute"}).Doc(),
+		"nested":       FilterDocBuilder.Eq("address.city", "Paris").Doc(),
+		"array-path":   FilterDocBuilder.Eq("toys.kind", "ball").Doc(),
+		"index-path":   FilterDocBuilder.Eq("toys.0.kind", "wheel").Doc(),
+		"null":         FilterDocBuilder.Eq("owner", nil).Doc(),
+		"null-missing": FilterDocBuilder.Eq("missing", nil).Doc(),
+		"gt":           FilterDocBuilder.Gt("age", 2).GtE("age", 3).Lt("age", 4.5).LtE("age", int64(3)).Doc(),
+		"gt-element":   FilterDocBuilder.Gt("scores", 90).Doc(),
+		"ne":           FilterDocBuilder.Ne("name", "mouse").Doc(),
+		"in":           FilterDocBuilder.In("tags", bson.A{"big", "cute"}).Doc(),
+		"nin":          FilterDocBuilder.Nin("name", bson.A{"mouse"}).Doc(),
+		"exists":       FilterDocBuilder.Exists("owner").Doc(),
+		"size":         FilterDocBuilder.Size("tags", 2).Doc(),
+		"all":          FilterDocBuilder.All("tags", []interface{}{"cute", "small"}).Doc(),
+		"elem-match": FilterDocBuilder.ElemMatch("toys", bson.D{
+			{Key: "kind", Value: "ball"}, {Key: "price", Value: bson.D{{Key: "$lt", Value: 5}}},
+		}).Doc(),
+		"elem-match-values": FilterDocBuilder.ElemMatch("scores", bson.D{{Key: "$gt", Value: 90}}).Doc(),
+		"regex":             FilterDocBuilder.Regex("name", "^HAM", "i").Doc(),
+		"mod":               FilterDocBuilder.Mod("age", 2, 1).Doc(),
+		"type":              FilterDocBuilder.Type("age", "int").Type("name", "string").Doc(),
+		"and":               FilterDocBuilder.And(FilterDocBuilder.Eq("age", 3).Doc(), FilterDocBuilder.Eq("name", "hamster").Doc()).Doc(),
+		"or":                FilterDocBuilder.Or(FilterDocBuilder.Eq("age", 4).Doc(), FilterDocBuilder.Eq("name", "hamster").Doc()).Doc(),
+		"nor":               FilterDocBuilder.Nor(FilterDocBuilder.Eq("age", 4).Doc()).Doc(),
+		"expr":              FilterDocBuilder.Expr(Expr.Gt(Expr.Size("$tags"), 1)).Doc(),
+		"regex-value":       FilterDocBuilder.Eq("name", primitive.Regex{Pattern: "ster$"}).Doc(),
+		"not":               FilterDocBuilder.Eq("age", bson.D{{Key: "$not", Value: bson.D{{Key: "$gt", Value: 5}}}}).Doc(),
+	}
+	for name, filter := range matching {
+		ok, err := filter.Matches(doc)
+		require.NoError(t, err, name)
+		require.True(t, ok, name)
+	}
+
+	failing := map[string]filterDoc{
+		"eq":            FilterDocBuilder.Eq("name", "mouse").Doc(),
+		"type-bracket":  FilterDocBuilder.Gt("name", 1).Doc(),
+		"missing":       FilterDocBuilder.Eq("missing", 1).Doc(),
+		"not-null":      FilterDocBuilder.Ne("missing", nil).Doc(),
+		"exists":        FilterDocBuilder.Exists("missing").Doc(),
+		"size":          FilterDocBuilder.Size("tags", 3).Doc(),
+		"all":           FilterDocBuilder.All("tags", []interface{}{"cute", "big"}).Doc(),
+		"elem-match":    FilterDocBuilder.ElemMatch("toys", bson.D{{Key: "kind", Value: "ball"}, {Key: "price", Value: 12.5}}).Doc(),
+		"regex":         FilterDocBuilder.Regex("name", "^HAM", "").Doc(),
+		"nested-array":  FilterDocBuilder.Eq("toys.price", 4).Doc(),
+		"nor":           FilterDocBuilder.Nor(FilterDocBuilder.Eq("age", 3).Doc()).Doc(),
+		"second-clause": FilterDocBuilder.Eq("name", "hamster").Eq("age", 4).Doc(),
+	}
+	for name, filter := range failing {
+		ok, err := filter.Matches(doc)
+		require.NoError(t, err, name)
+		require.False(t, ok, name)
+	}
+
+	// a Go int is an int32 when it fits, as the driver encodes it
+	ints := bson.D{{Key: "n", Value: 5}, {Key: "big", Value: 1 << 40}}
+	ok, err := FilterDocBuilder.Type("n", "int").Type("big", "long").Doc().Matches(ints)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Go typed slices are arrays, as once stored
+	typed := bson.D{
+		{Key: "tags", Value: []string{"go", "db"}},
+		{Key: "scores", Value: []int{70, 95}},
+		{Key: "toys", Value: []bson.D{{{Key: "kind", Value: "ball"}}}},
+		{Key: "raw", Value: []byte("go")},
+	}
+	matchingTyped := map[string]filterDoc{
+		"eq-element": FilterDocBuilder.Eq("tags", "go").Doc(),
+		"eq-array":   FilterDocBuilder.Eq("tags", bson.A{"go", "db"}).Doc(),
+		"gt-element": FilterDocBuilder.Gt("scores", 90).Doc(),
+		"array-path": FilterDocBuilder.Eq("toys.kind", "ball").Doc(),
+		"size":       FilterDocBuilder.Size("scores", 2).Doc(),
+		"type":       FilterDocBuilder.Type("tags", "array").Type("raw", "binData").Doc(),
+	}
+	for name, filter := range matchingTyped {
+		ok, err := filter.Matches(typed)
+		require.NoError(t, err, name)
+		require.True(t, ok, name)
+	}
+
+	_, err = FilterDocBuilder.Text("hamster", nil).Doc().Matches(doc)
+	require.True(t, errors.Is(err, ErrUnsupported))
+	_, err = FilterDocBuilder.Near("loc", Point{Lng: 1, Lat: 1}).Doc().Matches(doc)
+	require.True(t, errors.Is(err, ErrUnsupported))
+	_, err = FilterDocBuilder.Near("loc", square).Doc().Matches(doc)
+	require.True(t, errors.Is(err, ErrInvalidGeometry))
+}
@@ -1,6 +1,7 @@
 package hamster
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -168,6 +169,29 @@ func TestFilterDocLogic(t *testing.T) {
 	require.ElementsMatch(t, norDoc.ToD(), norBson)
 }
 
+func TestFilterDocLogicDocuments(t *testing.T) {
+	mixed := FilterDocBuilder.And(
+		FilterDocBuilder.Eq("a", 1),
+		bson.D{{Key: "b", Value: 2}},
+		bson.M{"d": 4, "c": 3},
+	).Doc()
+	require.NoError(t, mixed.Err())
+	require.EqualValues(t, bson.D{{Key: "$and", Value: []bson.D{
+		{{Key: "a", Value: 1}},
+		{{Key: "b", Value: 2}},
+		{{Key: "c", Value: 3}, {Key: "d", Value: 4}},
+	}}}, mixed.ToD())
+
+	not := FilterDocBuilder.Not(bson.M{"a": 1}).Doc()
+	require.EqualValues(t, bson.D{{Key: "$not", Value: bson.D{{Key: "a", Value: 1}}}}, not.ToD())
+
+	nested := FilterDocBuilder.Or(FilterDocBuilder.Near("loc", Point{Lat: 100})).Doc()
+	require.True(t, errors.Is(nested.Err(), ErrInvalidGeometry))
+
+	invalid := FilterDocBuilder.Nor(bson.D{{Key: "a", Value: 1}}, 42).Doc()
+	require.True(t, errors.Is(invalid.Err(), ErrInvalidFilter))
+}
+
 func TestFilterDocArrays(t *testing.T) {
 	// $all
 	// { tags: { $all: [ "ssl" , "security" ] } }
@@ -459,3 +483,101 @@ func TestFilterDocGeo(t *testing.T) {
 	}}
 	require.ElementsMatch(t, geoWithinDoc.ToD(), geoWithinBson)
 }
+
+func TestFilterDocGeometry(t *testing.T) {
+	// { loc: { $geoWithin: { $geometry: { type: "Polygon", coordinates: [ ... ] } } } }
+	doc := FilterDocBuilder.GeoWithin("loc", square).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "loc", Value: bson.D{{Key: "$geoWithin",
+		Value: bson.D{{Key: "$geometry", Value: square.ToD()}}}}}}, doc.ToD())
+
+	// { loc: { $geoIntersects: { $geometry: { type: "LineString", coordinates: [ [ 0, 0 ], [ 1, 1 ] ] } } } }
+	line := LineString{{Lng: 0, Lat: 0}, {Lng: 1, Lat: 1}}
+	doc = FilterDocBuilder.GeoIntersects("loc", line).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "loc", Value: bson.D{{Key: "$geoIntersects",
+		Value: bson.D{{Key: "$geometry", Value: line.ToD()}}}}}}, doc.ToD())
+
+	// { loc: { $near: { $geometry: { type: "Point", coordinates: [ -73.97, 40.77 ] } } } }
+	point := Point{Lng: -73.97, Lat: 40.77}
+	doc = FilterDocBuilder.Near("loc", point).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "loc", Value: bson.D{{Key: "$near",
+		Value: bson.D{{Key: "$geometry", Value: point.ToD()}}}}}}, doc.ToD())
+
+	// { loc: { $near: [ -73.97, 40.77 ] } }
+	doc = FilterDocBuilder.Near("loc", LegacyPoint{X: -73.97, Y: 40.77}).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "loc", Value: bson.D{{Key: "$near", Value: bson.A{-73.97, 40.77}}}}}, doc.ToD())
+
+	require.True(t, errors.Is(FilterDocBuilder.GeoWithin("loc", point).Doc().Err(), ErrInvalidGeometry))
+	require.True(t, errors.Is(FilterDocBuilder.Near("loc", line).Doc().Err(), ErrInvalidGeometry))
+	require.True(t, errors.Is(FilterDocBuilder.GeoIntersects("loc", Point{Lat: 100}).Doc().Err(), ErrInvalidGeometry))
+	require.True(t, errors.Is(FilterDocBuilder.GeoIntersects("loc", "x").Doc().Err(), ErrInvalidGeometry))
+
+	// errors of nested filters are kept
+	doc = FilterDocBuilder.Or(FilterDocBuilder.Near("loc", line).Doc()).Doc()
+	require.True(t, errors.Is(doc.Err(), ErrInvalidGeometry))
+	_, err := bson.Marshal(doc)
+	require.Error(t, err)
+}
+
+func TestFilterDocNear(t *testing.T) {
+	point := Point{Lng: -73.9667, Lat: 40.78}
+	minDistance, maxDistance := Meters(1000), Kilometers(5)
+
+	// { location: { $near: { $geometry: { type: "Point", coordinates: [ -73.9667, 40.78 ] }, $minDistance: 1000, $maxDistance: 5000 } } }
+	doc := FilterDocBuilder.NearWithOptions("location", point, &FilterDocNearOptions{
+		MinDistance: &minDistance,
+		MaxDistance: &maxDistance,
+	}).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "location", Value: bson.D{{Key: "$near", Value: bson.D{
+		{Key: "$geometry", Value: bson.D{{Key: "type", Value: "Point"}, {Key: "coordinates", Value: bson.A{-73.9667, 40.78}}}},
+		{Key: "$minDistance", Value: 1000.0},
+		{Key: "$maxDistance", Value: 5000.0},
+	}}}}}, doc.ToD())
+
+	// { location: { $nearSphere: { $geometry: { type: "Point", coordinates: [ -73.9667, 40.78 ] }, $maxDistance: 5000 } } }
+	doc = FilterDocBuilder.NearSphere("location", point, &FilterDocNearOptions{MaxDistance: &maxDistance}).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "location", Value: bson.D{{Key: "$nearSphere", Value: bson.D{
+		{Key: "$geometry", Value: bson.D{{Key: "type", Value: "Point"}, {Key: "coordinates", Value: bson.A{-73.9667, 40.78}}}},
+		{Key: "$maxDistance", Value: 5000.0},
+	}}}}}, doc.ToD())
+
+	// { location: { $nearSphere: [ -73.9667, 40.78 ], $minDistance: 1000 / 6378100, $maxDistance: 5000 / 6378100 } }
+	legacy := LegacyPoint{X: -73.9667, Y: 40.78}
+	doc = FilterDocBuilder.NearSphere("location", legacy, &FilterDocNearOptions{
+		MinDistance: &minDistance,
+		MaxDistance: &maxDistance,
+	}).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "location", Value: bson.D{
+		{Key: "$nearSphere", Value: bson.A{-73.9667, 40.78}},
+		{Key: "$minDistance", Value: 1000 / EarthRadiusMeters},
+		{Key: "$maxDistance", Value: 5000 / EarthRadiusMeters},
+	}}}, doc.ToD())
+
+	// { location: { $near: [ -73.9667, 40.78 ], $maxDistance: 5000 / 6378100 } }
+	doc = FilterDocBuilder.NearWithOptions("location", legacy, &FilterDocNearOptions{MaxDistance: &maxDistance}).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "location", Value: bson.D{
+		{Key: "$near", Value: bson.A{-73.9667, 40.78}},
+		{Key: "$maxDistance", Value: 5000 / EarthRadiusMeters},
+	}}}, doc.ToD())
+
+	// { location: { $nearSphere: [ -73.9667, 40.78 ] } }
+	doc = FilterDocBuilder.NearSphere("location", legacy, nil).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "location", Value: bson.D{{Key: "$nearSphere", Value: bson.A{-73.9667, 40.78}}}}}, doc.ToD())
+
+	negative := Meters(-1)
+	require.True(t, errors.Is(FilterDocBuilder.NearSphere("location", point,
+		&FilterDocNearOptions{MinDistance: &negative}).Doc().Err(), ErrInvalidFilter))
+	require.True(t, errors.Is(FilterDocBuilder.NearSphere("location", point,
+		&FilterDocNearOptions{MinDistance: &maxDistance, MaxDistance: &minDistance}).Doc().Err(), ErrInvalidFilter))
+	require.True(t, errors.Is(FilterDocBuilder.NearWithOptions("location", bson.D{},
+		&FilterDocNearOptions{MaxDistance: &maxDistance}).Doc().Err(), ErrInvalidFilter))
+	require.True(t, errors.Is(FilterDocBuilder.NearSphere("location", square, nil).Doc().Err(), ErrInvalidGeometry))
+}
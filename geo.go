@@ -0,0 +1,252 @@
+package hamster
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrInvalidGeometry is returned when a GeoJSON geometry is malformed
+var ErrInvalidGeometry = errors.New("hamster: invalid geometry")
+
+// Geometry is a GeoJSON geometry object
+// https://www.mongodb.com/docs/manual/reference/geojson/
+type Geometry interface {
+	Bsoner
+	// Validate reports the first problem of the geometry
+	Validate() error
+}
+
+// Point is a GeoJSON Point, also used as a position of the other geometries
+// { type: "Point", coordinates: [ <lng>, <lat> ] }
+type Point struct {
+	Lng float64
+	Lat float64
+}
+
+// LineString is a GeoJSON LineString of two or more positions
+type LineString []Point
+
+// Polygon is a GeoJSON Polygon, the first ring is the exterior ring and the
+// others are holes. Rings must be closed, either winding is accepted as the
+// server does for polygons smaller than a hemisphere, ParseGeometry winds them
+// the RFC 7946 way
+type Polygon [][]Point
+
+// MultiPoint is a GeoJSON MultiPoint
+type MultiPoint []Point
+
+// MultiPolygon is a GeoJSON MultiPolygon
+type MultiPolygon []Polygon
+
+// GeometryCollection is a GeoJSON GeometryCollection
+type GeometryCollection []Geometry
+
+// LegacyPoint is a legacy coordinate pair, [ <x>, <y> ]
+type LegacyPoint struct {
+	X float64
+	Y float64
+}
+
+// ToA convert LegacyPoint to a bson.A coordinate pair
+func (p LegacyPoint) ToA() bson.A {
+	return bson.A{p.X, p.Y}
+}
+
+func geometryD(kind string, coordinates interface{}) bson.D {
+	return bson.D{{Key: "type", Value: kind}, {Key: "coordinates", Value: coordinates}}
+}
+
+func pointsA(points []Point) bson.A {
+	arr := make(bson.A, 0, len(points))
+	for _, p := range points {
+		arr = append(arr, p.coordinates())
+	}
+	return arr
+}
+
+func ringsA(rings [][]Point) bson.A {
+	arr := make(bson.A, 0, len(rings))
+	for _, ring := range rings {
+		arr = append(arr, pointsA(ring))
+	}
+	return arr
+}
+
+func (p Point) coordinates() bson.A {
+	return bson.A{p.Lng, p.Lat}
+}
+
+// ToD convert Point to a bson.D GeoJSON document
+func (p Point) ToD() bson.D {
+	return geometryD("Point", p.coordinates())
+}
+
+// ToM convert Point to a bson.M GeoJSON document
+func (p Point) ToM() bson.M {
+	return p.ToD().Map()
+}
+
+// Validate checks the longitude and latitude ranges
+func (p Point) Validate() error {
+	if math.IsNaN(p.Lng) || math.IsNaN(p.Lat) {
+		return fmt.Errorf("%w: position [%v, %v] is not a number", ErrInvalidGeometry, p.Lng, p.Lat)
+	}
+	if p.Lng < -180 || p.Lng > 180 {
+		return fmt.Errorf("%w: longitude %v out of [-180, 180]", ErrInvalidGeometry, p.Lng)
+	}
+	if p.Lat < -90 || p.Lat > 90 {
+		return fmt.Errorf("%w: latitude %v out of [-90, 90]", ErrInvalidGeometry, p.Lat)
+	}
+	return nil
+}
+
+func validatePoints(points []Point) error {
+	for _, p := range points {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ToD convert LineString to a bson.D GeoJSON document
+func (l LineString) ToD() bson.D {
+	return geometryD("LineString", pointsA(l))
+}
+
+// ToM convert LineString to a bson.M GeoJSON document
+func (l LineString) ToM() bson.M {
+	return l.ToD().Map()
+}
+
+// Validate checks the LineString has at least two valid positions
+func (l LineString) Validate() error {
+	if len(l) < 2 {
+		return fmt.Errorf("%w: LineString needs at least 2 positions, got %d", ErrInvalidGeometry, len(l))
+	}
+	return validatePoints(l)
+}
+
+// ToD convert Polygon to a bson.D GeoJSON document
+func (p Polygon) ToD() bson.D {
+	return geometryD("Polygon", ringsA(p))
+}
+
+// ToM convert Polygon to a bson.M GeoJSON document
+func (p Polygon) ToM() bson.M {
+	return p.ToD().Map()
+}
+
+// Validate checks every ring is closed, has at least four positions and an area
+func (p Polygon) Validate() error {
+	if len(p) == 0 {
+		return fmt.Errorf("%w: Polygon needs an exterior ring", ErrInvalidGeometry)
+	}
+	for i, ring := range p {
+		if len(ring) < 4 {
+			return fmt.Errorf("%w: Polygon ring %d needs at least 4 positions, got %d", ErrInvalidGeometry, i, len(ring))
+		}
+		if err := validatePoints(ring); err != nil {
+			return err
+		}
+		if ring[0] != ring[len(ring)-1] {
+			return fmt.Errorf("%w: Polygon ring %d is not closed", ErrInvalidGeometry, i)
+		}
+		if ringArea(ring) == 0 {
+			return fmt.Errorf("%w: Polygon ring %d has no area", ErrInvalidGeometry, i)
+		}
+	}
+	return nil
+}
+
+// ringArea returns twice the signed area of a closed ring,
+// positive when the ring is counterclockwise
+func ringArea(ring []Point) float64 {
+	var area float64
+	for i := 0; i < len(ring)-1; i++ {
+		area += ring[i].Lng*ring[i+1].Lat - ring[i+1].Lng*ring[i].Lat
+	}
+	return area
+}
+
+// ToD convert MultiPoint to a bson.D GeoJSON document
+func (m MultiPoint) ToD() bson.D {
+	return geometryD("MultiPoint", pointsA(m))
+}
+
+// ToM convert MultiPoint to a bson.M GeoJSON document
+func (m MultiPoint) ToM() bson.M {
+	return m.ToD().Map()
+}
+
+// Validate checks the MultiPoint has at least one valid position
+func (m MultiPoint) Validate() error {
+	if len(m) == 0 {
+		return fmt.Errorf("%w: MultiPoint needs at least 1 position", ErrInvalidGeometry)
+	}
+	return validatePoints(m)
+}
+
+// ToD convert MultiPolygon to a bson.D GeoJSON document
+func (m MultiPolygon) ToD() bson.D {
+	arr := make(bson.A, 0, len(m))
+	for _, p := range m {
+		arr = append(arr, ringsA(p))
+	}
+	return geometryD("MultiPolygon", arr)
+}
+
+// ToM convert MultiPolygon to a bson.M GeoJSON document
+func (m MultiPolygon) ToM() bson.M {
+	return m.ToD().Map()
+}
+
+// Validate checks the MultiPolygon has at least one polygon and all of them are valid
+func (m MultiPolygon) Validate() error {
+	if len(m) == 0 {
+		return fmt.Errorf("%w: MultiPolygon needs at least 1 polygon", ErrInvalidGeometry)
+	}
+	for _, p := range m {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ToD convert GeometryCollection to a bson.D GeoJSON document, nil geometries
+// are left out and reported by Validate
+// { type: "GeometryCollection", geometries: [ <geometry>, ... ] }
+func (g GeometryCollection) ToD() bson.D {
+	arr := make(bson.A, 0, len(g))
+	for _, geometry := range g {
+		if geometry != nil {
+			arr = append(arr, geometry.ToD())
+		}
+	}
+	return bson.D{{Key: "type", Value: "GeometryCollection"}, {Key: "geometries", Value: arr}}
+}
+
+// ToM convert GeometryCollection to a bson.M GeoJSON document
+func (g GeometryCollection) ToM() bson.M {
+	return g.ToD().Map()
+}
+
+// Validate checks the collection has at least one geometry and all of them are valid
+func (g GeometryCollection) Validate() error {
+	if len(g) == 0 {
+		return fmt.Errorf("%w: GeometryCollection needs at least 1 geometry", ErrInvalidGeometry)
+	}
+	for _, geometry := range g {
+		if geometry == nil {
+			return fmt.Errorf("%w: GeometryCollection contains a nil geometry", ErrInvalidGeometry)
+		}
+		if err := geometry.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
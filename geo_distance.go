@@ -0,0 +1,56 @@
+package hamster
+
+// EarthRadiusMeters is the equatorial radius the server uses to convert
+// between meters and radians
+const EarthRadiusMeters = 6378100.0
+
+const (
+	metersPerKilometer = 1000.0
+	metersPerMile      = 1609.344
+)
+
+// Distance is a length on the earth surface, stored in meters.
+// Build it with Meters, Kilometers or Miles and read it in the unit the
+// query expects: Meters for GeoJSON $maxDistance and $minDistance,
+// Radians for $centerSphere and legacy spherical queries
+type Distance float64
+
+// Meters returns a Distance of m meters
+func Meters(m float64) Distance {
+	return Distance(m)
+}
+
+// Kilometers returns a Distance of km kilometers
+func Kilometers(km float64) Distance {
+	return Distance(km * metersPerKilometer)
+}
+
+// Miles returns a Distance of mi miles
+func Miles(mi float64) Distance {
+	return Distance(mi * metersPerMile)
+}
+
+// Radians returns a Distance of r radians of the earth radius
+func Radians(r float64) Distance {
+	return Distance(r * EarthRadiusMeters)
+}
+
+// Meters returns d in meters
+func (d Distance) Meters() float64 {
+	return float64(d)
+}
+
+// Kilometers returns d in kilometers
+func (d Distance) Kilometers() float64 {
+	return float64(d) / metersPerKilometer
+}
+
+// Miles returns d in miles
+func (d Distance) Miles() float64 {
+	return float64(d) / metersPerMile
+}
+
+// Radians returns d as an angle in radians
+func (d Distance) Radians() float64 {
+	return float64(d) / EarthRadiusMeters
+}
@@ -0,0 +1,25 @@
+package hamster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestDistance(t *testing.T) {
+	// the server documentation divides by 6378.1 km and 3963.2 miles
+	require.InDelta(t, 5/6378.1, Kilometers(5).Radians(), 1e-12)
+	require.InDelta(t, 100/3963.2, Miles(100).Radians(), 1e-6)
+	require.InDelta(t, 2000.0, Meters(2000).Meters(), 1e-9)
+	require.InDelta(t, 3218.688, Miles(2).Meters(), 1e-9)
+	require.InDelta(t, 1.5, Kilometers(1.5).Kilometers(), 1e-12)
+	require.InDelta(t, 2.0, Miles(2).Miles(), 1e-12)
+	require.InDelta(t, 0.25, Radians(0.25).Radians(), 1e-12)
+	require.InDelta(t, 6378.1, Radians(1).Kilometers(), 1e-9)
+
+	// { loc: { $geoWithin: { $centerSphere: [ [ -88, 30 ], 10 / 3963.2 ] } } }
+	doc := FilterDocBuilder.GeoWithCenterSphere("loc", -88, 30, Miles(10).Radians()).Doc()
+	centerSphere := doc.ToD()[0].Value.(bson.D)[0].Value.(bson.D)[0].Value.(bson.A)
+	require.InDelta(t, 10/3963.2, centerSphere[1], 1e-6)
+}
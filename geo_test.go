@@ -0,0 +1,76 @@
+package hamster
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// square is a counterclockwise unit square with a clockwise hole
+var square = Polygon{
+	{{Lng: 0, Lat: 0}, {Lng: 10, Lat: 0}, {Lng: 10, Lat: 10}, {Lng: 0, Lat: 10}, {Lng: 0, Lat: 0}},
+	{{Lng: 2, Lat: 2}, {Lng: 2, Lat: 8}, {Lng: 8, Lat: 8}, {Lng: 8, Lat: 2}, {Lng: 2, Lat: 2}},
+}
+
+func TestGeometryToD(t *testing.T) {
+	// { type: "Point", coordinates: [ -73.97, 40.77 ] }
+	point := Point{Lng: -73.97, Lat: 40.77}
+	require.EqualValues(t, bson.D{{Key: "type", Value: "Point"}, {Key: "coordinates", Value: bson.A{-73.97, 40.77}}}, point.ToD())
+	require.EqualValues(t, bson.M{"type": "Point", "coordinates": bson.A{-73.97, 40.77}}, point.ToM())
+
+	line := LineString{{Lng: 40, Lat: 5}, {Lng: 41, Lat: 6}}
+	require.EqualValues(t, bson.D{{Key: "type", Value: "LineString"},
+		{Key: "coordinates", Value: bson.A{bson.A{40.0, 5.0}, bson.A{41.0, 6.0}}}}, line.ToD())
+
+	require.EqualValues(t, bson.D{{Key: "type", Value: "Polygon"}, {Key: "coordinates", Value: bson.A{
+		bson.A{bson.A{0.0, 0.0}, bson.A{10.0, 0.0}, bson.A{10.0, 10.0}, bson.A{0.0, 10.0}, bson.A{0.0, 0.0}},
+		bson.A{bson.A{2.0, 2.0}, bson.A{2.0, 8.0}, bson.A{8.0, 8.0}, bson.A{8.0, 2.0}, bson.A{2.0, 2.0}},
+	}}}, square.ToD())
+
+	multiPoint := MultiPoint{{Lng: 1, Lat: 2}}
+	require.EqualValues(t, bson.D{{Key: "type", Value: "MultiPoint"}, {Key: "coordinates", Value: bson.A{bson.A{1.0, 2.0}}}}, multiPoint.ToD())
+
+	multiPolygon := MultiPolygon{square[:1]}
+	require.EqualValues(t, bson.D{{Key: "type", Value: "MultiPolygon"}, {Key: "coordinates", Value: bson.A{
+		bson.A{bson.A{bson.A{0.0, 0.0}, bson.A{10.0, 0.0}, bson.A{10.0, 10.0}, bson.A{0.0, 10.0}, bson.A{0.0, 0.0}}},
+	}}}, multiPolygon.ToD())
+
+	collection := GeometryCollection{point, line}
+	require.EqualValues(t, bson.D{{Key: "type", Value: "GeometryCollection"},
+		{Key: "geometries", Value: bson.A{point.ToD(), line.ToD()}}}, collection.ToD())
+	require.NoError(t, collection.Validate())
+	// nil geometries are left out rather than panicking
+	require.EqualValues(t, collection.ToD(), GeometryCollection{nil, point, line}.ToD())
+
+	require.EqualValues(t, bson.A{-73.97, 40.77}, LegacyPoint{X: -73.97, Y: 40.77}.ToA())
+}
+
+func TestGeometryValidate(t *testing.T) {
+	require.NoError(t, square.Validate())
+	require.NoError(t, MultiPolygon{square}.Validate())
+	// either winding is accepted, as the server does
+	require.NoError(t, Polygon{square[1]}.Validate())
+	require.NoError(t, Polygon{square[0], square[0]}.Validate())
+
+	cases := map[string]Geometry{
+		"longitude":      Point{Lng: 181, Lat: 0},
+		"latitude":       Point{Lng: 0, Lat: -91},
+		"short-line":     LineString{{Lng: 0, Lat: 0}},
+		"no-ring":        Polygon{},
+		"short-ring":     Polygon{{{Lng: 0, Lat: 0}, {Lng: 1, Lat: 0}, {Lng: 0, Lat: 0}}},
+		"open-ring":      Polygon{{{Lng: 0, Lat: 0}, {Lng: 1, Lat: 0}, {Lng: 1, Lat: 1}, {Lng: 0, Lat: 1}}},
+		"nan":            Point{Lng: math.NaN(), Lat: 0},
+		"nil-in-coll":    GeometryCollection{Point{}, nil},
+		"flat-ring":      Polygon{{{Lng: 0, Lat: 0}, {Lng: 1, Lat: 0}, {Lng: 2, Lat: 0}, {Lng: 0, Lat: 0}}},
+		"empty-multi":    MultiPoint{},
+		"bad-multi":      MultiPolygon{Polygon{}},
+		"empty-coll":     GeometryCollection{},
+		"nested-invalid": GeometryCollection{Point{Lng: 200}},
+	}
+	for name, g := range cases {
+		require.True(t, errors.Is(g.Validate(), ErrInvalidGeometry), name)
+	}
+}
@@ -0,0 +1,242 @@
+package hamster
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// geoJSONObject is any RFC 7946 GeoJSON object
+type geoJSONObject struct {
+	Type        string            `json:"type"`
+	Coordinates json.RawMessage   `json:"coordinates"`
+	Geometries  []json.RawMessage `json:"geometries"`
+	Geometry    json.RawMessage   `json:"geometry"`
+	Features    []json.RawMessage `json:"features"`
+}
+
+// ParseGeometry parses a RFC 7946 GeoJSON geometry object, altitudes are
+// dropped, polygon rings are turned counterclockwise for exteriors and
+// clockwise for holes as RFC 7946 asks parsers to accept either winding,
+// and the geometry is validated
+func ParseGeometry(data []byte) (Geometry, error) {
+	var obj geoJSONObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidGeometry, err)
+	}
+	g, err := obj.geometry()
+	if err != nil {
+		return nil, err
+	}
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// ParseGeoJSON parses a RFC 7946 GeoJSON geometry, Feature or FeatureCollection
+// and returns its geometries, features without a geometry are skipped
+func ParseGeoJSON(data []byte) ([]Geometry, error) {
+	var obj geoJSONObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidGeometry, err)
+	}
+
+	var geometries []Geometry
+	switch obj.Type {
+	case "Feature":
+		g, err := parseFeature(data)
+		if err != nil {
+			return nil, err
+		}
+		if g != nil {
+			geometries = append(geometries, g)
+		}
+	case "FeatureCollection":
+		for _, feature := range obj.Features {
+			g, err := parseFeature(feature)
+			if err != nil {
+				return nil, err
+			}
+			if g != nil {
+				geometries = append(geometries, g)
+			}
+		}
+	default:
+		g, err := ParseGeometry(data)
+		if err != nil {
+			return nil, err
+		}
+		geometries = append(geometries, g)
+	}
+	if len(geometries) == 0 {
+		return nil, fmt.Errorf("%w: GeoJSON %s has no geometry", ErrInvalidGeometry, obj.Type)
+	}
+	return geometries, nil
+}
+
+func parseFeature(data []byte) (Geometry, error) {
+	var obj geoJSONObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidGeometry, err)
+	}
+	if obj.Type != "Feature" {
+		return nil, fmt.Errorf("%w: expected a Feature, got %q", ErrInvalidGeometry, obj.Type)
+	}
+	if len(obj.Geometry) == 0 || string(obj.Geometry) == "null" {
+		return nil, nil
+	}
+	return ParseGeometry(obj.Geometry)
+}
+
+func (obj geoJSONObject) geometry() (Geometry, error) {
+	switch obj.Type {
+	case "Point":
+		var c []float64
+		if err := obj.decode(&c); err != nil {
+			return nil, err
+		}
+		return position(c)
+	case "LineString":
+		var c [][]float64
+		if err := obj.decode(&c); err != nil {
+			return nil, err
+		}
+		points, err := positions(c)
+		return LineString(points), err
+	case "MultiPoint":
+		var c [][]float64
+		if err := obj.decode(&c); err != nil {
+			return nil, err
+		}
+		points, err := positions(c)
+		return MultiPoint(points), err
+	case "Polygon":
+		var c [][][]float64
+		if err := obj.decode(&c); err != nil {
+			return nil, err
+		}
+		return polygon(c)
+	case "MultiPolygon":
+		var c [][][][]float64
+		if err := obj.decode(&c); err != nil {
+			return nil, err
+		}
+		m := make(MultiPolygon, 0, len(c))
+		for _, rings := range c {
+			p, err := polygon(rings)
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, p)
+		}
+		return m, nil
+	case "GeometryCollection":
+		collection := make(GeometryCollection, 0, len(obj.Geometries))
+		for _, raw := range obj.Geometries {
+			var sub geoJSONObject
+			if err := json.Unmarshal(raw, &sub); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidGeometry, err)
+			}
+			g, err := sub.geometry()
+			if err != nil {
+				return nil, err
+			}
+			collection = append(collection, g)
+		}
+		return collection, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown GeoJSON geometry type %q", ErrInvalidGeometry, obj.Type)
+	}
+}
+
+func (obj geoJSONObject) decode(v interface{}) error {
+	if len(obj.Coordinates) == 0 {
+		return fmt.Errorf("%w: GeoJSON %s has no coordinates", ErrInvalidGeometry, obj.Type)
+	}
+	if err := json.Unmarshal(obj.Coordinates, v); err != nil {
+		return fmt.Errorf("%w: GeoJSON %s coordinates: %v", ErrInvalidGeometry, obj.Type, err)
+	}
+	return nil
+}
+
+func position(c []float64) (Point, error) {
+	if len(c) < 2 {
+		return Point{}, fmt.Errorf("%w: GeoJSON position needs 2 numbers, got %d", ErrInvalidGeometry, len(c))
+	}
+	return Point{Lng: c[0], Lat: c[1]}, nil
+}
+
+func positions(c [][]float64) ([]Point, error) {
+	points := make([]Point, 0, len(c))
+	for _, p := range c {
+		point, err := position(p)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+func polygon(c [][][]float64) (Polygon, error) {
+	p := make(Polygon, 0, len(c))
+	for _, ring := range c {
+		points, err := positions(ring)
+		if err != nil {
+			return nil, err
+		}
+		// zero area rings are left to Validate
+		if area := ringArea(points); (len(p) == 0 && area < 0) || (len(p) > 0 && area > 0) {
+			reversed := make([]Point, len(points))
+			for i, point := range points {
+				reversed[len(points)-1-i] = point
+			}
+			points = reversed
+		}
+		p = append(p, points)
+	}
+	return p, nil
+}
+
+// GeoWithinGeoJSON parses GeoJSON with ParseGeoJSON and matches the documents
+// within its polygons, several polygons are merged into one MultiPolygon
+// { <field>: { $geoWithin: { $geometry: <polygon | multipolygon> } } }
+func (f filterDocBuilder) GeoWithinGeoJSON(fieldName string, data []byte) filterDocBuilder {
+	geometries, err := ParseGeoJSON(data)
+	if err != nil {
+		return f.fail(err)
+	}
+	if len(geometries) == 1 {
+		return f.GeoWithin(fieldName, geometries[0])
+	}
+	var m MultiPolygon
+	for _, g := range geometries {
+		switch p := g.(type) {
+		case Polygon:
+			m = append(m, p)
+		case MultiPolygon:
+			m = append(m, p...)
+		default:
+			return f.fail(fmt.Errorf("%w: $geoWithin requires a Polygon or MultiPolygon, got %T", ErrInvalidGeometry, g))
+		}
+	}
+	return f.GeoWithin(fieldName, m)
+}
+
+// GeoIntersectsGeoJSON parses GeoJSON with ParseGeoJSON and matches the documents
+// intersecting any of its geometries, several geometries become a $or
+// { <field>: { $geoIntersects: { $geometry: <geometry> } } } or { $or: [ ... ] }
+func (f filterDocBuilder) GeoIntersectsGeoJSON(fieldName string, data []byte) filterDocBuilder {
+	geometries, err := ParseGeoJSON(data)
+	if err != nil {
+		return f.fail(err)
+	}
+	if len(geometries) == 1 {
+		return f.GeoIntersects(fieldName, geometries[0])
+	}
+	filters := make([]interface{}, 0, len(geometries))
+	for _, g := range geometries {
+		filters = append(filters, FilterDocBuilder.GeoIntersects(fieldName, g))
+	}
+	return f.Or(filters...)
+}
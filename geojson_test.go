@@ -0,0 +1,102 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	geoJSONPolygon = `{"type": "Polygon", "coordinates": [[[0, 0], [10, 0], [10, 10], [0, 10], [0, 0]]]}`
+	geoJSONFeature = `{"type": "Feature", "properties": {"name": "zone"}, "geometry": ` + geoJSONPolygon + `}`
+)
+
+func TestParseGeometry(t *testing.T) {
+	g, err := ParseGeometry([]byte(`{"type": "Point", "coordinates": [-73.97, 40.77, 12.5]}`))
+	require.NoError(t, err)
+	require.Equal(t, Point{Lng: -73.97, Lat: 40.77}, g)
+
+	g, err = ParseGeometry([]byte(geoJSONPolygon))
+	require.NoError(t, err)
+	require.Equal(t, Polygon{square[0]}, g)
+
+	g, err = ParseGeometry([]byte(`{"type": "MultiPolygon", "coordinates": [[[[0, 0], [10, 0], [10, 10], [0, 10], [0, 0]]]]}`))
+	require.NoError(t, err)
+	require.Equal(t, MultiPolygon{{square[0]}}, g)
+
+	g, err = ParseGeometry([]byte(`{"type": "GeometryCollection", "geometries": [
+		{"type": "LineString", "coordinates": [[0, 0], [1, 1]]},
+		{"type": "MultiPoint", "coordinates": [[2, 2]]}]}`))
+	require.NoError(t, err)
+	require.Equal(t, GeometryCollection{
+		LineString{{Lng: 0, Lat: 0}, {Lng: 1, Lat: 1}},
+		MultiPoint{{Lng: 2, Lat: 2}},
+	}, g)
+
+	// pre-RFC winding is accepted and normalized
+	g, err = ParseGeometry([]byte(`{"type": "Polygon", "coordinates": [
+		[[0, 0], [0, 10], [10, 10], [10, 0], [0, 0]],
+		[[2, 2], [8, 2], [8, 8], [2, 8], [2, 2]]]}`))
+	require.NoError(t, err)
+	require.Equal(t, square, g)
+
+	cases := map[string]string{
+		"json":        `{"type": `,
+		"type":        `{"type": "Circle", "coordinates": [0, 0]}`,
+		"coordinates": `{"type": "Point"}`,
+		"position":    `{"type": "Point", "coordinates": [0]}`,
+		"shape":       `{"type": "Polygon", "coordinates": [0, 0]}`,
+		"open-ring":   `{"type": "Polygon", "coordinates": [[[0, 0], [10, 0], [10, 10], [0, 10]]]}`,
+	}
+	for name, data := range cases {
+		_, err := ParseGeometry([]byte(data))
+		require.True(t, errors.Is(err, ErrInvalidGeometry), name)
+	}
+}
+
+func TestParseGeoJSON(t *testing.T) {
+	geometries, err := ParseGeoJSON([]byte(geoJSONFeature))
+	require.NoError(t, err)
+	require.Equal(t, []Geometry{Polygon{square[0]}}, geometries)
+
+	geometries, err = ParseGeoJSON([]byte(`{"type": "FeatureCollection", "features": [` + geoJSONFeature + `,
+		{"type": "Feature", "properties": {}, "geometry": null},
+		{"type": "Feature", "geometry": {"type": "Point", "coordinates": [1, 2]}}]}`))
+	require.NoError(t, err)
+	require.Equal(t, []Geometry{Polygon{square[0]}, Point{Lng: 1, Lat: 2}}, geometries)
+
+	_, err = ParseGeoJSON([]byte(`{"type": "FeatureCollection", "features": []}`))
+	require.True(t, errors.Is(err, ErrInvalidGeometry))
+	_, err = ParseGeoJSON([]byte(`{"type": "FeatureCollection", "features": [` + geoJSONPolygon + `]}`))
+	require.True(t, errors.Is(err, ErrInvalidGeometry))
+}
+
+func TestFilterDocGeoJSON(t *testing.T) {
+	// { zone: { $geoWithin: { $geometry: { type: "Polygon", coordinates: [ ... ] } } } }
+	doc := FilterDocBuilder.GeoWithinGeoJSON("zone", []byte(geoJSONFeature)).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "zone", Value: bson.D{{Key: "$geoWithin",
+		Value: bson.D{{Key: "$geometry", Value: Polygon{square[0]}.ToD()}}}}}}, doc.ToD())
+
+	// two polygon features become one MultiPolygon
+	collection := []byte(`{"type": "FeatureCollection", "features": [` + geoJSONFeature + `,` + geoJSONFeature + `]}`)
+	doc = FilterDocBuilder.GeoWithinGeoJSON("zone", collection).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "zone", Value: bson.D{{Key: "$geoWithin",
+		Value: bson.D{{Key: "$geometry", Value: MultiPolygon{{square[0]}, {square[0]}}.ToD()}}}}}}, doc.ToD())
+
+	// { $or: [ { zone: { $geoIntersects: ... } }, { zone: { $geoIntersects: ... } } ] }
+	collection = []byte(`{"type": "FeatureCollection", "features": [` + geoJSONFeature + `,
+		{"type": "Feature", "geometry": {"type": "Point", "coordinates": [1, 2]}}]}`)
+	doc = FilterDocBuilder.GeoIntersectsGeoJSON("zone", collection).Doc()
+	require.NoError(t, doc.Err())
+	require.EqualValues(t, bson.D{{Key: "$or", Value: []bson.D{
+		FilterDocBuilder.GeoIntersects("zone", Polygon{square[0]}).Doc().ToD(),
+		FilterDocBuilder.GeoIntersects("zone", Point{Lng: 1, Lat: 2}).Doc().ToD(),
+	}}}, doc.ToD())
+
+	require.True(t, errors.Is(FilterDocBuilder.GeoWithinGeoJSON("zone", collection).Doc().Err(), ErrInvalidGeometry))
+	require.True(t, errors.Is(FilterDocBuilder.GeoIntersectsGeoJSON("zone", []byte(`{}`)).Doc().Err(), ErrInvalidGeometry))
+}
@@ -0,0 +1,239 @@
+package hamster
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lann/builder"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// groupDoc is a $group stage document
+type groupDoc struct {
+	Id     interface{}
+	Fields bson.D
+	// Errors collects the problems found while building the document
+	Errors []error
+}
+
+// groupDocBuilder is a builder for groupDoc
+type groupDocBuilder builder.Builder
+
+var (
+	// GroupDocBuilder is a singleton builder for $group stage documents,
+	// use it with AggregateDocBuilder.Group
+	GroupDocBuilder = builder.Register(groupDocBuilder{}, groupDoc{}).(groupDocBuilder)
+)
+
+// Doc returns the groupDoc instance
+func (g groupDocBuilder) Doc() groupDoc {
+	return builder.GetStruct(g).(groupDoc)
+}
+
+// ToD convert groupDoc to a bson.D $group document
+func (g groupDoc) ToD() bson.D {
+	d := bson.D{{Key: "_id", Value: g.Id}}
+	return append(d, g.Fields...)
+}
+
+// ToM convert groupDoc to a bson.M $group document
+func (g groupDoc) ToM() bson.M {
+	return g.ToD().Map()
+}
+
+// Err returns the first error found while building the document
+func (g groupDoc) Err() error {
+	if len(g.Errors) == 0 {
+		return nil
+	}
+	return g.Errors[0]
+}
+
+// MarshalBSON marshals groupDoc to BSON
+func (g groupDoc) MarshalBSON() ([]byte, error) {
+	if err := g.Err(); err != nil {
+		return nil, err
+	}
+	return bson.Marshal(g.ToD())
+}
+
+func (g groupDocBuilder) failf(format string, args ...interface{}) groupDocBuilder {
+	err := fmt.Errorf("%w: $group "+format, append([]interface{}{ErrInvalidStage}, args...)...)
+	return builder.Append(g, "Errors", err).(groupDocBuilder)
+}
+
+// Id groups by the given expression
+func (g groupDocBuilder) Id(expr interface{}) groupDocBuilder {
+	return builder.Set(g, "Id", bsonValue(expr)).(groupDocBuilder)
+}
+
+// IdField groups by a single field, { _id: "$<field>" }
+func (g groupDocBuilder) IdField(field string) groupDocBuilder {
+	return g.Id("$" + field)
+}
+
+// IdFields groups by a compound key of fields, { _id: { <field>: "$<field>", ... } }.
+// Dots in a field path are replaced by underscores in the key name.
+func (g groupDocBuilder) IdFields(fields ...string) groupDocBuilder {
+	d := make(bson.D, 0, len(fields))
+	for _, field := range fields {
+		d = append(d, bson.E{Key: strings.ReplaceAll(field, ".", "_"), Value: "$" + field})
+	}
+	return g.Id(d)
+}
+
+// IdCompound groups by a compound key of named expressions
+func (g groupDocBuilder) IdCompound(keys bson.D) groupDocBuilder {
+	return g.Id(keys)
+}
+
+// IdNull groups all input documents together, { _id: null }
+func (g groupDocBuilder) IdNull() groupDocBuilder {
+	return builder.Set(g, "Id", nil).(groupDocBuilder)
+}
+
+// Field adds an output field computed by a raw accumulator document
+func (g groupDocBuilder) Field(field string, accumulator interface{}) groupDocBuilder {
+	if field == "" || field == "_id" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+		return g.failf("invalid output field name %q", field)
+	}
+	doc := builder.GetStruct(g).(groupDoc)
+	for _, e := range doc.Fields {
+		if e.Key == field {
+			return g.failf("duplicate output field %q", field)
+		}
+	}
+	return builder.Append(g, "Fields", bson.E{Key: field, Value: bsonValue(accumulator)}).(groupDocBuilder)
+}
+
+func (g groupDocBuilder) accumulate(field, operator string, expr interface{}) groupDocBuilder {
+	return g.Field(field, bson.D{{Key: operator, Value: bsonValue(expr)}})
+}
+
+// Sum adds { <field>: { $sum: <expr> } }
+func (g groupDocBuilder) Sum(field string, expr interface{}) groupDocBuilder {
+	return g.accumulate(field, "$sum", expr)
+}
+
+// Avg adds { <field>: { $avg: <expr> } }
+func (g groupDocBuilder) Avg(field string, expr interface{}) groupDocBuilder {
+	return g.accumulate(field, "$avg", expr)
+}
+
+// Min adds { <field>: { $min: <expr> } }
+func (g groupDocBuilder) Min(field string, expr interface{}) groupDocBuilder {
+	return g.accumulate(field, "$min", expr)
+}
+
+// Max adds { <field>: { $max: <expr> } }
+func (g groupDocBuilder) Max(field string, expr interface{}) groupDocBuilder {
+	return g.accumulate(field, "$max", expr)
+}
+
+// First adds { <field>: { $first: <expr> } }
+func (g groupDocBuilder) First(field string, expr interface{}) groupDocBuilder {
+	return g.accumulate(field, "$first", expr)
+}
+
+// Last adds { <field>: { $last: <expr> } }
+func (g groupDocBuilder) Last(field string, expr interface{}) groupDocBuilder {
+	return g.accumulate(field, "$last", expr)
+}
+
+// Push adds { <field>: { $push: <expr> } }
+func (g groupDocBuilder) Push(field string, expr interface{}) groupDocBuilder {
+	return g.accumulate(field, "$push", expr)
+}
+
+// AddToSet adds { <field>: { $addToSet: <expr> } }
+func (g groupDocBuilder) AddToSet(field string, expr interface{}) groupDocBuilder {
+	return g.accumulate(field, "$addToSet", expr)
+}
+
+// Count adds { <field>: { $count: {} } }
+func (g groupDocBuilder) Count(field string) groupDocBuilder {
+	return g.accumulate(field, "$count", bson.D{})
+}
+
+// StdDevPop adds { <field>: { $stdDevPop: <expr> } }
+func (g groupDocBuilder) StdDevPop(field string, expr interface{}) groupDocBuilder {
+	return g.accumulate(field, "$stdDevPop", expr)
+}
+
+// StdDevSamp adds { <field>: { $stdDevSamp: <expr> } }
+func (g groupDocBuilder) StdDevSamp(field string, expr interface{}) groupDocBuilder {
+	return g.accumulate(field, "$stdDevSamp", expr)
+}
+
+// MergeObjects adds { <field>: { $mergeObjects: <expr> } }
+func (g groupDocBuilder) MergeObjects(field string, expr interface{}) groupDocBuilder {
+	return g.accumulate(field, "$mergeObjects", expr)
+}
+
+// Top adds { <field>: { $top: { sortBy: <sortBy>, output: <output> } } }
+func (g groupDocBuilder) Top(field string, sortBy sortDoc, output interface{}) groupDocBuilder {
+	return g.sorted(field, "$top", 0, sortBy, output)
+}
+
+// Bottom adds { <field>: { $bottom: { sortBy: <sortBy>, output: <output> } } }
+func (g groupDocBuilder) Bottom(field string, sortBy sortDoc, output interface{}) groupDocBuilder {
+	return g.sorted(field, "$bottom", 0, sortBy, output)
+}
+
+// TopN adds { <field>: { $topN: { n: <n>, sortBy: <sortBy>, output: <output> } } }
+func (g groupDocBuilder) TopN(field string, n int64, sortBy sortDoc, output interface{}) groupDocBuilder {
+	if n < 1 {
+		return g.failf("$topN n must be positive, got %d", n)
+	}
+	return g.sorted(field, "$topN", n, sortBy, output)
+}
+
+// BottomN adds { <field>: { $bottomN: { n: <n>, sortBy: <sortBy>, output: <output> } } }
+func (g groupDocBuilder) BottomN(field string, n int64, sortBy sortDoc, output interface{}) groupDocBuilder {
+	if n < 1 {
+		return g.failf("$bottomN n must be positive, got %d", n)
+	}
+	return g.sorted(field, "$bottomN", n, sortBy, output)
+}
+
+func (g groupDocBuilder) sorted(field, operator string, n int64, sortBy sortDoc, output interface{}) groupDocBuilder {
+	if len(sortBy.ToD()) == 0 {
+		return g.failf("%s requires sortBy", operator)
+	}
+	d := bson.D{}
+	if n > 0 {
+		d = append(d, bson.E{Key: "n", Value: n})
+	}
+	d = append(d, bson.E{Key: "sortBy", Value: sortBy.ToD()}, bson.E{Key: "output", Value: bsonValue(output)})
+	return g.accumulate(field, operator, d)
+}
+
+// FirstN adds { <field>: { $firstN: { input: <input>, n: <n> } } }
+func (g groupDocBuilder) FirstN(field string, n int64, input interface{}) groupDocBuilder {
+	return g.limited(field, "$firstN", n, input)
+}
+
+// LastN adds { <field>: { $lastN: { input: <input>, n: <n> } } }
+func (g groupDocBuilder) LastN(field string, n int64, input interface{}) groupDocBuilder {
+	return g.limited(field, "$lastN", n, input)
+}
+
+// MaxN adds { <field>: { $maxN: { input: <input>, n: <n> } } }
+func (g groupDocBuilder) MaxN(field string, n int64, input interface{}) groupDocBuilder {
+	return g.limited(field, "$maxN", n, input)
+}
+
+// MinN adds { <field>: { $minN: { input: <input>, n: <n> } } }
+func (g groupDocBuilder) MinN(field string, n int64, input interface{}) groupDocBuilder {
+	return g.limited(field, "$minN", n, input)
+}
+
+func (g groupDocBuilder) limited(field, operator string, n int64, input interface{}) groupDocBuilder {
+	if n < 1 {
+		return g.failf("%s n must be positive, got %d", operator, n)
+	}
+	return g.accumulate(field, operator, bson.D{
+		{Key: "input", Value: bsonValue(input)},
+		{Key: "n", Value: n},
+	})
+}
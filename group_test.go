@@ -0,0 +1,122 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestGroupDocBuilder(t *testing.T) {
+	t.Run("test-id", func(t *testing.T) {
+		require.EqualValues(t, bson.D{{Key: "_id", Value: "$item"}},
+			GroupDocBuilder.IdField("item").Doc().ToD())
+
+		require.EqualValues(t, bson.D{{Key: "_id", Value: nil}},
+			GroupDocBuilder.IdNull().Doc().ToD())
+
+		require.EqualValues(t, bson.D{{Key: "_id", Value: bson.D{
+			{Key: "item", Value: "$item"},
+			{Key: "address_city", Value: "$address.city"},
+		}}}, GroupDocBuilder.IdFields("item", "address.city").Doc().ToD())
+	})
+
+	t.Run("test-accumulators", func(t *testing.T) {
+		// { _id: "$item", totalSaleAmount: { $sum: { $multiply: [ "$price", "$quantity" ] } },
+		//   averageQuantity: { $avg: "$quantity" }, count: { $count: {} } }
+		multiply := bson.D{{Key: "$multiply", Value: bson.A{"$price", "$quantity"}}}
+		doc := GroupDocBuilder.IdField("item").
+			Sum("totalSaleAmount", multiply).
+			Avg("averageQuantity", "$quantity").
+			Min("minPrice", "$price").
+			Max("maxPrice", "$price").
+			First("firstSale", "$date").
+			Last("lastSale", "$date").
+			Push("quantities", "$quantity").
+			AddToSet("stores", "$store").
+			StdDevPop("popDev", "$quantity").
+			StdDevSamp("sampDev", "$quantity").
+			MergeObjects("merged", "$details").
+			Count("count").
+			Doc()
+
+		std := bson.D{
+			{Key: "_id", Value: "$item"},
+			{Key: "totalSaleAmount", Value: bson.D{{Key: "$sum", Value: multiply}}},
+			{Key: "averageQuantity", Value: bson.D{{Key: "$avg", Value: "$quantity"}}},
+			{Key: "minPrice", Value: bson.D{{Key: "$min", Value: "$price"}}},
+			{Key: "maxPrice", Value: bson.D{{Key: "$max", Value: "$price"}}},
+			{Key: "firstSale", Value: bson.D{{Key: "$first", Value: "$date"}}},
+			{Key: "lastSale", Value: bson.D{{Key: "$last", Value: "$date"}}},
+			{Key: "quantities", Value: bson.D{{Key: "$push", Value: "$quantity"}}},
+			{Key: "stores", Value: bson.D{{Key: "$addToSet", Value: "$store"}}},
+			{Key: "popDev", Value: bson.D{{Key: "$stdDevPop", Value: "$quantity"}}},
+			{Key: "sampDev", Value: bson.D{{Key: "$stdDevSamp", Value: "$quantity"}}},
+			{Key: "merged", Value: bson.D{{Key: "$mergeObjects", Value: "$details"}}},
+			{Key: "count", Value: bson.D{{Key: "$count", Value: bson.D{}}}},
+		}
+		require.NoError(t, doc.Err())
+		require.EqualValues(t, std, doc.ToD())
+	})
+
+	t.Run("test-n-accumulators", func(t *testing.T) {
+		// { _id: "$gameId", playerId: { $topN: { n: 3, sortBy: { score: -1 }, output: [ "$playerId", "$score" ] } } }
+		sortBy := SortDocBuilder.OrderDescBy("score").Doc()
+		doc := GroupDocBuilder.IdField("gameId").
+			Top("best", sortBy, "$playerId").
+			Bottom("worst", sortBy, "$playerId").
+			TopN("top3", 3, sortBy, bson.A{"$playerId", "$score"}).
+			BottomN("bottom3", 3, sortBy, "$playerId").
+			FirstN("firstThree", 3, "$score").
+			LastN("lastThree", 3, "$score").
+			MaxN("maxThree", 3, "$score").
+			MinN("minThree", 3, "$score").
+			Doc()
+
+		std := bson.D{
+			{Key: "_id", Value: "$gameId"},
+			{Key: "best", Value: bson.D{{Key: "$top", Value: bson.D{
+				{Key: "sortBy", Value: sortBy.ToD()}, {Key: "output", Value: "$playerId"}}}}},
+			{Key: "worst", Value: bson.D{{Key: "$bottom", Value: bson.D{
+				{Key: "sortBy", Value: sortBy.ToD()}, {Key: "output", Value: "$playerId"}}}}},
+			{Key: "top3", Value: bson.D{{Key: "$topN", Value: bson.D{
+				{Key: "n", Value: int64(3)}, {Key: "sortBy", Value: sortBy.ToD()},
+				{Key: "output", Value: bson.A{"$playerId", "$score"}}}}}},
+			{Key: "bottom3", Value: bson.D{{Key: "$bottomN", Value: bson.D{
+				{Key: "n", Value: int64(3)}, {Key: "sortBy", Value: sortBy.ToD()}, {Key: "output", Value: "$playerId"}}}}},
+			{Key: "firstThree", Value: bson.D{{Key: "$firstN", Value: bson.D{{Key: "input", Value: "$score"}, {Key: "n", Value: int64(3)}}}}},
+			{Key: "lastThree", Value: bson.D{{Key: "$lastN", Value: bson.D{{Key: "input", Value: "$score"}, {Key: "n", Value: int64(3)}}}}},
+			{Key: "maxThree", Value: bson.D{{Key: "$maxN", Value: bson.D{{Key: "input", Value: "$score"}, {Key: "n", Value: int64(3)}}}}},
+			{Key: "minThree", Value: bson.D{{Key: "$minN", Value: bson.D{{Key: "input", Value: "$score"}, {Key: "n", Value: int64(3)}}}}},
+		}
+		require.NoError(t, doc.Err())
+		require.EqualValues(t, std, doc.ToD())
+	})
+
+	t.Run("test-validate", func(t *testing.T) {
+		doc := GroupDocBuilder.IdNull().Sum("total", "$qty").Sum("total", "$price").Doc()
+		require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+
+		doc = GroupDocBuilder.IdNull().Sum("a.b", "$qty").Doc()
+		require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+
+		doc = GroupDocBuilder.IdNull().TopN("top", 0, SortDocBuilder.OrderAscBy("a").Doc(), "$a").Doc()
+		require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+
+		doc = GroupDocBuilder.IdNull().Top("top", SortDocBuilder.Doc(), "$a").Doc()
+		require.True(t, errors.Is(doc.Err(), ErrInvalidStage))
+
+		_, err := bson.Marshal(doc)
+		require.Error(t, err)
+	})
+
+	t.Run("test-aggregate", func(t *testing.T) {
+		group := GroupDocBuilder.IdField("year").Count("count").Doc()
+		doc := AggregateDocBuilder.Group(group.ToD()).Doc()
+		require.EqualValues(t, bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$year"},
+			{Key: "count", Value: bson.D{{Key: "$count", Value: bson.D{}}}},
+		}}}, doc.ToA()[0])
+	})
+}
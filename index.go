@@ -24,6 +24,15 @@ func (i indexDocBuilder) Doc() indexDoc {
 	return builder.GetStruct(i).(indexDoc)
 }
 
+// ToD returns the index keys, as taken by a hint
+func (i indexDoc) ToD() bson.D {
+	return i.Keys
+}
+
+func (i indexDoc) ToM() bson.M {
+	return i.Keys.Map()
+}
+
 func (i indexDoc) ToModel() mongo.IndexModel {
 	return mongo.IndexModel{Keys: i.Keys, Options: i.Options}
 }
@@ -18,3 +18,9 @@ func TestIndexDocBuilder(t *testing.T) {
 	require.NotNil(t, model.Options.Unique)
 	require.True(t, *model.Options.Unique)
 }
+
+func TestIndexDocHint(t *testing.T) {
+	idx := IndexDocBuilder.Asc("email").Doc()
+	require.EqualValues(t, bson.D{{Key: "email", Value: SortAsc}}, idx.ToD())
+	require.EqualValues(t, bson.M{"email": SortAsc}, idx.ToM())
+}
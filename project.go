@@ -111,8 +111,9 @@ func (p projectDocBuilder) SliceWithSkip(field string, skip, limit int64) projec
 	return builder.Append(p, "Projects", e).(projectDocBuilder)
 }
 
-func (p projectDocBuilder) Field(field string, value bson.D) projectDocBuilder {
-	return builder.Append(p, "Projects", bson.E{field, value}).(projectDocBuilder)
+// Creates a projection to the given field name of a computed value, such as an Expression.
+func (p projectDocBuilder) Field(field string, value interface{}) projectDocBuilder {
+	return builder.Append(p, "Projects", bson.E{Key: field, Value: bsonValue(value)}).(projectDocBuilder)
 }
 
 // Creates a $meta projection to the given field name for the given meta field name.
@@ -124,3 +125,18 @@ func (p projectDocBuilder) Meta(field, metaFieldName string) projectDocBuilder {
 func (p projectDocBuilder) MetaTextScore(field string) projectDocBuilder {
 	return p.Meta(field, "textScore")
 }
+
+// Creates a projection to the given field name of the Atlas Search score, for use after $search.
+func (p projectDocBuilder) MetaSearchScore(field string) projectDocBuilder {
+	return p.Meta(field, "searchScore")
+}
+
+// Creates a projection to the given field name of the Atlas Search highlights, for use after a $search with highlight.
+func (p projectDocBuilder) MetaSearchHighlights(field string) projectDocBuilder {
+	return p.Meta(field, "searchHighlights")
+}
+
+// Creates a projection to the given field name of the Atlas Vector Search score, for use after $vectorSearch.
+func (p projectDocBuilder) MetaVectorSearchScore(field string) projectDocBuilder {
+	return p.Meta(field, "vectorSearchScore")
+}
@@ -107,6 +107,15 @@ func TestProjectDoc(t *testing.T) {
 
 		p = ProjectDocBuilder.MetaTextScore("x").Doc().ToD()
 		require.EqualValues(t, p, d)
+
+		p = ProjectDocBuilder.MetaSearchScore("x").MetaSearchHighlights("y").Doc().ToD()
+		require.EqualValues(t, bson.D{
+			{Key: "x", Value: bson.D{{Key: "$meta", Value: "searchScore"}}},
+			{Key: "y", Value: bson.D{{Key: "$meta", Value: "searchHighlights"}}},
+		}, p)
+
+		p = ProjectDocBuilder.MetaVectorSearchScore("x").Doc().ToD()
+		require.EqualValues(t, bson.D{{Key: "x", Value: bson.D{{Key: "$meta", Value: "vectorSearchScore"}}}}, p)
 	})
 
 	t.Run("test-field", func(t *testing.T) {
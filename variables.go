@@ -0,0 +1,153 @@
+package hamster
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrUndeclaredVariable is returned when a $$variable is referenced but never declared
+var ErrUndeclaredVariable = errors.New("hamster: undeclared variable")
+
+// systemVariables are the $$ variables the server always provides
+var systemVariables = map[string]bool{
+	"ROOT":         true,
+	"CURRENT":      true,
+	"REMOVE":       true,
+	"NOW":          true,
+	"CLUSTER_TIME": true,
+	"DESCEND":      true,
+	"PRUNE":        true,
+	"KEEP":         true,
+	"SEARCH_META":  true,
+	"USER_ROLES":   true,
+}
+
+// variableName returns the variable name of a "$$name.path" reference
+func variableName(s string) (string, bool) {
+	if !strings.HasPrefix(s, "$$") || len(s) == 2 {
+		return "", false
+	}
+	name := s[2:]
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	return name, true
+}
+
+// variableScope is the stack of the variables visible at a point of a pipeline,
+// each $let, $map, $filter, $reduce and nested $lookup body pushes its own
+type variableScope []map[string]bool
+
+func (s variableScope) has(name string) bool {
+	for _, vars := range s {
+		if vars[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// with returns the scope of a body binding names, s is left untouched
+func (s variableScope) with(names ...string) variableScope {
+	vars := make(map[string]bool, len(names))
+	for _, name := range names {
+		vars[name] = true
+	}
+	return append(s[:len(s):len(s)], vars)
+}
+
+// checkVariables returns an error for the first $$ variable used in v that is
+// neither in declared, a system variable, nor bound by an enclosing $let,
+// $map, $filter, $reduce or nested $lookup
+func checkVariables(v interface{}, declared map[string]bool) error {
+	return variableScope{declared}.check(v)
+}
+
+func (s variableScope) check(v interface{}) error {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case string:
+		if name, ok := variableName(t); ok && !systemVariables[name] && !s.has(name) {
+			return fmt.Errorf("%w: $$%s", ErrUndeclaredVariable, name)
+		}
+		return nil
+	case Expression:
+		return s.check(t.Value())
+	case aggregateDoc:
+		return s.check(t.ToA())
+	}
+	if d, ok := toDocument(v); ok {
+		for _, e := range d {
+			if err := s.checkElement(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, elem := range arrayOf(v) {
+		if err := s.check(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkElement checks a field, the body of an operator binding variables is
+// checked in a scope holding them and its other fields in s
+func (s variableScope) checkElement(e bson.E) error {
+	body := documentOf(e.Value)
+	if body == nil {
+		return s.check(e.Value)
+	}
+	var bodyKey string
+	var inner variableScope
+	switch e.Key {
+	case "$let":
+		bodyKey, inner = "in", s.with(declaredNames(body, "vars")...)
+	case "$map", "$filter":
+		as := "this"
+		for _, b := range body {
+			if name, ok := b.Value.(string); ok && b.Key == "as" {
+				as = name
+			}
+		}
+		bodyKey, inner = "in", s.with(as)
+		if e.Key == "$filter" {
+			bodyKey = "cond"
+		}
+	case "$reduce":
+		bodyKey, inner = "in", s.with("this", "value")
+	case "$lookup":
+		bodyKey, inner = "pipeline", s.with(declaredNames(body, "let")...)
+	default:
+		return s.check(e.Value)
+	}
+	for _, b := range body {
+		scope := s
+		if b.Key == bodyKey {
+			scope = inner
+		}
+		if err := scope.check(b.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// declaredNames returns the names of the variables declared by the key field of body
+func declaredNames(body bson.D, key string) []string {
+	var names []string
+	for _, b := range body {
+		if b.Key != key {
+			continue
+		}
+		for _, decl := range documentOf(b.Value) {
+			names = append(names, decl.Key)
+		}
+	}
+	return names
+}
@@ -0,0 +1,68 @@
+package hamster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCheckVariables(t *testing.T) {
+	mapped := bson.D{{Key: "$map", Value: bson.D{
+		{Key: "input", Value: "$items"},
+		{Key: "as", Value: "item"},
+		{Key: "in", Value: "$$item.name"},
+	}}}
+	reduced := bson.D{{Key: "$reduce", Value: bson.D{
+		{Key: "input", Value: "$items"},
+		{Key: "initialValue", Value: 0},
+		{Key: "in", Value: bson.D{{Key: "$add", Value: bson.A{"$$value", "$$this"}}}},
+	}}}
+	valid := map[string]interface{}{
+		"declared": bson.D{{Key: "a", Value: "$$tenant"}},
+		"system":   bson.A{"$$ROOT", "$$NOW", "$$REMOVE"},
+		"map":      mapped,
+		"filter": bson.D{{Key: "$filter", Value: bson.D{
+			{Key: "input", Value: "$items"},
+			{Key: "cond", Value: bson.D{{Key: "$gt", Value: bson.A{"$$this.qty", "$$tenant"}}}},
+		}}},
+		"reduce": reduced,
+		"let-bson-m": bson.D{{Key: "$let", Value: bson.D{
+			{Key: "vars", Value: bson.M{"total": "$price"}},
+			{Key: "in", Value: bson.D{{Key: "$gt", Value: bson.A{"$$total", 10}}}},
+		}}},
+		"lookup": bson.D{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: "stock"},
+			{Key: "let", Value: bson.D{{Key: "item", Value: "$item"}}},
+			{Key: "pipeline", Value: bson.A{bson.D{{Key: "$match", Value: bson.D{{Key: "$expr", Value: bson.D{
+				{Key: "$eq", Value: bson.A{"$item", "$$item"}},
+			}}}}}}},
+			{Key: "as", Value: "stock"},
+		}}},
+	}
+	for name, v := range valid {
+		require.NoError(t, checkVariables(v, map[string]bool{"tenant": true}), name)
+	}
+
+	// variables are only visible in the body that binds them
+	invalid := map[string]interface{}{
+		"undeclared":   bson.D{{Key: "a", Value: "$$other"}},
+		"after-map":    bson.A{mapped, "$$item"},
+		"map-input":    bson.D{{Key: "$map", Value: bson.D{{Key: "input", Value: "$$item"}, {Key: "as", Value: "item"}, {Key: "in", Value: 1}}}},
+		"this-renamed": bson.D{{Key: "$map", Value: bson.D{{Key: "input", Value: "$items"}, {Key: "as", Value: "item"}, {Key: "in", Value: "$$this"}}}},
+		"this-outside": bson.D{{Key: "a", Value: "$$this"}},
+		"after-reduce": bson.A{reduced, "$$value"},
+		"let-vars": bson.D{{Key: "$let", Value: bson.D{
+			{Key: "vars", Value: bson.D{{Key: "a", Value: 1}, {Key: "b", Value: "$$a"}}},
+			{Key: "in", Value: "$$b"},
+		}}},
+		"after-lookup": bson.A{
+			bson.D{{Key: "$lookup", Value: bson.D{{Key: "let", Value: bson.D{{Key: "item", Value: "$item"}}}, {Key: "pipeline", Value: bson.A{}}}}},
+			bson.D{{Key: "$match", Value: bson.D{{Key: "$expr", Value: "$$item"}}}},
+		},
+	}
+	for name, v := range invalid {
+		require.True(t, errors.Is(checkVariables(v, map[string]bool{"tenant": true}), ErrUndeclaredVariable), name)
+	}
+}